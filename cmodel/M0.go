@@ -58,18 +58,11 @@ func (m *M0) addParameters(fpg optimize.FloatParameterGenerator) {
 	omega.SetMin(1e-4)
 	omega.SetMax(1000)
 
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.parameters.Append(omega)
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.qdone = false
 		m.expAllBr = false
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-
-	m.parameters.Append(omega)
-	m.parameters.Append(kappa)
 }
 
 // GetParameters returns the model parameter values.
@@ -92,8 +85,7 @@ func (m *M0) SetDefaults() {
 // UpdateMatrix updates Q-matrix after change in the model parameter
 // values.
 func (m *M0) UpdateMatrix() {
-	Q, s := codon.CreateTransitionMatrix(m.data.cFreq, m.kappa, m.omega, m.q.Q)
-	m.q.Set(Q, s)
+	m.setTransitionMatrix(m.q, m.kappa, m.omega, nil)
 
 	err := m.q.Eigen()
 	if err != nil {
@@ -110,5 +102,6 @@ func (m *M0) UpdateMatrix() {
 func (m *M0) update() {
 	if !m.qdone {
 		m.UpdateMatrix()
+		m.qdone = true
 	}
 }
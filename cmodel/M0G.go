@@ -154,17 +154,10 @@ func (m *M0G) addParameters(fpg optimize.FloatParameterGenerator) {
 
 	m.parameters.Append(omega)
 
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.qdone = false
 		m.expAllBr = false
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-
-	m.parameters.Append(kappa)
 
 	if m.ncatsg > 1 {
 		if !m.proportional {
@@ -353,8 +346,7 @@ func (m *M0G) updateMatrices() {
 				m.tmp[2] = m.gammas[c3]
 
 				e := codon.NewEMatrix(m.data.cFreq)
-				Q, s := codon.CreateRateTransitionMatrix(m.data.cFreq, m.kappa, m.omega, m.tmp, e.Q)
-				e.Set(Q, s)
+				m.setTransitionMatrix(e, m.kappa, m.omega, m.tmp)
 				err := e.Eigen()
 				if err != nil {
 					log.Fatal(err)
@@ -367,7 +359,7 @@ func (m *M0G) updateMatrices() {
 					e.Copy(m.q[catid])
 					m.q[catid].ScaleD(rate)
 					m.prop[0][catid] = pq
-					scale += pq * s * rate
+					scale += pq * e.Scale * rate
 				}
 			}
 		}
@@ -433,6 +425,7 @@ func (m *M0G) update() {
 	}
 	if !m.qdone {
 		m.updateMatrices()
+		m.qdone = true
 	}
 }
 
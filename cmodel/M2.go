@@ -2,22 +2,30 @@ package cmodel
 
 import (
 	"math/rand"
+	"strconv"
 	"time"
 
 	"bitbucket.org/Davydov/godon/codon"
 	"bitbucket.org/Davydov/godon/dist"
 	"bitbucket.org/Davydov/godon/optimize"
+	"bitbucket.org/Davydov/godon/tree"
 )
 
-// M2 is an implementation of M1a & M2a models.
+// M2 is an implementation of M1a & M2a models. It also implements
+// M2a_rel and clade models (CmC & CmD), which share the same site
+// classes.
 type M2 struct {
 	*BaseModel
-	q0             []*codon.EMatrix
-	q1             []*codon.EMatrix
-	q2             []*codon.EMatrix
+	q0 []*codon.EMatrix
+	q1 []*codon.EMatrix
+	// q2 stores matrices for every omega2 value
+	q2             [][]*codon.EMatrix
 	p0, p1prop     float64
-	omega0, omega2 float64
-	kappa          float64
+	omega0, omega1 float64
+	// omega2 has a single value, except for the clade models
+	// where every branch class has its own omega2
+	omega2 []float64
+	kappa  float64
 	// site gamma alpha parameter
 	alphas float64
 	gammas []float64
@@ -25,12 +33,22 @@ type M2 struct {
 	alphac float64
 	gammac []float64
 	// only allow omega2 if addw is true
-	addw       bool
+	addw bool
+	// relaxed removes omega2>1 constraint (M2a_rel & clade models)
+	relaxed bool
+	// clade is true for the clade models (CmC & CmD)
+	clade bool
+	// freew1 is true if omega1 is estimated (CmD), otherwise omega1=1
+	freew1 bool
+	// cladeID is omega2 index for every node ID
+	cladeID []int
+	// cladeNames are names of omega2 parameters
+	cladeNames []string
 	ncatsg     int
 	ncatcg     int
 	q0done     bool
 	q1done     bool
-	q2done     bool
+	q2done     []bool
 	propdone   bool
 	gammasdone bool
 	gammacdone bool
@@ -43,36 +61,64 @@ type M2 struct {
 // m2Summary stores summary information.
 type m2Summary struct {
 	SitePosteriorNEB []float64 `json:"sitePosteriorNEB,omitempty"`
+	SitePosteriorBEB []float64 `json:"sitePosteriorBEB,omitempty"`
 	PosteriorTime    float64   `json:"posteriorTime,omitempty"`
 }
 
+// Empty returns true if there's no data in the structure.
+func (s m2Summary) Empty() bool {
+	if s.SitePosteriorNEB == nil && s.SitePosteriorBEB == nil {
+		return true
+	}
+	return false
+}
+
 // NewM2 creates a new M1a or M2a model. If addw is true, M2a is
 // created, otherwise M1a.
 func NewM2(data *Data, addw bool, ncatsg, ncatcg int) (m *M2) {
-	// n site gamma categories, ncatb * n^3 matrices
-	gcat := ncatsg * ncatsg * ncatsg
+	return newM2(data, addw, false, false, false, ncatsg, ncatcg)
+}
+
+// NewM2Rel creates a new M2a_rel model. This is M2a without omega2>1
+// constraint; it is the null model for the clade model C.
+func NewM2Rel(data *Data, ncatsg, ncatcg int) (m *M2) {
+	return newM2(data, true, true, false, false, ncatsg, ncatcg)
+}
+
+// NewCladeModel creates a new clade model. In the clade models every
+// branch class has its own omega2 for the divergent site class. If
+// cmd is true, CmD is created (omega1 is estimated), otherwise CmC
+// (omega1=1).
+func NewCladeModel(data *Data, cmd bool, ncatsg, ncatcg int) (m *M2) {
+	return newM2(data, true, true, true, cmd, ncatsg, ncatcg)
+}
+
+// newM2 creates a new model with M2-like site classes.
+func newM2(data *Data, addw, relaxed, clade, freew1 bool, ncatsg, ncatcg int) (m *M2) {
 	m = &M2{
-		addw:   addw,
-		ncatsg: ncatsg,
-		ncatcg: ncatcg,
-		q0:     make([]*codon.EMatrix, gcat*ncatcg),
-		q1:     make([]*codon.EMatrix, gcat*ncatcg),
-		q2:     make([]*codon.EMatrix, gcat*ncatcg),
-		gammas: make([]float64, ncatsg),
-		gammac: make([]float64, ncatcg),
-		tmp:    make([]float64, maxInt(ncatsg, ncatcg, 3)),
-	}
-
-	for i := 0; i < gcat*ncatcg; i++ {
-		m.q0[i] = codon.NewEMatrix(data.cFreq)
-		m.q1[i] = codon.NewEMatrix(data.cFreq)
-		if addw {
-			m.q2[i] = codon.NewEMatrix(data.cFreq)
-		}
+		addw:    addw,
+		relaxed: relaxed,
+		clade:   clade,
+		freew1:  freew1,
+		ncatsg:  ncatsg,
+		ncatcg:  ncatcg,
+		omega1:  1,
+		gammas:  make([]float64, ncatsg),
+		gammac:  make([]float64, ncatcg),
+		tmp:     make([]float64, maxInt(ncatsg, ncatcg, 3)),
 	}
 
 	m.BaseModel = NewBaseModel(data, m)
 
+	m.setCladeClasses()
+	m.omega2 = make([]float64, len(m.cladeNames))
+	m.q2done = make([]bool, len(m.cladeNames))
+	m.newMatrices()
+
+	if clade && len(m.cladeNames) < 2 {
+		log.Warning("Only one branch class found, clade model is equivalent to the model without clades")
+	}
+
 	m.setupParameters()
 	m.setBranchMatrices()
 	m.SetDefaults()
@@ -91,35 +137,31 @@ func (m *M2) GetNClass() int {
 // Copy makes a copy of the model preserving the model parameter
 // values.
 func (m *M2) Copy() optimize.Optimizable {
-	// n inner gamma categories, ncatb * n^3 matrices
-	gcat := m.ncatsg * m.ncatsg * m.ncatsg
 	newM := &M2{
-		BaseModel: m.BaseModel.Copy(),
-		q0:        make([]*codon.EMatrix, gcat*m.ncatcg),
-		q1:        make([]*codon.EMatrix, gcat*m.ncatcg),
-		q2:        make([]*codon.EMatrix, gcat*m.ncatcg),
-		tmp:       make([]float64, maxInt(m.ncatsg, m.ncatcg, 3)),
-		ncatsg:    m.ncatsg,
-		ncatcg:    m.ncatcg,
-		gammas:    make([]float64, m.ncatsg),
-		gammac:    make([]float64, m.ncatcg),
-		addw:      m.addw,
-		p0:        m.p0,
-		p1prop:    m.p1prop,
-		omega0:    m.omega0,
-		omega2:    m.omega2,
-		kappa:     m.kappa,
-		alphas:    m.alphas,
-		alphac:    m.alphac,
-	}
-
-	for i := 0; i < gcat*m.ncatcg; i++ {
-		newM.q0[i] = codon.NewEMatrix(m.data.cFreq)
-		newM.q1[i] = codon.NewEMatrix(m.data.cFreq)
-		if m.addw {
-			newM.q2[i] = codon.NewEMatrix(m.data.cFreq)
-		}
+		BaseModel:  m.BaseModel.Copy(),
+		tmp:        make([]float64, maxInt(m.ncatsg, m.ncatcg, 3)),
+		ncatsg:     m.ncatsg,
+		ncatcg:     m.ncatcg,
+		gammas:     make([]float64, m.ncatsg),
+		gammac:     make([]float64, m.ncatcg),
+		addw:       m.addw,
+		relaxed:    m.relaxed,
+		clade:      m.clade,
+		freew1:     m.freew1,
+		cladeID:    m.cladeID,
+		cladeNames: m.cladeNames,
+		p0:         m.p0,
+		p1prop:     m.p1prop,
+		omega0:     m.omega0,
+		omega1:     m.omega1,
+		omega2:     make([]float64, len(m.omega2)),
+		q2done:     make([]bool, len(m.q2done)),
+		kappa:      m.kappa,
+		alphas:     m.alphas,
+		alphac:     m.alphac,
 	}
+	copy(newM.omega2, m.omega2)
+	newM.newMatrices()
 
 	newM.BaseModel.model = newM
 	newM.setupParameters()
@@ -127,6 +169,62 @@ func (m *M2) Copy() optimize.Optimizable {
 	return newM
 }
 
+// newMatrices allocates all the matrices.
+func (m *M2) newMatrices() {
+	// n site gamma categories, ncatcg * n^3 matrices
+	n := m.ncatsg * m.ncatsg * m.ncatsg * m.ncatcg
+	m.q0 = make([]*codon.EMatrix, n)
+	m.q1 = make([]*codon.EMatrix, n)
+	m.q2 = make([][]*codon.EMatrix, len(m.omega2))
+	for i := 0; i < n; i++ {
+		m.q0[i] = codon.NewEMatrix(m.data.cFreq)
+		m.q1[i] = codon.NewEMatrix(m.data.cFreq)
+	}
+	if m.addw {
+		for j := range m.q2 {
+			m.q2[j] = make([]*codon.EMatrix, n)
+			for i := 0; i < n; i++ {
+				m.q2[j][i] = codon.NewEMatrix(m.data.cFreq)
+			}
+		}
+	}
+}
+
+// setCladeClasses computes omega2 index for every branch and names
+// of the omega2 parameters.
+func (m *M2) setCladeClasses() {
+	if !m.clade {
+		m.cladeID = make([]int, m.data.Tree.MaxNodeID()+1)
+		m.cladeNames = []string{"omega2"}
+		return
+	}
+	var classes []int
+	classes, m.cladeID = branchClasses(m.data.Tree, func(node *tree.Node) int {
+		return node.Class
+	})
+	m.cladeNames = make([]string, len(classes))
+	for i, class := range classes {
+		m.cladeNames[i] = "omega2_" + strconv.Itoa(class)
+	}
+}
+
+// resetQ2 marks all omega2 matrices for recomputation.
+func (m *M2) resetQ2() {
+	for i := range m.q2done {
+		m.q2done[i] = false
+	}
+}
+
+// q2Ready returns true if no omega2 matrices need recomputation.
+func (m *M2) q2Ready() bool {
+	for _, done := range m.q2done {
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
 // addParameters adds all the model parameters to the parameter
 // storage.
 func (m *M2) addParameters(fpg optimize.FloatParameterGenerator) {
@@ -140,28 +238,39 @@ func (m *M2) addParameters(fpg optimize.FloatParameterGenerator) {
 	p0.SetProposalFunc(optimize.NormalProposal(0.01))
 	m.parameters.Append(p0)
 
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.q0done = false
 		m.q1done = false
-		m.q2done = false
+		m.resetQ2()
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-	m.parameters.Append(kappa)
 
 	omega0 := fpg(&m.omega0, "omega0")
 	omega0.SetOnChange(func() {
 		m.q0done = false
 	})
-	omega0.SetPriorFunc(optimize.UniformPrior(0, 1, false, false))
+	if m.freew1 {
+		omega0.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+		omega0.SetMax(1000)
+	} else {
+		omega0.SetPriorFunc(optimize.UniformPrior(0, 1, false, false))
+		omega0.SetMax(1)
+	}
 	omega0.SetProposalFunc(optimize.NormalProposal(0.01))
 	omega0.SetMin(1e-4)
-	omega0.SetMax(1)
 	m.parameters.Append(omega0)
 
+	if m.freew1 {
+		omega1 := fpg(&m.omega1, "omega1")
+		omega1.SetOnChange(func() {
+			m.q1done = false
+		})
+		omega1.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+		omega1.SetProposalFunc(optimize.NormalProposal(0.01))
+		omega1.SetMin(1e-4)
+		omega1.SetMax(1000)
+		m.parameters.Append(omega1)
+	}
+
 	if m.addw {
 		p1prop := fpg(&m.p1prop, "p1prop")
 		p1prop.SetOnChange(func() {
@@ -173,15 +282,22 @@ func (m *M2) addParameters(fpg optimize.FloatParameterGenerator) {
 		p1prop.SetProposalFunc(optimize.NormalProposal(0.01))
 		m.parameters.Append(p1prop)
 
-		omega2 := fpg(&m.omega2, "omega2")
-		omega2.SetOnChange(func() {
-			m.q2done = false
-		})
-		omega2.SetPriorFunc(optimize.GammaPrior(1, 2, false))
-		omega2.SetProposalFunc(optimize.NormalProposal(0.01))
-		omega2.SetMin(1)
-		omega2.SetMax(1000)
-		m.parameters.Append(omega2)
+		for i := range m.omega2 {
+			i := i
+			omega2 := fpg(&m.omega2[i], m.cladeNames[i])
+			omega2.SetOnChange(func() {
+				m.q2done[i] = false
+			})
+			omega2.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+			omega2.SetProposalFunc(optimize.NormalProposal(0.01))
+			if m.relaxed {
+				omega2.SetMin(1e-4)
+			} else {
+				omega2.SetMin(1)
+			}
+			omega2.SetMax(1000)
+			m.parameters.Append(omega2)
+		}
 	}
 
 	if m.ncatsg > 1 {
@@ -209,12 +325,33 @@ func (m *M2) addParameters(fpg optimize.FloatParameterGenerator) {
 	}
 }
 
-// GetParameters returns the model parameter values.
+// GetParameters returns the model parameter values. For the clade
+// models omega2 of the first branch class is returned.
 func (m *M2) GetParameters() (p0, p1prop, omega0, omega2, kappa, alphas, alphac float64) {
-	return m.p0, m.p1prop, m.omega0, m.omega2, m.kappa, m.alphas, m.alphac
+	return m.p0, m.p1prop, m.omega0, m.omega2[0], m.kappa, m.alphas, m.alphac
 }
 
-// SetParameters sets the model parameter values.
+// GetCladeParameters returns omega1 and omega2 for every branch
+// class (sorted by the class).
+func (m *M2) GetCladeParameters() (omega1 float64, omega2 []float64) {
+	omega2 = make([]float64, len(m.omega2))
+	copy(omega2, m.omega2)
+	return m.omega1, omega2
+}
+
+// SetCladeParameters sets omega1 (only for CmD) and omega2 for every
+// branch class (sorted by the class).
+func (m *M2) SetCladeParameters(omega1 float64, omega2 ...float64) {
+	if m.freew1 {
+		m.omega1 = omega1
+		m.q1done = false
+	}
+	copy(m.omega2, omega2)
+	m.resetQ2()
+}
+
+// SetParameters sets the model parameter values. For the clade
+// models omega2 is used for all the branch classes.
 func (m *M2) SetParameters(p0, p1prop, omega0, omega2, kappa, alphas, alphac float64) {
 	if m.addw {
 		m.p1prop = p1prop
@@ -224,14 +361,16 @@ func (m *M2) SetParameters(p0, p1prop, omega0, omega2, kappa, alphas, alphac flo
 	m.p0 = p0
 	m.kappa = kappa
 	m.omega0 = omega0
-	m.omega2 = omega2
+	for i := range m.omega2 {
+		m.omega2[i] = omega2
+	}
 	m.alphas = alphas
 	m.alphac = alphac
 	m.gammasdone = false
 	m.gammacdone = false
 	m.q0done = false
 	m.q1done = false
-	m.q2done = false
+	m.resetQ2()
 }
 
 // SetDefaults sets the default initial parameter values.
@@ -244,6 +383,9 @@ func (m *M2) SetDefaults() {
 	alphas := 1e-3 + rand.Float64()*10
 	alphac := 1e-3 + rand.Float64()*10
 	m.SetParameters(p0, p1prop, omega0, omega2, kappa, alphas, alphac)
+	if m.freew1 {
+		m.omega1 = 0.5 + rand.Float64()
+	}
 }
 
 // Organization of the class categories.
@@ -265,6 +407,8 @@ func (m *M2) SetDefaults() {
 //   omega2, internal gamma cat ncatsg^3, external gamma cat ncatcg
 // ]
 // (total: 3 * ncatsg^3 * ncatcg
+// For the clade models omega2 depends on the branch class. For CmD
+// omega1 is estimated.
 
 // setBranchMatrices set matrices for all the branches.
 func (m *M2) setBranchMatrices() {
@@ -278,7 +422,7 @@ func (m *M2) setBranchMatrices() {
 				m.qs[i+j*m.ncatcg+0*scat*m.ncatcg][node.ID] = m.q0[i+j*m.ncatcg]
 				m.qs[i+j*m.ncatcg+1*scat*m.ncatcg][node.ID] = m.q1[i+j*m.ncatcg]
 				if m.addw {
-					m.qs[i+j*m.ncatcg+2*scat*m.ncatcg][node.ID] = m.q2[i+j*m.ncatcg]
+					m.qs[i+j*m.ncatcg+2*scat*m.ncatcg][node.ID] = m.q2[m.cladeID[node.ID]][i+j*m.ncatcg]
 				}
 			}
 		}
@@ -295,8 +439,7 @@ func (m *M2) fillMatrices(omega float64, dest []*codon.EMatrix) {
 				m.tmp[2] = m.gammas[c3]
 
 				e := codon.NewEMatrix(m.data.cFreq)
-				Q, s := codon.CreateRateTransitionMatrix(m.data.cFreq, m.kappa, omega, m.tmp, e.Q)
-				e.Set(Q, s)
+				m.setTransitionMatrix(e, m.kappa, omega, m.tmp)
 				err := e.Eigen()
 				if err != nil {
 					log.Fatal(err)
@@ -322,49 +465,157 @@ func (m *M2) updateMatrices() {
 	}
 
 	if !m.q1done {
-		m.fillMatrices(1, m.q1)
+		m.fillMatrices(m.omega1, m.q1)
 		m.q1done = true
 	}
 
-	if m.addw && !m.q2done {
-		m.fillMatrices(m.omega2, m.q2)
-		m.q2done = true
+	if m.addw {
+		for i, done := range m.q2done {
+			if !done {
+				m.fillMatrices(m.omega2[i], m.q2[i])
+				m.q2done[i] = true
+			}
+		}
 	}
 
 	m.propdone = false
 }
 
-// Final prints NEB results (only if with positive selection).
+// omegaClassLikelihoods returns the likelihood of every position
+// for the omega class k (0, 1 or 2) averaged over the rate
+// categories and the log scale factors.
+func (m *M2) omegaClassLikelihoods(k int) ([]float64, []float64) {
+	bothcat := m.ncatsg * m.ncatsg * m.ncatsg * m.ncatcg
+	classes := make([]int, bothcat)
+	weights := make([]float64, bothcat)
+	for i := range classes {
+		classes[i] = k*bothcat + i
+		weights[i] = 1 / float64(bothcat)
+	}
+	return m.weightedSiteLikelihoods(classes, weights)
+}
+
+// BEBPosterior returns BEB posterior values of the omega2 class
+// (Yang et al., 2005). p0 and p1 are integrated over the ternary
+// grid, omega0 over U(0, 1) and omega2 over U(1, 11); the other
+// parameters are fixed to their current values.
+func (m *M2) BEBPosterior() (res []float64) {
+	nPos := m.data.cSeqs.Length()
+	omega0, omega2 := m.omega0, m.omega2[0]
+
+	log.Info("w0 and w2 grid")
+
+	w0s := floatRange(0.05, 0.1, bebGridSize)
+	log.Infof("w0: %v", strFltSlice(w0s))
+
+	w2s := floatRange(1.5, 1, bebGridSize)
+	log.Infof("w2: %v", strFltSlice(w2s))
+
+	// this computes the scaling factors, which are kept
+	// for all the grid values
+	m.expBranchesIfNeeded()
+
+	l1, s1 := m.omegaClassLikelihoods(1)
+	l0 := make([][]float64, len(w0s))
+	s0 := make([][]float64, len(w0s))
+	for i, w0 := range w0s {
+		m.omega0 = w0
+		m.q0done = false
+		m.updateMatrices()
+		m.ExpBranches()
+		l0[i], s0[i] = m.omegaClassLikelihoods(0)
+	}
+	l2 := make([][]float64, len(w2s))
+	s2 := make([][]float64, len(w2s))
+	for i, w2 := range w2s {
+		m.omega2[0] = w2
+		m.resetQ2()
+		m.updateMatrices()
+		m.ExpBranches()
+		l2[i], s2[i] = m.omegaClassLikelihoods(2)
+	}
+	// all the likelihoods of a position should have the same scale
+	commonScale(append(append([][]float64{l1}, l0...), l2...),
+		append(append([][]float64{s1}, s0...), s2...))
+
+	// restore the parameter values
+	m.omega0, m.omega2[0] = omega0, omega2
+	m.q0done = false
+	m.resetQ2()
+	m.update()
+
+	type point struct {
+		p0, p1 float64
+		iW0    int
+		iW2    int
+	}
+	points := make([]point, 0, bebGridSize*bebGridSize*len(w0s)*len(w2s))
+	for i := 0; i < bebGridSize; i++ {
+		for j := 0; j <= 2*i; j++ {
+			p0, p1 := ternaryPoint(i, j, bebGridSize)
+			for iW0 := range w0s {
+				for iW2 := range w2s {
+					points = append(points, point{p0, p1, iW0, iW2})
+				}
+			}
+		}
+	}
+	log.Infof("Computed f(x_h|w) for %d classes", len(w0s)+len(w2s)+1)
+
+	return bebPosterior(len(points), nPos, func(ipoint, pos int) (l, lSel float64) {
+		pt := points[ipoint]
+		lSel = (1 - pt.p0 - pt.p1) * l2[pt.iW2][pos]
+		l = pt.p0*l0[pt.iW0][pos] + pt.p1*l1[pos] + lSel
+		return
+	})
+}
+
+// Final prints NEB and BEB results (only if with positive
+// selection).
 func (m *M2) Final(neb, beb, codonRates, siteRates, codonOmega bool) {
 	startTime := time.Now()
 	defer func() { m.summary.PosteriorTime = time.Since(startTime).Seconds() }()
 
-	// if w2=1, do not perform NEB analysis.
-	if !neb || !m.addw {
+	// if w2=1, do not perform NEB & BEB analysis.
+	if !m.addw {
 		return
 	}
 
-	classes := make([]float64, m.GetNClass())
+	if neb {
+		classes := make([]float64, m.GetNClass())
 
-	gcat := m.ncatsg * m.ncatsg * m.ncatsg
+		gcat := m.ncatsg * m.ncatsg * m.ncatsg
 
-	for c1 := 0; c1 < m.ncatsg; c1++ {
-		for c2 := 0; c2 < m.ncatsg; c2++ {
-			for c3 := 0; c3 < m.ncatsg; c3++ {
-				for ecl := range m.gammac {
-					catid := (((c1*m.ncatsg)+c2)*m.ncatsg+c3)*m.ncatcg + ecl
+		for c1 := 0; c1 < m.ncatsg; c1++ {
+			for c2 := 0; c2 < m.ncatsg; c2++ {
+				for c3 := 0; c3 < m.ncatsg; c3++ {
+					for ecl := range m.gammac {
+						catid := (((c1*m.ncatsg)+c2)*m.ncatsg+c3)*m.ncatcg + ecl
 
-					class := 2*gcat*m.ncatcg + catid
-					classes[class] = 1
+						class := 2*gcat*m.ncatcg + catid
+						classes[class] = 1
+					}
 				}
 			}
 		}
+
+		m.summary.SitePosteriorNEB = m.NEBPosterior(classes)
+
+		log.Notice("NEB analysis")
+		m.PrintPosterior(m.summary.SitePosteriorNEB)
 	}
 
-	posterior := m.NEBPosterior(classes)
-	m.summary.SitePosteriorNEB = posterior
+	if beb {
+		if m.relaxed {
+			// omega2 prior is only defined for omega2>1
+			log.Warning("BEB is not available for M2a_rel and clade models")
+			return
+		}
+		m.summary.SitePosteriorBEB = m.BEBPosterior()
 
-	m.PrintPosterior(posterior)
+		log.Notice("BEB analysis")
+		m.PrintPosterior(m.summary.SitePosteriorBEB)
+	}
 }
 
 // updateProportions updates proportions if model parameters are
@@ -406,7 +657,7 @@ func (m *M2) update() {
 			m.gammas = dist.DiscreteGamma(m.alphas, m.alphas, m.ncatsg, false, m.tmp, m.gammas)
 			m.q0done = false
 			m.q1done = false
-			m.q2done = false
+			m.resetQ2()
 		} else {
 			m.gammas[0] = 1
 		}
@@ -417,13 +668,13 @@ func (m *M2) update() {
 			m.gammac = dist.DiscreteGamma(m.alphac, m.alphac, m.ncatcg, false, m.tmp, m.gammac)
 			m.q0done = false
 			m.q1done = false
-			m.q2done = false
+			m.resetQ2()
 		} else {
 			m.gammac[0] = 1
 		}
 		m.gammacdone = true
 	}
-	if !m.q0done || !m.q1done || !m.q2done {
+	if !m.q0done || !m.q1done || !m.q2Ready() {
 		m.updateMatrices()
 	}
 	if !m.propdone {
@@ -431,9 +682,9 @@ func (m *M2) update() {
 	}
 }
 
-// Summary returns the run summary (site posterior for NEB).
+// Summary returns the run summary (site posterior for NEB and BEB).
 func (m *M2) Summary() interface{} {
-	if len(m.summary.SitePosteriorNEB) > 0 {
+	if !m.summary.Empty() {
 		return m.summary
 	}
 	// nil prevents json from printing "{}"
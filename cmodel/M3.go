@@ -0,0 +1,268 @@
+package cmodel
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// M3 is an implementation of M3 (discrete) model.
+type M3 struct {
+	*BaseModel
+	q     []*codon.EMatrix
+	omega []float64
+	// pprop stores the proportions; the first one is p0, and
+	// every next one is a fraction of the remaining proportion.
+	pprop    []float64
+	kappa    float64
+	ncat     int
+	qdone    []bool
+	propdone bool
+	summary  m3Summary
+}
+
+// m3Summary stores summary information.
+type m3Summary struct {
+	SitePosteriorNEB []float64 `json:"sitePosteriorNEB,omitempty"`
+	PosteriorTime    float64   `json:"posteriorTime,omitempty"`
+}
+
+// NewM3 creates a new M3 model with ncat omega categories.
+func NewM3(data *Data, ncat int) (m *M3) {
+	m = &M3{
+		ncat:  ncat,
+		q:     make([]*codon.EMatrix, ncat),
+		omega: make([]float64, ncat),
+		pprop: make([]float64, ncat-1),
+		qdone: make([]bool, ncat),
+	}
+	for i := range m.q {
+		m.q[i] = codon.NewEMatrix(data.cFreq)
+	}
+
+	m.BaseModel = NewBaseModel(data, m)
+
+	m.setupParameters()
+	m.setBranchMatrices()
+	m.SetDefaults()
+	return
+}
+
+// GetNClass returns number of site classes.
+func (m *M3) GetNClass() int {
+	return m.ncat
+}
+
+// Copy makes a copy of the model preserving the model parameter
+// values.
+func (m *M3) Copy() optimize.Optimizable {
+	newM := &M3{
+		BaseModel: m.BaseModel.Copy(),
+		ncat:      m.ncat,
+		q:         make([]*codon.EMatrix, m.ncat),
+		omega:     make([]float64, m.ncat),
+		pprop:     make([]float64, m.ncat-1),
+		qdone:     make([]bool, m.ncat),
+		kappa:     m.kappa,
+	}
+	for i := range newM.q {
+		newM.q[i] = codon.NewEMatrix(m.data.cFreq)
+	}
+	copy(newM.omega, m.omega)
+	copy(newM.pprop, m.pprop)
+	newM.BaseModel.model = newM
+	newM.setupParameters()
+	newM.setBranchMatrices()
+	return newM
+}
+
+// addParameters adds all the model parameters to the parameter
+// storage.
+func (m *M3) addParameters(fpg optimize.FloatParameterGenerator) {
+	m.addNucParameters(fpg, &m.kappa, func() {
+		for i := range m.qdone {
+			m.qdone[i] = false
+		}
+	})
+
+	for i := range m.omega {
+		i := i
+		omega := fpg(&m.omega[i], "omega"+strconv.Itoa(i))
+		omega.SetOnChange(func() {
+			m.qdone[i] = false
+		})
+		omega.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+		omega.SetProposalFunc(optimize.NormalProposal(0.01))
+		omega.SetMin(1e-4)
+		omega.SetMax(1000)
+		m.parameters.Append(omega)
+	}
+
+	for i := range m.pprop {
+		name := "p0"
+		if i > 0 {
+			name = "p" + strconv.Itoa(i) + "prop"
+		}
+		p := fpg(&m.pprop[i], name)
+		p.SetOnChange(func() {
+			m.propdone = false
+		})
+		p.SetPriorFunc(optimize.UniformPrior(0, 1, false, false))
+		p.SetMin(0)
+		p.SetMax(1)
+		p.SetProposalFunc(optimize.NormalProposal(0.01))
+		m.parameters.Append(p)
+	}
+}
+
+// GetParameters returns the model parameter values.
+func (m *M3) GetParameters() (kappa float64, omega, p []float64) {
+	omega = make([]float64, m.ncat)
+	copy(omega, m.omega)
+	p = make([]float64, m.ncat)
+	rest := 1.0
+	for i, pprop := range m.pprop {
+		p[i] = rest * pprop
+		rest -= p[i]
+	}
+	p[m.ncat-1] = rest
+	return m.kappa, omega, p
+}
+
+// SetParameters sets the model parameter values. Omega and p should
+// have ncat values, p should sum up to one.
+func (m *M3) SetParameters(kappa float64, omega, p []float64) {
+	m.kappa = kappa
+	copy(m.omega, omega)
+	rest := 1.0
+	for i := range m.pprop {
+		if rest > 0 {
+			m.pprop[i] = p[i] / rest
+		} else {
+			m.pprop[i] = 0
+		}
+		rest -= p[i]
+	}
+	for i := range m.qdone {
+		m.qdone[i] = false
+	}
+	m.propdone = false
+}
+
+// SetDefaults sets the default initial parameter values.
+func (m *M3) SetDefaults() {
+	kappa := 1e-2 + rand.Float64()*10
+	omega := make([]float64, m.ncat)
+	p := make([]float64, m.ncat)
+	w := 0.2 + 0.1*rand.Float64()
+	for i := range omega {
+		omega[i] = w
+		w *= 3
+		p[i] = 1 / float64(m.ncat)
+	}
+	m.SetParameters(kappa, omega, p)
+}
+
+// setBranchMatrices set matrices for all the branches.
+func (m *M3) setBranchMatrices() {
+	for i := range m.q {
+		for _, node := range m.data.Tree.NodeIDArray() {
+			if node == nil {
+				continue
+			}
+			m.qs[i][node.ID] = m.q[i]
+		}
+	}
+}
+
+// updateMatrices updates matrices if model parameters are changing.
+func (m *M3) updateMatrices() {
+	for i, q := range m.q {
+		if m.qdone[i] {
+			continue
+		}
+		m.setTransitionMatrix(q, m.kappa, m.omega[i], nil)
+		err := q.Eigen()
+		if err != nil {
+			panic("error finding eigen")
+		}
+		m.qdone[i] = true
+	}
+	m.propdone = false
+}
+
+// updateProportions updates proportions if model parameters are
+// changing.
+func (m *M3) updateProportions() {
+	rest := 1.0
+	for i, pprop := range m.pprop {
+		m.prop[0][i] = rest * pprop
+		rest -= m.prop[0][i]
+	}
+	m.prop[0][m.ncat-1] = rest
+
+	scale := 0.0
+	for i, q := range m.q {
+		scale += m.prop[0][i] * q.Scale
+	}
+	for i := range m.scale {
+		m.scale[i] = scale
+	}
+	m.propdone = true
+	m.expAllBr = false
+}
+
+// update updates matrices and proportions.
+func (m *M3) update() {
+	for _, done := range m.qdone {
+		if !done {
+			m.updateMatrices()
+			break
+		}
+	}
+	if !m.propdone {
+		m.updateProportions()
+	}
+}
+
+// Final prints NEB results for the classes with omega>1.
+func (m *M3) Final(neb, beb, codonRates, siteRates, codonOmega bool) {
+	startTime := time.Now()
+	defer func() { m.summary.PosteriorTime = time.Since(startTime).Seconds() }()
+
+	if !neb {
+		return
+	}
+
+	classes := make([]float64, m.GetNClass())
+	positive := false
+	for i, omega := range m.omega {
+		if omega > 1 {
+			classes[i] = 1
+			positive = true
+		}
+	}
+
+	// no classes with positive selection
+	if !positive {
+		return
+	}
+
+	posterior := m.NEBPosterior(classes)
+	m.summary.SitePosteriorNEB = posterior
+
+	log.Notice("NEB analysis")
+	m.PrintPosterior(posterior)
+}
+
+// Summary returns the run summary (site posterior for NEB).
+func (m *M3) Summary() interface{} {
+	if len(m.summary.SitePosteriorNEB) > 0 {
+		return m.summary
+	}
+	// nil prevents json from printing "{}"
+	return nil
+}
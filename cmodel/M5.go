@@ -0,0 +1,399 @@
+package cmodel
+
+import (
+	"math/rand"
+	"time"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/dist"
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// Continuous omega distributions.
+const (
+	// omegaGamma is gamma distribution (M5).
+	omegaGamma = iota
+	// omegaTwoGamma is a mixture of two gamma distributions (M6).
+	omegaTwoGamma
+	// omegaBetaGamma is a mixture of beta and gamma+1
+	// distributions (M10).
+	omegaBetaGamma
+)
+
+// maxDistOmega is the maximum omega for the discretized
+// distributions.
+const maxDistOmega = 1000
+
+// M5 is an implementation of M5 (gamma), M6 (2gamma) and M10
+// (beta&gamma+1) models. Gamma distributions are parametrized using
+// the mean (omega) and the shape (alpha). In M6 the second gamma
+// distribution has the mean of one. In M10 omega is the mean of
+// gamma+1 distribution. Every component is discretized separately
+// into equal-probability categories represented by their means; this
+// differs from the codeml discretization, so the likelihood values
+// are not directly comparable with PAML.
+type M5 struct {
+	*BaseModel
+	qw []*codon.EMatrix
+	// omegas for every class
+	omegas []float64
+	kappa  float64
+	// first component proportion (M6 & M10)
+	p0 float64
+	// gamma (M5, M6) or gamma+1 (M10) mean and shape
+	omega, alpha float64
+	// second gamma shape (M6)
+	alpha2 float64
+	// beta distribution parameters (M10)
+	p, q float64
+	// distribution type
+	dtype int
+	// number of categories for the first and the second
+	// component
+	ncat1, ncat2 int
+	// temporary array for discretization
+	tmp      []float64
+	q1done   bool
+	q2done   bool
+	propdone bool
+	summary  m5Summary
+}
+
+// m5Summary stores summary information.
+type m5Summary struct {
+	SitePosteriorNEB []float64 `json:"sitePosteriorNEB,omitempty"`
+	PosteriorTime    float64   `json:"posteriorTime,omitempty"`
+}
+
+// NewM5 creates a new M5 (gamma) model.
+func NewM5(data *Data, ncatg int) (m *M5) {
+	return newM5(data, omegaGamma, ncatg, 0)
+}
+
+// NewM6 creates a new M6 (2gamma) model.
+func NewM6(data *Data, ncatg int) (m *M5) {
+	return newM5(data, omegaTwoGamma, ncatg, ncatg)
+}
+
+// NewM10 creates a new M10 (beta&gamma+1) model.
+func NewM10(data *Data, ncatb, ncatg int) (m *M5) {
+	return newM5(data, omegaBetaGamma, ncatb, ncatg)
+}
+
+// newM5 creates a new model with a continuous omega distribution.
+func newM5(data *Data, dtype, ncat1, ncat2 int) (m *M5) {
+	if ncat1 < 2 || (dtype != omegaGamma && ncat2 < 2) {
+		panic("continuous omega distribution requires at least two categories")
+	}
+	m = &M5{
+		dtype: dtype,
+		ncat1: ncat1,
+		ncat2: ncat2,
+	}
+	m.init(data.cFreq)
+
+	m.BaseModel = NewBaseModel(data, m)
+
+	m.setupParameters()
+	m.setBranchMatrices()
+	m.SetDefaults()
+	return
+}
+
+// init allocates matrices and arrays.
+func (m *M5) init(cf codon.Frequency) {
+	n := m.ncat1 + m.ncat2
+	m.qw = make([]*codon.EMatrix, n)
+	for i := range m.qw {
+		m.qw[i] = codon.NewEMatrix(cf)
+	}
+	m.omegas = make([]float64, n)
+	m.tmp = make([]float64, maxInt(m.ncat1, m.ncat2))
+}
+
+// GetNClass returns number of site classes.
+func (m *M5) GetNClass() int {
+	return m.ncat1 + m.ncat2
+}
+
+// Copy makes a copy of the model preserving the model parameter
+// values.
+func (m *M5) Copy() optimize.Optimizable {
+	newM := &M5{
+		BaseModel: m.BaseModel.Copy(),
+		kappa:     m.kappa,
+		p0:        m.p0,
+		omega:     m.omega,
+		alpha:     m.alpha,
+		alpha2:    m.alpha2,
+		p:         m.p,
+		q:         m.q,
+		dtype:     m.dtype,
+		ncat1:     m.ncat1,
+		ncat2:     m.ncat2,
+	}
+	newM.init(m.data.cFreq)
+	newM.BaseModel.model = newM
+	newM.setupParameters()
+	newM.setBranchMatrices()
+	return newM
+}
+
+// addParameters adds all the model parameters to the parameter
+// storage.
+func (m *M5) addParameters(fpg optimize.FloatParameterGenerator) {
+	if m.dtype != omegaGamma {
+		p0 := fpg(&m.p0, "p0")
+		p0.SetOnChange(func() {
+			m.propdone = false
+		})
+		p0.SetPriorFunc(optimize.UniformPrior(0, 1, false, false))
+		p0.SetMin(0)
+		p0.SetMax(1)
+		p0.SetProposalFunc(optimize.NormalProposal(0.01))
+		m.parameters.Append(p0)
+	}
+
+	if m.dtype == omegaBetaGamma {
+		p := fpg(&m.p, "p")
+		p.SetOnChange(func() {
+			m.q1done = false
+		})
+		p.SetPriorFunc(optimize.ExponentialPrior(1, false))
+		p.SetMin(0.005)
+		p.SetMax(100)
+		p.SetProposalFunc(optimize.NormalProposal(0.01))
+		m.parameters.Append(p)
+
+		q := fpg(&m.q, "q")
+		q.SetOnChange(func() {
+			m.q1done = false
+		})
+		q.SetPriorFunc(optimize.ExponentialPrior(1, false))
+		q.SetMin(0.005)
+		q.SetMax(100)
+		q.SetProposalFunc(optimize.NormalProposal(0.01))
+		m.parameters.Append(q)
+	}
+
+	m.addNucParameters(fpg, &m.kappa, func() {
+		m.q1done = false
+		m.q2done = false
+	})
+
+	// gamma distribution parameters
+	gammaChange := func() {
+		if m.dtype == omegaBetaGamma {
+			m.q2done = false
+		} else {
+			m.q1done = false
+		}
+	}
+
+	omega := fpg(&m.omega, "omega")
+	omega.SetOnChange(gammaChange)
+	omega.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+	omega.SetProposalFunc(optimize.NormalProposal(0.01))
+	if m.dtype == omegaBetaGamma {
+		omega.SetMin(1 + 1e-3)
+	} else {
+		omega.SetMin(1e-4)
+	}
+	omega.SetMax(100)
+	m.parameters.Append(omega)
+
+	alpha := fpg(&m.alpha, "alpha")
+	alpha.SetOnChange(gammaChange)
+	alpha.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+	alpha.SetProposalFunc(optimize.NormalProposal(0.01))
+	alpha.SetMin(1e-2)
+	alpha.SetMax(1000)
+	m.parameters.Append(alpha)
+
+	if m.dtype == omegaTwoGamma {
+		alpha2 := fpg(&m.alpha2, "alpha2")
+		alpha2.SetOnChange(func() {
+			m.q2done = false
+		})
+		alpha2.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+		alpha2.SetProposalFunc(optimize.NormalProposal(0.01))
+		alpha2.SetMin(1e-2)
+		alpha2.SetMax(1000)
+		m.parameters.Append(alpha2)
+	}
+}
+
+// GetParameters returns the model parameter values.
+func (m *M5) GetParameters() (kappa, p0, omega, alpha, alpha2, p, q float64) {
+	return m.kappa, m.p0, m.omega, m.alpha, m.alpha2, m.p, m.q
+}
+
+// SetParameters sets the model parameter values. Parameters not
+// used by the model are ignored.
+func (m *M5) SetParameters(kappa, p0, omega, alpha, alpha2, p, q float64) {
+	m.kappa = kappa
+	if m.dtype == omegaGamma {
+		m.p0 = 1
+	} else {
+		m.p0 = p0
+	}
+	m.omega = omega
+	m.alpha = alpha
+	m.alpha2 = alpha2
+	m.p = p
+	m.q = q
+	m.q1done = false
+	m.q2done = false
+	m.propdone = false
+}
+
+// SetDefaults sets the default initial parameter values.
+func (m *M5) SetDefaults() {
+	kappa := 1e-2 + rand.Float64()*10
+	p0 := 0.69 + rand.Float64()*0.3
+	omega := 0.2 + 0.1*rand.Float64()
+	if m.dtype == omegaBetaGamma {
+		omega = 2 + rand.Float64()
+	}
+	alpha := 0.5 + rand.Float64()
+	alpha2 := 0.5 + rand.Float64()
+	p := 0.2 + rand.Float64()
+	q := 1 + rand.Float64()
+	m.SetParameters(kappa, p0, omega, alpha, alpha2, p, q)
+}
+
+// Organization of the class categories.
+// first component cat 1
+// ...
+// first component cat ncat1
+// second component cat 1
+// ...
+// second component cat ncat2
+// First component is gamma for M5 & M6 and beta for M10. Second
+// component is gamma with mean of one for M6 and gamma+1 for M10.
+
+// setBranchMatrices set matrices for all the branches.
+func (m *M5) setBranchMatrices() {
+	for i, q := range m.qw {
+		for _, node := range m.data.Tree.NodeIDArray() {
+			if node == nil {
+				continue
+			}
+			m.qs[i][node.ID] = q
+		}
+	}
+}
+
+// fillMatrices computes matrices for the classes.
+func (m *M5) fillMatrices(omegas []float64, qw []*codon.EMatrix) {
+	for i, omega := range omegas {
+		if omega > maxDistOmega {
+			omega = maxDistOmega
+		}
+		m.setTransitionMatrix(qw[i], m.kappa, omega, nil)
+		err := qw[i].Eigen()
+		if err != nil {
+			panic("error finding eigen")
+		}
+	}
+}
+
+// updateMatrices updates matrices if model parameters are changing.
+func (m *M5) updateMatrices() {
+	omegas1 := m.omegas[:m.ncat1]
+	omegas2 := m.omegas[m.ncat1:]
+	if !m.q1done {
+		if m.dtype == omegaBetaGamma {
+			dist.DiscreteBeta(m.p, m.q, m.ncat1, false, m.tmp, omegas1)
+		} else {
+			dist.DiscreteGamma(m.alpha, m.alpha/m.omega, m.ncat1, false, m.tmp, omegas1)
+		}
+		m.fillMatrices(omegas1, m.qw[:m.ncat1])
+		m.q1done = true
+	}
+	if !m.q2done && m.ncat2 > 0 {
+		switch m.dtype {
+		case omegaTwoGamma:
+			dist.DiscreteGamma(m.alpha2, m.alpha2, m.ncat2, false, m.tmp, omegas2)
+		case omegaBetaGamma:
+			dist.DiscreteGamma(m.alpha, m.alpha/(m.omega-1), m.ncat2, false, m.tmp, omegas2)
+			for i := range omegas2 {
+				omegas2[i]++
+			}
+		}
+		m.fillMatrices(omegas2, m.qw[m.ncat1:])
+		m.q2done = true
+	}
+	m.propdone = false
+}
+
+// updateProportions updates proportions if model parameters are
+// changing.
+func (m *M5) updateProportions() {
+	for i := 0; i < m.ncat1; i++ {
+		m.prop[0][i] = m.p0 / float64(m.ncat1)
+	}
+	for i := 0; i < m.ncat2; i++ {
+		m.prop[0][m.ncat1+i] = (1 - m.p0) / float64(m.ncat2)
+	}
+
+	scale := 0.0
+	for i, q := range m.qw {
+		scale += m.prop[0][i] * q.Scale
+	}
+	for i := range m.scale {
+		m.scale[i] = scale
+	}
+	m.propdone = true
+	m.expAllBr = false
+}
+
+// update updates matrices and proportions.
+func (m *M5) update() {
+	if !m.q1done || (!m.q2done && m.ncat2 > 0) {
+		m.updateMatrices()
+	}
+	if !m.propdone {
+		m.updateProportions()
+	}
+}
+
+// Final prints NEB results for the classes with omega>1.
+func (m *M5) Final(neb, beb, codonRates, siteRates, codonOmega bool) {
+	startTime := time.Now()
+	defer func() { m.summary.PosteriorTime = time.Since(startTime).Seconds() }()
+
+	if !neb {
+		return
+	}
+
+	m.update()
+	classes := make([]float64, m.GetNClass())
+	positive := false
+	for i, omega := range m.omegas {
+		if omega > 1 {
+			classes[i] = 1
+			positive = true
+		}
+	}
+
+	// no classes with positive selection
+	if !positive {
+		return
+	}
+
+	posterior := m.NEBPosterior(classes)
+	m.summary.SitePosteriorNEB = posterior
+
+	log.Notice("NEB analysis")
+	m.PrintPosterior(posterior)
+}
+
+// Summary returns the run summary (site posterior for NEB).
+func (m *M5) Summary() interface{} {
+	if len(m.summary.SitePosteriorNEB) > 0 {
+		return m.summary
+	}
+	// nil prevents json from printing "{}"
+	return nil
+}
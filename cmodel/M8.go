@@ -59,6 +59,7 @@ type M8 struct {
 // m8Summary stores summary information.
 type m8Summary struct {
 	SitePosteriorNEB []float64 `json:"sitePosteriorNEB,omitempty"`
+	SitePosteriorBEB []float64 `json:"sitePosteriorBEB,omitempty"`
 	CodonGammaRates  []float64 `json:"codonGammaRates,omitempty"`
 	SiteGammaRates   []float64 `json:"siteGammaRates,omitempty"`
 	CodonOmega       []float64 `json:"codonOmega,omitempty"`
@@ -67,7 +68,7 @@ type m8Summary struct {
 
 // Empty returns true if there's no data in the structure.
 func (s m8Summary) Empty() bool {
-	if s.SitePosteriorNEB == nil && s.CodonGammaRates == nil && s.CodonOmega == nil {
+	if s.SitePosteriorNEB == nil && s.SitePosteriorBEB == nil && s.CodonGammaRates == nil && s.CodonOmega == nil {
 		return true
 	}
 	return false
@@ -218,16 +219,10 @@ func (m *M8) addParameters(fpg optimize.FloatParameterGenerator) {
 	q.SetProposalFunc(optimize.NormalProposal(0.01))
 	m.parameters.Append(q)
 
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.q0done = false
 		m.qbdone = false
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-	m.parameters.Append(kappa)
 
 	if m.addw && !m.fixw {
 		omega := fpg(&m.omega, "omega")
@@ -450,8 +445,7 @@ func (m *M8) updateQ() {
 
 				e := codon.NewEMatrix(m.data.cFreq)
 
-				Q, s := codon.CreateRateTransitionMatrix(m.data.cFreq, m.kappa, m.omega, m.tmp, e.Q)
-				e.Set(Q, s)
+				m.setTransitionMatrix(e, m.kappa, m.omega, m.tmp)
 				err := e.Eigen()
 				if err != nil {
 					panic("error finding eigen")
@@ -497,8 +491,7 @@ func (m *M8) updateQb() {
 
 				for icl, omega := range m.omegab {
 					e := codon.NewEMatrix(m.data.cFreq)
-					Q, s := codon.CreateRateTransitionMatrix(m.data.cFreq, m.kappa, omega, m.tmp, e.Q)
-					e.Set(Q, s)
+					m.setTransitionMatrix(e, m.kappa, omega, m.tmp)
 					err := e.Eigen()
 					if err != nil {
 						panic("error finding eigen")
@@ -662,7 +655,110 @@ func (m *M8) omegaPosterior() []float64 {
 	return m.NEBPosterior(clOmega)
 }
 
-// Final prints NEB results (only if with positive selection).
+// rateClassLikelihoods returns the likelihood of every position for
+// the beta category (or the positive selection class if bcat equals
+// ncatb) averaged over the rate categories.
+func (m *M8) rateClassLikelihoods(bcat int) ([]float64, []float64) {
+	bothcat := m.ncatsg * m.ncatsg * m.ncatsg * m.ncatcg
+	classes := make([]int, 0, bothcat)
+	weights := make([]float64, 0, bothcat)
+	for c1 := 0; c1 < m.ncatsg; c1++ {
+		for c2 := 0; c2 < m.ncatsg; c2++ {
+			for c3 := 0; c3 < m.ncatsg; c3++ {
+				for ecl := range m.gammac {
+					catid := (((c1*m.ncatsg)+c2)*m.ncatsg+c3)*m.ncatcg + ecl
+					classes = append(classes, catid+bothcat*bcat)
+					weights = append(weights, m.gammasprop[c1]*m.gammasprop[c2]*m.gammasprop[c3]*m.gammacprop[ecl])
+				}
+			}
+		}
+	}
+	return m.weightedSiteLikelihoods(classes, weights)
+}
+
+// BEBPosterior returns BEB posterior values of the positive
+// selection class (Yang et al., 2005). p0 is integrated over U(0, 1),
+// p and q over U(0, 2) and omega over U(1, 11); the other parameters
+// are fixed to their current values.
+func (m *M8) BEBPosterior() (res []float64) {
+	nPos := m.data.cSeqs.Length()
+	p, q, omega := m.p, m.q, m.omega
+
+	log.Info("p0, p, q and w grid")
+
+	p0s := floatRange(0.05, 0.1, bebGridSize)
+	log.Infof("p0: %v", strFltSlice(p0s))
+
+	pqs := floatRange(0.1, 0.2, bebGridSize)
+	log.Infof("p, q: %v", strFltSlice(pqs))
+
+	ws := floatRange(1.5, 1, bebGridSize)
+	log.Infof("w: %v", strFltSlice(ws))
+
+	// this computes the scaling factors, which are kept
+	// for all the grid values
+	m.expBranchesIfNeeded()
+
+	// lb stores the likelihood of the beta distribution for
+	// every p and q value
+	lb := make([][][]float64, len(pqs))
+	// all the likelihoods and log scale factors, likelihoods of a
+	// position should have the same scale
+	var ls, scales [][]float64
+	for ip, pv := range pqs {
+		lb[ip] = make([][]float64, len(pqs))
+		for iq, qv := range pqs {
+			m.p, m.q = pv, qv
+			m.updateQb()
+			m.ExpBranches()
+			lb[ip][iq] = make([]float64, nPos)
+			sb := make([]float64, nPos)
+			for bcat := 0; bcat < m.ncatb; bcat++ {
+				l, s := m.rateClassLikelihoods(bcat)
+				for pos := range l {
+					lb[ip][iq][pos], sb[pos] = addScaled(lb[ip][iq][pos], sb[pos], l[pos]/float64(m.ncatb), s[pos])
+				}
+			}
+			ls = append(ls, lb[ip][iq])
+			scales = append(scales, sb)
+		}
+	}
+	lw := make([][]float64, len(ws))
+	for i, w := range ws {
+		m.omega = w
+		m.updateQ()
+		m.ExpBranches()
+		var sw []float64
+		lw[i], sw = m.rateClassLikelihoods(m.ncatb)
+		ls = append(ls, lw[i])
+		scales = append(scales, sw)
+	}
+	commonScale(ls, scales)
+
+	// restore the parameter values
+	m.p, m.q, m.omega = p, q, omega
+	m.qbdone = false
+	m.q0done = false
+	m.update()
+
+	log.Infof("Computed f(x_h|w) for %d classes", len(pqs)*len(pqs)*m.ncatb+len(ws))
+
+	nPoints := len(p0s) * len(pqs) * len(pqs) * len(ws)
+	return bebPosterior(nPoints, nPos, func(point, pos int) (l, lSel float64) {
+		iW := point % len(ws)
+		point /= len(ws)
+		iQ := point % len(pqs)
+		point /= len(pqs)
+		iP := point % len(pqs)
+		p0 := p0s[point/len(pqs)]
+		lSel = (1 - p0) * lw[iW][pos]
+		l = p0*lb[iP][iQ][pos] + lSel
+		return
+	})
+}
+
+// Final prints NEB and BEB results (only if with positive
+// selection).
 func (m *M8) Final(neb, beb, codonRates, siteRates, codonOmega bool) {
 	startTime := time.Now()
 	defer func() { m.summary.PosteriorTime = time.Since(startTime).Seconds() }()
@@ -700,10 +796,17 @@ func (m *M8) Final(neb, beb, codonRates, siteRates, codonOmega bool) {
 			}
 		}
 
-		posterior := m.NEBPosterior(classes)
-		m.summary.SitePosteriorNEB = posterior
+		m.summary.SitePosteriorNEB = m.NEBPosterior(classes)
+
+		log.Notice("NEB analysis")
+		m.PrintPosterior(m.summary.SitePosteriorNEB)
+	}
+
+	if beb && m.addw && !m.fixw {
+		m.summary.SitePosteriorBEB = m.BEBPosterior()
 
-		m.PrintPosterior(posterior)
+		log.Notice("BEB analysis")
+		m.PrintPosterior(m.summary.SitePosteriorBEB)
 	}
 	if m.ncatcg > 1 {
 		m.update()
@@ -36,8 +36,9 @@ type aggSchema struct {
 }
 
 // observedSubL calculates likelihood for given site class and position
-// taking into account only visible states.
-func (m *BaseModel) observedSubL(class, pos int, plh [][]float64, lettersF, lettersA []int) (res float64) {
+// taking into account only visible states. The likelihood is
+// res*exp(scale).
+func (m *BaseModel) observedSubL(class, pos int, plh [][]float64, lettersF, lettersA []int) (res, scale float64) {
 	if len(lettersA) <= 1 {
 		// aggregation makes sense only for two absent
 		// letters or more
@@ -45,7 +46,7 @@ func (m *BaseModel) observedSubL(class, pos int, plh [][]float64, lettersF, lett
 	}
 	fabs := 0.0
 	for _, l := range lettersA {
-		fabs += m.data.cFreq.Freq[l]
+		fabs += m.cFreq.Freq[l]
 	}
 
 	NCodon := m.data.cFreq.GCode.NCodon
@@ -96,7 +97,7 @@ func (m *BaseModel) observedSubL(class, pos int, plh [][]float64, lettersF, lett
 						pai := 0.0
 						if l2 != NCodon {
 							for _, l1 := range lettersA {
-								pai += m.data.cFreq.Freq[l1] * m.eQts[class][child.ID][l1*NCodon+l2]
+								pai += m.cFreq.Freq[l1] * m.eQts[class][child.ID][l1*NCodon+l2]
 							}
 							pai /= fabs
 
@@ -111,12 +112,13 @@ func (m *BaseModel) observedSubL(class, pos int, plh [][]float64, lettersF, lett
 			}
 			plh[node.ID][l1] = l
 		}
+		scale += scalePartialStates(plh[node.ID], lettersF)
 
 		if node.IsRoot() {
 			for _, l := range lettersF {
 				if l != NCodon {
 
-					res += m.data.cFreq.Freq[l] * plh[node.ID][l]
+					res += m.cFreq.Freq[l] * plh[node.ID][l]
 				} else {
 					res += fabs * plh[node.ID][l]
 				}
@@ -143,21 +145,22 @@ func (m *BaseModel) observedStates(lettersF, lettersA []int) (schema *aggSchema)
 		if l != m.data.cFreq.GCode.NCodon {
 			schema.state2codons[i] = append(schema.state2codons[i], l)
 			schema.codon2state[l] = i
-			schema.stateFreq[i] += m.data.cFreq.Freq[l]
+			schema.stateFreq[i] += m.cFreq.Freq[l]
 		}
 	}
 	aState := NStates - 1
 	for _, l := range lettersA {
 		schema.state2codons[aState] = append(schema.state2codons[aState], l)
 		schema.codon2state[l] = aState
-		schema.stateFreq[aState] += m.data.cFreq.Freq[l]
+		schema.stateFreq[aState] += m.cFreq.Freq[l]
 	}
 	return
 }
 
 // aggSubL calculates likelihood for given site class and position
-// using provided aggregation schema.
-func (m *BaseModel) aggSubL(class, pos int, plh [][]float64, schema *aggSchema) (res float64) {
+// using provided aggregation schema. The likelihood is
+// res*exp(scale).
+func (m *BaseModel) aggSubL(class, pos int, plh [][]float64, schema *aggSchema) (res, scale float64) {
 	NStates := len(schema.state2codons)
 	NCodon := m.data.cFreq.GCode.NCodon
 
@@ -193,7 +196,7 @@ func (m *BaseModel) aggSubL(class, pos int, plh [][]float64, schema *aggSchema)
 								pl12 += q[l2]
 
 							}
-							ps12 += m.data.cFreq.Freq[l1] * pl12
+							ps12 += m.cFreq.Freq[l1] * pl12
 						}
 						//s += q.Get(l1, l2) * plh[child.Id][l2]
 						ps12 /= schema.stateFreq[s1]
@@ -211,6 +214,7 @@ func (m *BaseModel) aggSubL(class, pos int, plh [][]float64, schema *aggSchema)
 			}
 			plh[node.ID][s1] = l
 		}
+		scale += scalePartial(plh[node.ID][:NStates])
 
 		if node.IsRoot() {
 			for s := 0; s < NStates; s++ {
@@ -225,8 +229,8 @@ func (m *BaseModel) aggSubL(class, pos int, plh [][]float64, schema *aggSchema)
 }
 
 // fixedSubL calculates likelihood for given site class and position
-// if the site is fixed.
-func (m *BaseModel) fixedSubL(class, pos int, plh [][]float64) (res float64) {
+// if the site is fixed. The likelihood is res*exp(scale).
+func (m *BaseModel) fixedSubL(class, pos int, plh [][]float64) (res, scale float64) {
 	NCodon := m.data.cFreq.GCode.NCodon
 
 	for i := 0; i < m.data.Tree.MaxNodeID()+1; i++ {
@@ -249,19 +253,20 @@ func (m *BaseModel) fixedSubL(class, pos int, plh [][]float64) (res float64) {
 			p10 := 0.0
 			for l1 := 0; l1 < NCodon; l1++ {
 				if l != l1 {
-					p10 += m.data.cFreq.Freq[l1] * m.eQts[class][child.ID][l1*NCodon+l]
+					p10 += m.cFreq.Freq[l1] * m.eQts[class][child.ID][l1*NCodon+l]
 				}
 			}
-			p10 /= (1 - m.data.cFreq.Freq[l])
+			p10 /= (1 - m.cFreq.Freq[l])
 			p11 := 1 - p10
 
 			cplh := plh[child.ID]
 			plh[node.ID][0] *= p00*cplh[0] + p01*cplh[1]
 			plh[node.ID][1] *= p10*cplh[0] + p11*cplh[1]
 		}
+		scale += scalePartial(plh[node.ID][:2])
 
 		if node.IsRoot() {
-			res = m.data.cFreq.Freq[l]*plh[node.ID][0] + (1-m.data.cFreq.Freq[l])*plh[node.ID][1]
+			res = m.cFreq.Freq[l]*plh[node.ID][0] + (1-m.cFreq.Freq[l])*plh[node.ID][1]
 			break
 		}
 
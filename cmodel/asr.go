@@ -0,0 +1,354 @@
+package cmodel
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/gonum/blas"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/tree"
+)
+
+// AncestralNode stores the ancestral sequence reconstruction for an
+// internal node.
+type AncestralNode struct {
+	// NodeID is the node id (as in the tree printed with the
+	// branch ids).
+	NodeID int `json:"nodeID"`
+	// Joint is the joint reconstruction (Pupko et al., 2000).
+	Joint string `json:"joint"`
+	// Marginal is the sequence of codons with the highest
+	// marginal posterior probabilities.
+	Marginal string `json:"marginal"`
+	// MarginalProb are the posterior probabilities of the
+	// marginal reconstruction codons.
+	MarginalProb []float64 `json:"marginalProb"`
+}
+
+// ancestralBuffers is the temporary storage for the ancestral
+// reconstruction of a single position.
+type ancestralBuffers struct {
+	// down are the partial likelihoods of the subtrees
+	down [][]float64
+	// downScale are the log scale factors of down
+	downScale []float64
+	// msg are the partial likelihoods of the subtrees propagated
+	// to the parent node
+	msg [][]float64
+	// up are the likelihoods of the rest of the tree
+	up [][]float64
+	// joint are the posterior probabilities of the node states
+	// for a site class
+	joint [][]float64
+	// post are the marginal posterior probabilities
+	post [][]float64
+	// best are the best states of a node given the parent
+	// state (Pupko et al., 2000)
+	best [][]byte
+	// states are the reconstructed states
+	states []byte
+	tmp    []float64
+}
+
+// newAncestralBuffers allocates buffers for the ancestral
+// reconstruction.
+func newAncestralBuffers(nni, nCodon int) *ancestralBuffers {
+	newMatrix := func() [][]float64 {
+		res := make([][]float64, nni)
+		for i := range res {
+			res[i] = make([]float64, nCodon)
+		}
+		return res
+	}
+	b := &ancestralBuffers{
+		down:      newMatrix(),
+		downScale: make([]float64, nni),
+		msg:       newMatrix(),
+		up:        newMatrix(),
+		joint:     newMatrix(),
+		post:      newMatrix(),
+		best:      make([][]byte, nni),
+		states:    make([]byte, nni),
+		tmp:       make([]float64, nCodon),
+	}
+	for i := range b.best {
+		b.best[i] = make([]byte, nCodon)
+	}
+	return b
+}
+
+// setLeaf sets partial likelihood for a terminal node.
+func (m *BaseModel) setLeaf(node *tree.Node, pos int, plh []float64) {
+	cod := m.data.cSeqs[node.LeafID].Sequence[pos]
+	for l := range plh {
+		if cod == codon.NOCODON || byte(l) == cod {
+			plh[l] = 1
+		} else {
+			plh[l] = 0
+		}
+	}
+}
+
+// marginalSubL computes the likelihood of a position for a site
+// class, and for every internal node the posterior probabilities of
+// the node states given the site class (stored in b.joint). The
+// likelihood is res*exp(scale).
+func (m *BaseModel) marginalSubL(class, pos int, b *ancestralBuffers) (res, scale float64) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nodes := m.data.Tree.NodeOrder()
+
+	for node := range m.data.Tree.Terminals() {
+		m.setLeaf(node, pos, b.down[node.ID])
+		b.downScale[node.ID] = 0
+	}
+
+	// postorder traversal
+	for _, node := range nodes {
+		for l := 0; l < NCodon; l++ {
+			b.down[node.ID][l] = 1
+		}
+		b.downScale[node.ID] = 0
+		for _, child := range node.ChildNodes() {
+			impl.Dgemv(blas.NoTrans, NCodon, NCodon, 1, m.eQts[class][child.ID], NCodon, b.down[child.ID], 1, 0, b.msg[child.ID], 1)
+			for l := 0; l < NCodon; l++ {
+				b.down[node.ID][l] *= b.msg[child.ID][l]
+			}
+			b.downScale[node.ID] += b.downScale[child.ID]
+		}
+		b.downScale[node.ID] += scalePartial(b.down[node.ID])
+	}
+
+	// preorder traversal
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		if node.IsRoot() {
+			copy(b.up[node.ID], m.cFreq.Freq)
+			res = 0
+			for l := 0; l < NCodon; l++ {
+				res += b.up[node.ID][l] * b.down[node.ID][l]
+			}
+			scale = b.downScale[node.ID]
+		}
+		sum := 0.0
+		for l := 0; l < NCodon; l++ {
+			b.joint[node.ID][l] = b.up[node.ID][l] * b.down[node.ID][l]
+			sum += b.joint[node.ID][l]
+		}
+		if sum > 0 {
+			for l := 0; l < NCodon; l++ {
+				b.joint[node.ID][l] /= sum
+			}
+		}
+		for _, child := range node.ChildNodes() {
+			if child.IsTerminal() {
+				continue
+			}
+			copy(b.tmp, b.up[node.ID])
+			for _, sibling := range node.ChildNodes() {
+				if sibling == child {
+					continue
+				}
+				for l := 0; l < NCodon; l++ {
+					b.tmp[l] *= b.msg[sibling.ID][l]
+				}
+			}
+			impl.Dgemv(blas.Trans, NCodon, NCodon, 1, m.eQts[class][child.ID], NCodon, b.tmp, 1, 0, b.up[child.ID], 1)
+			// the scale factor is not required, since the
+			// posteriors are normalized
+			scalePartial(b.up[child.ID])
+		}
+	}
+	return
+}
+
+// jointSubL performs the joint reconstruction (Pupko et al., 2000)
+// of a position for a site class. The reconstructed states are
+// stored in b.states, the probability of the reconstruction and the
+// data is res*exp(scale).
+func (m *BaseModel) jointSubL(class, pos int, b *ancestralBuffers) (res, scale float64) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nodes := m.data.Tree.NodeOrder()
+
+	for node := range m.data.Tree.Terminals() {
+		m.setLeaf(node, pos, b.down[node.ID])
+		b.downScale[node.ID] = 0
+	}
+
+	// postorder traversal
+	for _, node := range nodes {
+		for l := 0; l < NCodon; l++ {
+			b.down[node.ID][l] = 1
+		}
+		b.downScale[node.ID] = 0
+		for _, child := range node.ChildNodes() {
+			q := m.eQts[class][child.ID]
+			if child.IsTerminal() {
+				// leaf states are not reconstructed
+				impl.Dgemv(blas.NoTrans, NCodon, NCodon, 1, q, NCodon, b.down[child.ID], 1, 0, b.msg[child.ID], 1)
+			} else {
+				for l1 := 0; l1 < NCodon; l1++ {
+					max := -1.0
+					for l2 := 0; l2 < NCodon; l2++ {
+						v := q[l1*NCodon+l2] * b.down[child.ID][l2]
+						if v > max {
+							max = v
+							b.best[child.ID][l1] = byte(l2)
+						}
+					}
+					b.msg[child.ID][l1] = max
+				}
+			}
+			for l := 0; l < NCodon; l++ {
+				b.down[node.ID][l] *= b.msg[child.ID][l]
+			}
+			b.downScale[node.ID] += b.downScale[child.ID]
+		}
+		b.downScale[node.ID] += scalePartial(b.down[node.ID])
+	}
+
+	// preorder traversal
+	res = -1
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		if node.IsRoot() {
+			for l := 0; l < NCodon; l++ {
+				v := m.cFreq.Freq[l] * b.down[node.ID][l]
+				if v > res {
+					res = v
+					b.states[node.ID] = byte(l)
+				}
+			}
+			scale = b.downScale[node.ID]
+		}
+		for _, child := range node.ChildNodes() {
+			if !child.IsTerminal() {
+				b.states[child.ID] = b.best[child.ID][b.states[node.ID]]
+			}
+		}
+	}
+	return
+}
+
+// Ancestral returns the marginal and the joint ancestral sequence
+// reconstructions for all the internal nodes. For the marginal
+// reconstruction site classes are mixed according to their
+// proportions. The joint reconstruction is the most probable
+// combination of a site class and ancestral codons.
+func (m *BaseModel) Ancestral() (res []AncestralNode) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nPos := m.data.cSeqs.Length()
+	nni := m.data.Tree.MaxNodeID() + 1
+
+	m.expBranchesIfNeeded()
+
+	var internal []*tree.Node
+	for _, node := range m.data.Tree.NodeIDArray() {
+		if node != nil && !node.IsTerminal() {
+			internal = append(internal, node)
+		}
+	}
+
+	marginal := make([][]byte, nni)
+	prob := make([][]float64, nni)
+	joint := make([][]byte, nni)
+	for _, node := range internal {
+		marginal[node.ID] = make([]byte, nPos)
+		prob[node.ID] = make([]float64, nPos)
+		joint[node.ID] = make([]byte, nPos)
+	}
+
+	nWorkers := m.workers()
+	done := make(chan struct{}, nWorkers)
+	tasks := make(chan int, nPos)
+
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			b := newAncestralBuffers(nni, NCodon)
+			for pos := range tasks {
+				for _, node := range internal {
+					for l := range b.post[node.ID] {
+						b.post[node.ID][l] = 0
+					}
+				}
+				// class posteriors are accumulated relative
+				// to the largest log class likelihood
+				total := 0.0
+				maxW := math.Inf(-1)
+				bestJoint := math.Inf(-1)
+				for class, p := range m.prop[pos] {
+					if p <= smallProp {
+						continue
+					}
+					if l, scale := m.marginalSubL(class, pos, b); l > 0 {
+						lw := math.Log(p*l) + scale
+						if lw > maxW {
+							f := math.Exp(maxW - lw)
+							total *= f
+							for _, node := range internal {
+								for i := range b.post[node.ID] {
+									b.post[node.ID][i] *= f
+								}
+							}
+							maxW = lw
+						}
+						w := math.Exp(lw - maxW)
+						total += w
+						for _, node := range internal {
+							for l, v := range b.joint[node.ID] {
+								b.post[node.ID][l] += w * v
+							}
+						}
+					}
+
+					l, scale := m.jointSubL(class, pos, b)
+					if v := math.Log(p*l) + scale; v > bestJoint || math.IsInf(bestJoint, -1) {
+						bestJoint = v
+						for _, node := range internal {
+							joint[node.ID][pos] = b.states[node.ID]
+						}
+					}
+				}
+				for _, node := range internal {
+					for l, v := range b.post[node.ID] {
+						if v/total > prob[node.ID][pos] {
+							prob[node.ID][pos] = v / total
+							marginal[node.ID][pos] = byte(l)
+						}
+					}
+				}
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	for pos := 0; pos < nPos; pos++ {
+		tasks <- pos
+	}
+	close(tasks)
+
+	for i := 0; i < nWorkers; i++ {
+		<-done
+	}
+
+	res = make([]AncestralNode, len(internal))
+	for i, node := range internal {
+		res[i] = AncestralNode{
+			NodeID:       node.ID,
+			Joint:        m.codonString(joint[node.ID]),
+			Marginal:     m.codonString(marginal[node.ID]),
+			MarginalProb: prob[node.ID],
+		}
+	}
+	return
+}
+
+// codonString converts a sequence of codon numbers to a nucleotide
+// sequence.
+func (m *BaseModel) codonString(seq []byte) string {
+	var b bytes.Buffer
+	for _, c := range seq {
+		b.WriteString(m.data.cFreq.GCode.NumCodon[c])
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package cmodel
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAncestralD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	m := NewM2(data, true, 1, 1)
+	m.SetParameters(0.6, 0.5, 0.05, 3, 2, 1, 1)
+	m.expBranchesIfNeeded()
+
+	NCodon := data.cFreq.GCode.NCodon
+	nni := data.Tree.MaxNodeID() + 1
+	nPos := data.cSeqs.Length()
+	b := newAncestralBuffers(nni, NCodon)
+	plh := make([][]float64, nni)
+	for i := range plh {
+		plh[i] = make([]float64, NCodon+1)
+	}
+
+	for pos := 0; pos < nPos; pos++ {
+		for class := 0; class < m.GetNClass(); class++ {
+			l, scale := m.fullSubL(class, pos, plh)
+			l *= math.Exp(scale)
+			lm, scale := m.marginalSubL(class, pos, b)
+			lm *= math.Exp(scale)
+			if math.Abs(l-lm)/l > 1e-8 {
+				tst.Fatal("pos=", pos, "class=", class, "expected ", l, ", got", lm)
+			}
+			// posterior probabilities of every node sum to one
+			for _, node := range data.Tree.NodeOrder() {
+				sum := 0.0
+				for _, v := range b.joint[node.ID] {
+					sum += v
+				}
+				if math.Abs(1-sum) > 1e-8 {
+					tst.Fatal("node=", node.ID, "pos=", pos, "expected 1, got", sum)
+				}
+			}
+			lj, scale := m.jointSubL(class, pos, b)
+			if lj *= math.Exp(scale); lj > l*(1+1e-8) || lj <= 0 {
+				tst.Fatal("pos=", pos, "class=", class, "joint probability", lj, "likelihood", l)
+			}
+		}
+	}
+
+	nodes := m.Ancestral()
+	if len(nodes) != data.Tree.NNodes()-data.Tree.NLeaves() {
+		tst.Error("Wrong number of internal nodes:", len(nodes))
+	}
+	for _, node := range nodes {
+		if len(node.Joint) != nPos*3 || len(node.Marginal) != nPos*3 {
+			tst.Error("Wrong sequence length for node", node.NodeID)
+		}
+		for pos, p := range node.MarginalProb {
+			if p <= 0 || p > 1+1e-8 {
+				tst.Error("node=", node.NodeID, "pos=", pos, "wrong probability", p)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package cmodel
+
+import (
+	"math"
+)
+
+// bebGridSize is the number of grid points for every parameter in
+// the BEB (Bayes empirical Bayes) analysis (Yang et al., 2005).
+const bebGridSize = 10
+
+// ternaryPoint returns the proportions p0 and p1 (p2=1-p0-p1) at
+// the center of triangle j in row i of the ternary grid. The grid
+// divides the simplex into d*d triangles of equal area, rows are
+// numbered from 0 to d-1 and row i has 2*i+1 triangles.
+func ternaryPoint(i, j, d int) (p0, p1 float64) {
+	p0 = (1. + float64(j/2*3) + float64(j%2)) / (3 * float64(d))
+	p1 = (1. + float64(d-1-i)*3 + float64(j%2)) / (3 * float64(d))
+	return
+}
+
+// weightedSiteLikelihoods returns the likelihood of every position
+// for a mixture of site classes with the given weights and the log
+// scale factors. Matrices should be exponentiated before the call.
+func (m *BaseModel) weightedSiteLikelihoods(classes []int, weights []float64) (res, scale []float64) {
+	nPos := m.data.cSeqs.Length()
+	res = make([]float64, nPos)
+	scale = make([]float64, nPos)
+
+	nWorkers := m.workers()
+	done := make(chan struct{}, nWorkers)
+	tasks := make(chan int, nPos)
+
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			nni := m.data.Tree.MaxNodeID() + 1
+			plh := make([][]float64, nni)
+			for i := 0; i < nni; i++ {
+				plh[i] = make([]float64, m.data.cFreq.GCode.NCodon+1)
+			}
+			for pos := range tasks {
+				if len(m.lettersF[pos]) == 1 {
+					// no letters in the current position
+					// probability = 1
+					res[pos] = 1
+					continue
+				}
+				for i, class := range classes {
+					l, s := m.fullSubL(class, pos, plh)
+					res[pos], scale[pos] = addScaled(res[pos], scale[pos], l*weights[i], s)
+				}
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	for _, pos := range m.patternPos {
+		tasks <- pos
+	}
+	close(tasks)
+
+	for i := 0; i < nWorkers; i++ {
+		<-done
+	}
+	m.expandPatterns(res)
+	m.expandPatterns(scale)
+	return
+}
+
+// bebPosterior integrates over nPoints grid points with equal prior
+// weights and returns posterior probability of the selected site
+// classes for every position. siteL returns the likelihood of a
+// position and the likelihood of the selected classes (both
+// include the class proportions) given a grid point.
+func bebPosterior(nPoints, nPos int, siteL func(point, pos int) (l, lSel float64)) (res []float64) {
+	// log-likelihood of the alignment for every grid point
+	lnL := make([]float64, nPoints)
+	maxLnL := math.Inf(-1)
+	for point := range lnL {
+		for pos := 0; pos < nPos; pos++ {
+			l, _ := siteL(point, pos)
+			lnL[point] += math.Log(l)
+		}
+		maxLnL = math.Max(maxLnL, lnL[point])
+	}
+
+	res = make([]float64, nPos)
+	sum := 0.0
+	for point := range lnL {
+		w := math.Exp(lnL[point] - maxLnL)
+		sum += w
+		for pos := range res {
+			l, lSel := siteL(point, pos)
+			res[pos] += w * lSel / l
+		}
+	}
+	for pos := range res {
+		res[pos] /= sum
+	}
+	return
+}
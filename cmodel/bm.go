@@ -0,0 +1,197 @@
+package cmodel
+
+import (
+	"strconv"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/optimize"
+	"bitbucket.org/Davydov/godon/tree"
+)
+
+// BranchModel is an implementation of the branch model. Every branch
+// class (#0, #1, ...) has its own omega (two-ratio or multi-ratio
+// model). In the free-ratio mode every branch has its own omega. If
+// fixw is true, all the branches share a single omega (one-ratio
+// model, which is equivalent to M0).
+type BranchModel struct {
+	*BaseModel
+	q         []*codon.EMatrix
+	omega     []float64
+	kappa     float64
+	fixw      bool
+	freeRatio bool
+	// omegaID is omega index for every node ID
+	omegaID []int
+	// omegaNames are names of omega parameters
+	omegaNames []string
+	qdone      []bool
+}
+
+// NewBranchModel creates a new BranchModel. If fixw is true, a
+// single omega is used for all the branches (one-ratio model). If
+// freeRatio is true, every branch has its own omega.
+func NewBranchModel(data *Data, fixw, freeRatio bool) (m *BranchModel) {
+	m = &BranchModel{
+		fixw:      fixw,
+		freeRatio: freeRatio,
+	}
+	m.BaseModel = NewBaseModel(data, m)
+	m.prop[0][0] = 1
+
+	m.setOmegaClasses()
+	m.q = make([]*codon.EMatrix, len(m.omegaNames))
+	for i := range m.q {
+		m.q[i] = codon.NewEMatrix(data.cFreq)
+	}
+	m.omega = make([]float64, len(m.omegaNames))
+	m.qdone = make([]bool, len(m.omegaNames))
+
+	if !fixw && !freeRatio && len(m.omegaNames) < 2 {
+		log.Warning("Only one branch class found, branch model is equivalent to M0")
+	}
+
+	m.setupParameters()
+	m.setBranchMatrices()
+	m.SetDefaults()
+	return
+}
+
+// GetNClass returns number of site classes.
+func (m *BranchModel) GetNClass() int {
+	return 1
+}
+
+// Copy makes a copy of the model preserving the model parameter
+// values.
+func (m *BranchModel) Copy() optimize.Optimizable {
+	newM := &BranchModel{
+		BaseModel:  m.BaseModel.Copy(),
+		q:          make([]*codon.EMatrix, len(m.q)),
+		omega:      make([]float64, len(m.omega)),
+		kappa:      m.kappa,
+		fixw:       m.fixw,
+		freeRatio:  m.freeRatio,
+		omegaID:    m.omegaID,
+		omegaNames: m.omegaNames,
+		qdone:      make([]bool, len(m.qdone)),
+	}
+	for i := range newM.q {
+		newM.q[i] = codon.NewEMatrix(m.data.cFreq)
+	}
+	copy(newM.omega, m.omega)
+	newM.BaseModel.model = newM
+	newM.setupParameters()
+	newM.setBranchMatrices()
+	return newM
+}
+
+// setOmegaClasses computes omega index for every branch and names
+// of the omega parameters.
+func (m *BranchModel) setOmegaClasses() {
+	var keys []int
+	keys, m.omegaID = branchClasses(m.data.Tree, m.omegaKey)
+	m.omegaNames = make([]string, len(keys))
+	for i, key := range keys {
+		if m.fixw {
+			m.omegaNames[i] = "omega"
+		} else {
+			m.omegaNames[i] = "omega" + strconv.Itoa(key)
+		}
+	}
+}
+
+// omegaKey returns a key identifying omega for a branch.
+func (m *BranchModel) omegaKey(node *tree.Node) int {
+	switch {
+	case m.fixw:
+		return 0
+	case m.freeRatio:
+		return node.ID
+	}
+	return node.Class
+}
+
+// addParameters adds all the model parameters to the parameter
+// storage.
+func (m *BranchModel) addParameters(fpg optimize.FloatParameterGenerator) {
+	for i := range m.omega {
+		i := i
+		omega := fpg(&m.omega[i], m.omegaNames[i])
+		omega.SetOnChange(func() {
+			m.qdone[i] = false
+		})
+		omega.SetPriorFunc(optimize.GammaPrior(1, 2, false))
+		omega.SetProposalFunc(optimize.NormalProposal(0.01))
+		omega.SetMin(1e-4)
+		omega.SetMax(1000)
+		m.parameters.Append(omega)
+	}
+
+	m.addNucParameters(fpg, &m.kappa, func() {
+		for i := range m.qdone {
+			m.qdone[i] = false
+		}
+	})
+}
+
+// GetParameters returns the model parameter values. Omegas are
+// ordered by the branch class (or by the node ID in the free-ratio
+// mode).
+func (m *BranchModel) GetParameters() (kappa float64, omega []float64) {
+	omega = make([]float64, len(m.omega))
+	copy(omega, m.omega)
+	return m.kappa, omega
+}
+
+// SetParameters sets the model parameter values. At least one omega
+// value is required. If there are fewer omega values than omega
+// parameters, the last value is used for the rest.
+func (m *BranchModel) SetParameters(kappa, omega0 float64, omega ...float64) {
+	omega = append([]float64{omega0}, omega...)
+	m.kappa = kappa
+	for i := range m.omega {
+		if i < len(omega) {
+			m.omega[i] = omega[i]
+		} else {
+			m.omega[i] = omega[len(omega)-1]
+		}
+		m.qdone[i] = false
+	}
+}
+
+// SetDefaults sets the default initial parameter values.
+func (m *BranchModel) SetDefaults() {
+	m.SetParameters(1, 1)
+}
+
+// setBranchMatrices set matrices for all the branches.
+func (m *BranchModel) setBranchMatrices() {
+	for _, node := range m.data.Tree.NodeIDArray() {
+		if node == nil {
+			continue
+		}
+		m.qs[0][node.ID] = m.q[m.omegaID[node.ID]]
+	}
+}
+
+// update updates matrices and proportions.
+func (m *BranchModel) update() {
+	for i, q := range m.q {
+		if m.qdone[i] {
+			continue
+		}
+		m.setTransitionMatrix(q, m.kappa, m.omega[i], nil)
+		err := q.Eigen()
+		if err != nil {
+			panic("error finding eigen")
+		}
+		for _, node := range m.data.Tree.NodeIDArray() {
+			if node == nil || m.omegaID[node.ID] != i {
+				continue
+			}
+			m.scale[node.ID] = q.Scale
+			m.expBr[node.ID] = false
+		}
+		m.qdone[i] = true
+	}
+}
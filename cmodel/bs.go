@@ -4,7 +4,6 @@ import (
 	"math"
 	"math/big"
 	"math/rand"
-	"runtime"
 	"time"
 
 	"bitbucket.org/Davydov/godon/codon"
@@ -87,17 +86,11 @@ func (m *BranchSite) Copy() optimize.Optimizable {
 // addParameters adds all the model parameters to the parameter
 // storage.
 func (m *BranchSite) addParameters(fpg optimize.FloatParameterGenerator) {
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.q0done = false
 		m.q1done = false
 		m.q2done = false
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-	m.parameters.Append(kappa)
 
 	omega0 := fpg(&m.omega0, "omega0")
 	omega0.SetOnChange(func() {
@@ -230,8 +223,7 @@ func (m *BranchSite) updateProportions() {
 // updateMatrices updates matrices if model parameters are changing.
 func (m *BranchSite) updateMatrices() {
 	if !m.q0done {
-		Q0, s0 := codon.CreateTransitionMatrix(m.data.cFreq, m.kappa, m.omega0, m.q0.Q)
-		m.q0.Set(Q0, s0)
+		m.setTransitionMatrix(m.q0, m.kappa, m.omega0, nil)
 		err := m.q0.Eigen()
 		if err != nil {
 			panic("error eigen q0")
@@ -240,8 +232,7 @@ func (m *BranchSite) updateMatrices() {
 	}
 
 	if !m.q1done {
-		Q1, s1 := codon.CreateTransitionMatrix(m.data.cFreq, m.kappa, 1, m.q1.Q)
-		m.q1.Set(Q1, s1)
+		m.setTransitionMatrix(m.q1, m.kappa, 1, nil)
 		err := m.q1.Eigen()
 		if err != nil {
 			panic("error eigen q1")
@@ -250,8 +241,7 @@ func (m *BranchSite) updateMatrices() {
 	}
 
 	if !m.q2done {
-		Q2, s2 := codon.CreateTransitionMatrix(m.data.cFreq, m.kappa, m.omega2, m.q2.Q)
-		m.q2.Set(Q2, s2)
+		m.setTransitionMatrix(m.q2, m.kappa, m.omega2, nil)
 		err := m.q2.Eigen()
 		if err != nil {
 			panic("error eigen q2")
@@ -263,9 +253,12 @@ func (m *BranchSite) updateMatrices() {
 }
 
 //siteLMatrix returns site likelihood matrix. First index is w0, second
-//w2, third class, forth position.
+//w2, third class, forth position. All the likelihoods of a position
+//are multiplied by the same factor to avoid underflow.
 func (m *BranchSite) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 	res = make([][][][]float64, len(w0))
+	// log scale factors
+	scale := make([][][][]float64, len(w0))
 	nClass := m.GetNClass()
 	nPos := m.data.cSeqs.Length()
 	nni := m.data.Tree.MaxNodeID() + 1
@@ -278,7 +271,7 @@ func (m *BranchSite) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 
 	counter := 0
 
-	nWorkers := runtime.GOMAXPROCS(0)
+	nWorkers := m.workers()
 	done := make(chan struct{}, nWorkers)
 	type bebtask struct {
 		iW0, iW2, class, pos int
@@ -293,7 +286,9 @@ func (m *BranchSite) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 				plh[i] = make([]float64, m.data.cFreq.GCode.NCodon+1)
 			}
 			for task := range tasks {
-				res[task.iW0][task.iW2][task.class][task.pos] = m.fullSubL(task.class, task.pos, plh)
+				l, s := m.fullSubL(task.class, task.pos, plh)
+				res[task.iW0][task.iW2][task.class][task.pos] = l
+				scale[task.iW0][task.iW2][task.class][task.pos] = s
 				done <- struct{}{}
 			}
 		}()
@@ -303,6 +298,7 @@ func (m *BranchSite) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 		m.omega0 = w0
 		m.q0done = false
 		res[iW0] = make([][][]float64, len(w2))
+		scale[iW0] = make([][][]float64, len(w2))
 		for iW2, w2 := range w2 {
 			m.omega2 = w2
 			m.q2done = false
@@ -310,31 +306,49 @@ func (m *BranchSite) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 			// in this scenario we keep q-factor as computed from MLE
 			m.ExpBranches()
 			res[iW0][iW2] = make([][]float64, nClass)
+			scale[iW0][iW2] = make([][]float64, nClass)
 			for class := 0; class < nClass; class++ {
 				switch {
 				case class == 0 && iW2 != 0:
 					res[iW0][iW2][class] = res[iW0][0][class]
+					scale[iW0][iW2][class] = scale[iW0][0][class]
 				case class == 1 && (iW0 != 0 || iW2 != 0):
 					res[iW0][iW2][class] = res[0][0][class]
+					scale[iW0][iW2][class] = scale[0][0][class]
 				case class == 3 && iW0 != 0:
 					res[iW0][iW2][class] = res[0][iW2][class]
+					scale[iW0][iW2][class] = scale[0][iW2][class]
 				default:
 					res[iW0][iW2][class] = make([]float64, nPos)
+					scale[iW0][iW2][class] = make([]float64, nPos)
 
 					counter++
-					for pos := 0; pos < nPos; pos++ {
+					// only the first position of every pattern
+					for _, pos := range m.patternPos {
 						//res[i_w0][i_w2][class][pos] = m.fullSubL(class, pos, plh)
 						tasks <- bebtask{iW0, iW2, class, pos}
 					}
 					// wait for everyone to finish
-					for pos := 0; pos < nPos; pos++ {
+					for range m.patternPos {
 						<-done
 					}
+					m.expandPatterns(res[iW0][iW2][class])
+					m.expandPatterns(scale[iW0][iW2][class])
 				}
 			}
 		}
 	}
 	log.Infof("Computed f(x_h|w) for %d classes", counter)
+
+	var ls, scales [][]float64
+	for iW0 := range res {
+		for iW2 := range res[iW0] {
+			ls = append(ls, res[iW0][iW2]...)
+			scales = append(scales, scale[iW0][iW2]...)
+		}
+	}
+	commonScale(ls, scales)
+
 	return
 }
 
@@ -344,8 +358,7 @@ func (m *BranchSite) computePropBEB(prop []float64, i, j, d int) []float64 {
 		nClass := m.GetNClass()
 		prop = make([]float64, nClass)
 	}
-	prop[0] = (1. + float64(j)/2*3 + float64(j%2)) / (3 * float64(d))
-	prop[1] = (1. + float64(d-1-i)*3 + float64(j%2)) / (3 * float64(d))
+	prop[0], prop[1] = ternaryPoint(i, j, d)
 	prop[2] = (1 - prop[0] - prop[1]) * prop[0] / (prop[0] + prop[1])
 	prop[3] = (1 - prop[0] - prop[1]) * prop[1] / (prop[0] + prop[1])
 	return prop
@@ -4,7 +4,6 @@ import (
 	"math"
 	"math/big"
 	"math/rand"
-	"runtime"
 	"time"
 
 	"bitbucket.org/Davydov/godon/codon"
@@ -187,17 +186,11 @@ func (m *BranchSiteGamma) Copy() optimize.Optimizable {
 // addParameters adds all the model parameters to the parameter
 // storage.
 func (m *BranchSiteGamma) addParameters(fpg optimize.FloatParameterGenerator) {
-	kappa := fpg(&m.kappa, "kappa")
-	kappa.SetOnChange(func() {
+	m.addNucParameters(fpg, &m.kappa, func() {
 		m.q0done = false
 		m.q1done = false
 		m.q2done = false
 	})
-	kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
-	kappa.SetProposalFunc(optimize.NormalProposal(0.01))
-	kappa.SetMin(1e-2)
-	kappa.SetMax(100)
-	m.parameters.Append(kappa)
 
 	omega0 := fpg(&m.omega0, "omega0")
 	omega0.SetOnChange(func() {
@@ -488,8 +481,7 @@ func (m *BranchSiteGamma) fillMatrices(omega float64, dest []*codon.EMatrix) {
 				m.tmp[2] = m.gammas[c3]
 
 				e := codon.NewEMatrix(m.data.cFreq)
-				Q, s := codon.CreateRateTransitionMatrix(m.data.cFreq, m.kappa, omega, m.tmp, e.Q)
-				e.Set(Q, s)
+				m.setTransitionMatrix(e, m.kappa, omega, m.tmp)
 				err := e.Eigen()
 				if err != nil {
 					log.Fatal(err)
@@ -534,8 +526,7 @@ func (m *BranchSiteGamma) computePropBEB(prop []float64, i, j, d int) []float64
 		nClass := m.GetNClass()
 		prop = make([]float64, nClass)
 	}
-	p0 := (1. + float64(j)/2*3 + float64(j%2)) / (3 * float64(d))
-	p1 := (1. + float64(d-1-i)*3 + float64(j%2)) / (3 * float64(d))
+	p0, p1 := ternaryPoint(i, j, d)
 	p2a := (1 - p0 - p1) * p0 / (p0 + p1)
 	p2b := (1 - p0 - p1) * p1 / (p0 + p1)
 	scat := m.ncatsg * m.ncatsg * m.ncatsg
@@ -551,9 +542,12 @@ func (m *BranchSiteGamma) computePropBEB(prop []float64, i, j, d int) []float64
 }
 
 //siteLMatrix returns site likelihood matrix. First index is w0, second
-//w2, third class, forth position.
+//w2, third class, forth position. All the likelihoods of a position
+//are multiplied by the same factor to avoid underflow.
 func (m *BranchSiteGamma) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 	res = make([][][][]float64, len(w0))
+	// log scale factors
+	scale := make([][][][]float64, len(w0))
 	nClass := m.GetNClass()
 	nPos := m.data.cSeqs.Length()
 	nni := m.data.Tree.MaxNodeID() + 1
@@ -569,7 +563,7 @@ func (m *BranchSiteGamma) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 
 	counter := 0
 
-	nWorkers := runtime.GOMAXPROCS(0)
+	nWorkers := m.workers()
 	done := make(chan struct{}, nWorkers)
 	type bebtask struct {
 		iW0, iW2, class, pos int
@@ -584,7 +578,9 @@ func (m *BranchSiteGamma) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 				plh[i] = make([]float64, m.data.cFreq.GCode.NCodon+1)
 			}
 			for task := range tasks {
-				res[task.iW0][task.iW2][task.class][task.pos] = m.fullSubL(task.class, task.pos, plh)
+				l, s := m.fullSubL(task.class, task.pos, plh)
+				res[task.iW0][task.iW2][task.class][task.pos] = l
+				scale[task.iW0][task.iW2][task.class][task.pos] = s
 				done <- struct{}{}
 			}
 		}()
@@ -594,6 +590,7 @@ func (m *BranchSiteGamma) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 		m.omega0 = w0
 		m.q0done = false
 		res[iW0] = make([][][]float64, len(w2))
+		scale[iW0] = make([][][]float64, len(w2))
 		for iW2, w2 := range w2 {
 			m.omega2 = w2
 			m.q2done = false
@@ -601,31 +598,49 @@ func (m *BranchSiteGamma) siteLMatrix(w0, w2 []float64) (res [][][][]float64) {
 			// in this scenario we keep q-factor as computed from MLE
 			m.ExpBranches()
 			res[iW0][iW2] = make([][]float64, nClass)
+			scale[iW0][iW2] = make([][]float64, nClass)
 			for class := 0; class < nClass; class++ {
 				switch {
 				case class/bothcat == 0 && iW2 != 0:
 					res[iW0][iW2][class] = res[iW0][0][class]
+					scale[iW0][iW2][class] = scale[iW0][0][class]
 				case class/bothcat == 1 && (iW0 != 0 || iW2 != 0):
 					res[iW0][iW2][class] = res[0][0][class]
+					scale[iW0][iW2][class] = scale[0][0][class]
 				case class/bothcat == 3 && iW0 != 0:
 					res[iW0][iW2][class] = res[0][iW2][class]
+					scale[iW0][iW2][class] = scale[0][iW2][class]
 				default:
 					res[iW0][iW2][class] = make([]float64, nPos)
+					scale[iW0][iW2][class] = make([]float64, nPos)
 
 					counter++
-					for pos := 0; pos < nPos; pos++ {
+					// only the first position of every pattern
+					for _, pos := range m.patternPos {
 						//res[i_w0][i_w2][class][pos] = m.fullSubL(class, pos, plh)
 						tasks <- bebtask{iW0, iW2, class, pos}
 					}
 					// wait for everyone to finish
-					for pos := 0; pos < nPos; pos++ {
+					for range m.patternPos {
 						<-done
 					}
+					m.expandPatterns(res[iW0][iW2][class])
+					m.expandPatterns(scale[iW0][iW2][class])
 				}
 			}
 		}
 	}
 	log.Infof("Computed f(x_h|w) for %d classes", counter)
+
+	var ls, scales [][]float64
+	for iW0 := range res {
+		for iW2 := range res[iW0] {
+			ls = append(ls, res[iW0][iW2]...)
+			scales = append(scales, scale[iW0][iW2]...)
+		}
+	}
+	commonScale(ls, scales)
+
 	return
 }
 
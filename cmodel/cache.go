@@ -0,0 +1,220 @@
+package cmodel
+
+import (
+	"github.com/gonum/blas"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/tree"
+)
+
+// maxCacheSize is the maximum number of float64 values stored in
+// the partial likelihood cache (256 MiB). If more memory is
+// required, the cache is disabled.
+const maxCacheSize = 1 << 25
+
+// partialCache stores conditional likelihood vectors of internal
+// nodes for every site class and every site pattern. Only the nodes
+// marked as dirty are recomputed, so a change of a single branch
+// length requires recomputation only of the path from the branch to
+// the root.
+type partialCache struct {
+	// plh[class][nodeID] are the partial likelihoods for
+	// blocks of patterns; nil for the terminal nodes
+	plh [][][]float64
+	// scale[class][nodeID] are the log scale factors of the
+	// subtree for every pattern
+	scale [][][]float64
+	// dirty[class][nodeID] is true if the node has to be
+	// recomputed
+	dirty [][]bool
+}
+
+// setupCache creates the partial likelihood cache. The cache is only
+// useful if branch lengths are optimized, since a change of any
+// other parameter invalidates all the nodes. Aggregation is not
+// supported. The cache can be disabled using SetCache.
+func (m *BaseModel) setupCache() {
+	m.cache = nil
+	if m.noCache || !m.optBranch || m.aggMode != AggNone {
+		return
+	}
+
+	NCodon := m.data.cFreq.GCode.NCodon
+	nPatterns := len(m.patternPos)
+	nni := m.data.Tree.MaxNodeID() + 1
+	nInternal := len(m.data.Tree.NodeOrder())
+	if size := m.nclass * nInternal * nPatterns * (NCodon + 1); size > maxCacheSize {
+		log.Warningf("Partial likelihood cache is too large (%d values), disabling", size)
+		return
+	}
+
+	c := &partialCache{
+		plh:   make([][][]float64, m.nclass),
+		scale: make([][][]float64, m.nclass),
+		dirty: make([][]bool, m.nclass),
+	}
+	for class := 0; class < m.nclass; class++ {
+		c.plh[class] = make([][]float64, nni)
+		c.scale[class] = make([][]float64, nni)
+		c.dirty[class] = make([]bool, nni)
+		for _, node := range m.data.Tree.NodeOrder() {
+			c.plh[class][node.ID] = make([]float64, nPatterns*NCodon)
+			c.scale[class][node.ID] = make([]float64, nPatterns)
+			c.dirty[class][node.ID] = true
+		}
+	}
+	m.cache = c
+	m.prunAllPos = false
+}
+
+// invalidateAll marks all the cached nodes as dirty.
+func (c *partialCache) invalidateAll() {
+	for class := range c.dirty {
+		for i := range c.dirty[class] {
+			c.dirty[class][i] = true
+		}
+	}
+}
+
+// invalidateBranch marks as dirty all the nodes which depend on the
+// branch leading to the node with id br, i.e. all the nodes from
+// its parent to the root.
+func (m *BaseModel) invalidateBranch(br int) {
+	if m.cache == nil {
+		return
+	}
+	for node := m.data.Tree.NodeIDArray()[br].Parent; node != nil; node = node.Parent {
+		for class := range m.cache.dirty {
+			m.cache.dirty[class][node.ID] = true
+		}
+	}
+}
+
+// cachedSubL recomputes the dirty nodes of the cache for a class and
+// a block of patterns from k0 to k1 (excluding). Within a block
+// partial likelihoods are stored in the fatSubL layout
+// (state*nPatterns+pattern). leaf and mul are temporary storage of
+// at least (k1-k0)*NCodon elements. Likelihoods of the patterns are
+// stored to res and the log scale factors to scale.
+func (m *BaseModel) cachedSubL(class, k0, k1 int, leaf, mul, res, scale []float64) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nb := k1 - k0
+	c := m.cache
+
+	var root *tree.Node
+	for _, node := range m.data.Tree.NodeOrder() {
+		root = node
+		if !c.dirty[class][node.ID] {
+			continue
+		}
+		plh := c.plh[class][node.ID][k0*NCodon : k1*NCodon]
+		nodeScale := c.scale[class][node.ID][k0:k1]
+		for i := range plh {
+			plh[i] = 1
+		}
+		for i := range nodeScale {
+			nodeScale[i] = 0
+		}
+		for _, child := range node.ChildNodes() {
+			var cplh []float64
+			if child.IsTerminal() {
+				cplh = leaf[:nb*NCodon]
+				for i, pos := range m.patternPos[k0:k1] {
+					cod := m.data.cSeqs[child.LeafID].Sequence[pos]
+					for l := byte(0); l < byte(NCodon); l++ {
+						if cod == codon.NOCODON || l == cod {
+							cplh[nb*int(l)+i] = 1
+						} else {
+							cplh[nb*int(l)+i] = 0
+						}
+					}
+				}
+			} else {
+				cplh = c.plh[class][child.ID][k0*NCodon : k1*NCodon]
+				for i, s := range c.scale[class][child.ID][k0:k1] {
+					nodeScale[i] += s
+				}
+			}
+			impl.Dgemm(blas.NoTrans, blas.NoTrans,
+				NCodon, nb, NCodon,
+				1,
+				m.eQts[class][child.ID], NCodon,
+				cplh, nb,
+				0,
+				mul, nb)
+			for i, v := range mul[:nb*NCodon] {
+				plh[i] *= v
+			}
+		}
+		scalePartialFat(plh, nb, nodeScale)
+	}
+
+	// the root is the last node
+	plh := c.plh[class][root.ID][k0*NCodon : k1*NCodon]
+	impl.Dgemv(blas.Trans, NCodon, nb, 1, plh, nb, m.cFreq.Freq, 1, 0, res, 1)
+	copy(scale, c.scale[class][root.ID][k0:k1])
+}
+
+// cachedPosLikelihood reads blocks of patterns from tasks, updates
+// the cache and computes likelihood for them. Block b contains
+// patterns from b*m.fatness to (b+1)*m.fatness.
+func (m *BaseModel) cachedPosLikelihood(tasks chan int, done chan struct{}) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nPatterns := len(m.patternPos)
+	leaf := make([]float64, NCodon*m.fatness)
+	mul := make([]float64, NCodon*m.fatness)
+	// class likelihoods and the total likelihoods with the log
+	// scale factors
+	l := make([]float64, m.fatness)
+	scale := make([]float64, m.fatness)
+	res := make([]float64, m.fatness)
+	resScale := make([]float64, m.fatness)
+
+	for b := range tasks {
+		if b < 0 {
+			break
+		}
+		k0 := b * m.fatness
+		k1 := k0 + m.fatness
+		if k1 > nPatterns {
+			k1 = nPatterns
+		}
+		nb := k1 - k0
+		if m.prunAllPos && m.prunPos[k0] {
+			continue
+		}
+
+		for i := range res {
+			res[i] = 0
+			resScale[i] = 0
+		}
+		// all proportions are identical (see fatPosLikelihood)
+		for class, p := range m.prop[m.patternPos[k0]] {
+			if p <= smallProp {
+				continue
+			}
+			m.cachedSubL(class, k0, k1, leaf, mul, l[:nb], scale[:nb])
+			for i := 0; i < nb; i++ {
+				res[i], resScale[i] = addScaled(res[i], resScale[i], l[i]*p, scale[i])
+			}
+		}
+		for i := 0; i < nb; i++ {
+			m.l[k0+i] = logScaled(res[i], resScale[i])
+			m.prunPos[k0+i] = true
+		}
+	}
+	done <- struct{}{}
+}
+
+// clean marks all the nodes as computed for the classes with
+// non-zero proportions.
+func (c *partialCache) clean(prop []float64) {
+	for class, p := range prop {
+		if p <= smallProp {
+			continue
+		}
+		for i := range c.dirty[class] {
+			c.dirty[class][i] = false
+		}
+	}
+}
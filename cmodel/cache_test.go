@@ -0,0 +1,105 @@
+package cmodel
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// uncachedLikelihood computes likelihood without the partial
+// likelihood cache.
+func uncachedLikelihood(m *BaseModel) float64 {
+	c := m.cache
+	m.cache = nil
+	m.prunAllPos = false
+	defer func() {
+		m.cache = c
+	}()
+	return m.Likelihood()
+}
+
+func TestCacheD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	m := NewBranchSite(data, false)
+	m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+	m.SetOptimizeBranchLengths()
+	if m.cache == nil {
+		tst.Fatal("Cache is not enabled")
+	}
+	pars := m.GetFloatParameters()
+
+	check := func(msg string) {
+		L := m.Likelihood()
+		LU := uncachedLikelihood(m.BaseModel)
+		if math.Abs(L-LU) > 1e-6 {
+			tst.Error(msg, ": expected ", LU, ", got", L)
+		}
+	}
+
+	check("initial")
+	var names []string
+	for _, node := range data.Tree.NodeIDArray() {
+		if node == nil || node.IsRoot() {
+			continue
+		}
+		name := "br" + strconv.Itoa(node.ID)
+		names = append(names, name)
+		if err := pars.SetByName(name, node.BranchLength*1.5+0.01); err != nil {
+			tst.Fatal("Error: ", err)
+		}
+		check(name)
+	}
+	if err := pars.SetByName("omega2", 3); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	check("omega2")
+	if err := pars.SetByName(names[0], 0.2); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	check(names[0])
+
+	L := m.Likelihood()
+	m.SetCache(false)
+	if m.cache != nil {
+		tst.Fatal("Cache is not disabled")
+	}
+	if m.BaseModel.Copy().cache != nil {
+		tst.Error("Cache is enabled in a copy")
+	}
+	if LU := m.Likelihood(); math.Abs(L-LU) > 1e-6 {
+		tst.Error("disabled cache: expected ", L, ", got", LU)
+	}
+}
+
+func BenchmarkBranchChangeD1(b *testing.B) {
+	data, err := GetTreeAlignment(data1, "F0")
+	if err != nil {
+		b.Error("Error: ", err)
+	}
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+	m0.SetOptimizeBranchLengths()
+	var pars optimize.FloatParameters
+	for _, par := range m0.GetFloatParameters() {
+		if strings.HasPrefix(par.Name(), "br") {
+			pars = append(pars, par)
+		}
+	}
+	m0.Likelihood()
+	b.ResetTimer()
+
+	// change one branch at a time
+	for i := 0; i < b.N; i++ {
+		par := pars[i%len(pars)]
+		par.Set(par.Get() * 1.01)
+		m0.Likelihood()
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/gonum/matrix/mat64"
+
 	"bitbucket.org/Davydov/godon/bio"
 	"bitbucket.org/Davydov/godon/codon"
 	"bitbucket.org/Davydov/godon/tree"
@@ -18,6 +20,18 @@ type Data struct {
 	Tree *tree.Tree
 	// cFreq is codon frequencies
 	cFreq codon.Frequency
+	// gtr is true if GTR exchangeabilities are used instead of kappa
+	gtr bool
+	// cFreqName is the codon frequency specification
+	cFreqName string
+	// mnm is true if double and triple nucleotide changes are allowed
+	mnm bool
+	// ecm is the empirical codon model exchangeability matrix (nil
+	// if the mechanistic model is used)
+	ecm *mat64.Dense
+	// freqGroups is the number of estimated nucleotide frequency
+	// sets (0: not estimated, 1: F1X4, 3: F3X4)
+	freqGroups int
 	// if the tree was rooted
 	root bool
 	// old root node id
@@ -68,16 +82,73 @@ func NewData(gCodeID int, alignmentFileName string, treeFileName string,
 		return nil, err
 	}
 
+	data.cFreq, err = codonFrequency(cFreq, data.cSeqs)
+	if err != nil {
+		return nil, err
+	}
+	data.cFreqName = cFreq
+
+	return data, nil
+}
+
+// codonFrequency computes codon frequencies from the alignment
+// given the frequency specification.
+func codonFrequency(cFreq string, cSeqs codon.Sequences) (codon.Frequency, error) {
 	switch cFreq {
 	case "F0":
 		log.Info("F0 frequency")
-		data.cFreq = codon.F0(data.cSeqs)
+		return codon.F0(cSeqs), nil
+	case "F1X4":
+		log.Info("F1X4 frequency")
+		return codon.F1X4(cSeqs), nil
 	case "F3X4":
 		log.Info("F3X4 frequency")
-		data.cFreq = codon.F3X4(data.cSeqs)
-	default:
-		return nil, errors.New("Unknow codon freuquency specification")
+		return codon.F3X4(cSeqs), nil
+	case "CF3X4":
+		log.Info("CF3X4 frequency")
+		return codon.CF3X4(cSeqs), nil
+	case "F61":
+		log.Info("F61 frequency")
+		return codon.F61(cSeqs), nil
+	}
+	return codon.Frequency{}, errors.New("Unknow codon freuquency specification")
+}
+
+// NewTreeData creates a new Data without an alignment, e.g. for the
+// simulations. Every leaf gets a sequence of a single unknown codon,
+// equal codon frequencies (F0) are used, since the other frequencies
+// are computed from an alignment.
+func NewTreeData(gCodeID int, treeFileName string) (*Data, error) {
+	data := &Data{}
+
+	gcode, ok := bio.GeneticCodes[gCodeID]
+	if !ok {
+		return nil, fmt.Errorf("couldn't load genetic code with id=%d", gCodeID)
 	}
+	log.Infof("Genetic code: %d, \"%s\"", gcode.ID, gcode.Name)
+
+	treeFile, err := os.Open(treeFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer treeFile.Close()
+
+	data.Tree, err = tree.ParseNewick(treeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for node := range data.Tree.Terminals() {
+		data.cSeqs = append(data.cSeqs, codon.Sequence{
+			Name:     node.Name,
+			Sequence: []byte{codon.NOCODON},
+			GCode:    gcode,
+		})
+	}
+
+	log.Info("F0 frequency")
+	data.cFreq = codon.F0(data.cSeqs)
+	data.cFreqName = "F0"
 
 	return data, nil
 }
@@ -104,6 +175,11 @@ func (data *Data) GetNClass1() (res int) {
 	return
 }
 
+// Length returns the alignment length in codons.
+func (data *Data) Length() int {
+	return data.cSeqs.Length()
+}
+
 // SetCodonFreqFromFile sets codon frequency from file.
 func (data *Data) SetCodonFreqFromFile(filename string) error {
 	cFreqFile, err := os.Open(filename)
@@ -111,17 +187,125 @@ func (data *Data) SetCodonFreqFromFile(filename string) error {
 		return err
 	}
 	data.cFreq, err = codon.ReadFrequency(cFreqFile, data.cFreq.GCode)
+	data.cFreqName = filename
 	return err
 }
 
+// SetCodonModel sets the codon model parametrization, "GY" (GY94)
+// or "MG" (MG94). It should be called after codon frequencies are
+// set.
+func (data *Data) SetCodonModel(codonModel string) error {
+	switch codonModel {
+	case "GY":
+		log.Info("GY94 codon model")
+		data.cFreq.Model = codon.GY94
+	case "MG":
+		log.Info("MG94 codon model")
+		var maxDiff float64
+		data.cFreq, maxDiff = codon.MG94Frequency(data.cFreq)
+		if maxDiff > 1e-6 {
+			log.Warningf("Codon frequencies are not a product of nucleotide frequencies, replaced by the product of marginals (max difference %g)", maxDiff)
+		}
+	default:
+		return errors.New("Unknown codon model specification")
+	}
+	return nil
+}
+
+// SetGTR enables GTR nucleotide exchangeabilities (instead of kappa)
+// for the models using the data.
+func (data *Data) SetGTR() {
+	log.Info("GTR nucleotide exchangeabilities")
+	data.gtr = true
+}
+
+// SetMultiNucleotide enables instantaneous double and triple
+// nucleotide changes (delta and psi parameters) for the models using
+// the data.
+func (data *Data) SetMultiNucleotide() {
+	log.Info("Multi-nucleotide substitutions")
+	data.mnm = true
+}
+
+// SetEstimateFrequency enables the maximum likelihood estimation of
+// the nucleotide frequencies defining the codon frequencies. Only
+// F1X4 (3 parameters) and F3X4 or CF3X4 (9 parameters) frequencies
+// can be estimated, empirical frequencies are used as starting
+// values.
+func (data *Data) SetEstimateFrequency() error {
+	switch data.cFreqName {
+	case "F1X4":
+		data.freqGroups = 1
+	case "F3X4", "CF3X4":
+		data.freqGroups = 3
+	default:
+		return errors.New("Only F1X4, F3X4 and CF3X4 frequencies can be estimated")
+	}
+	log.Infof("Estimating %d nucleotide frequencies", data.freqGroups*3)
+	return nil
+}
+
+// SetECMFromFile reads the empirical codon model exchangeability
+// matrix from file. The exchangeabilities replace the mechanistic
+// nucleotide-level parameters (kappa or GTR, delta and psi), while
+// omega still applies to the nonsynonymous changes (ECM+omega).
+func (data *Data) SetECMFromFile(filename string) error {
+	if data.gtr || data.mnm {
+		return errors.New("Empirical codon model cannot be combined with GTR or multi-nucleotide changes")
+	}
+	ecmFile, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer ecmFile.Close()
+	data.ecm, err = codon.ReadExchangeability(ecmFile, data.cFreq.GCode)
+	if err != nil {
+		return err
+	}
+	log.Infof("Empirical codon model exchangeabilities from %s", filename)
+	return nil
+}
+
+// Replicate creates a copy of data with a different alignment
+// (e.g. a simulated one). Codon frequencies are
+// recomputed from the new alignment unless they were read from a
+// file; the codon model of the data is preserved.
+func (data *Data) Replicate(ali bio.Sequences) (*Data, error) {
+	cSeqs, err := codon.ToCodonSequences(ali, data.cFreq.GCode)
+	if err != nil {
+		return nil, err
+	}
+	res := data.Copy()
+	res.cSeqs = cSeqs
+	switch data.cFreqName {
+	case "F0", "F1X4", "F3X4", "CF3X4", "F61":
+		res.cFreq, err = codonFrequency(data.cFreqName, cSeqs)
+		if err != nil {
+			return nil, err
+		}
+		// the recomputed frequencies use GY94
+		if data.cFreq.Model == codon.MG94 {
+			if err := res.SetCodonModel("MG"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
 // Copy creates a copy (only new tree is created).
 func (data *Data) Copy() *Data {
 	return &Data{
-		cSeqs:  data.cSeqs,
-		Tree:   data.Tree.Copy(),
-		cFreq:  data.cFreq,
-		root:   data.root,
-		rootID: data.rootID,
+		cSeqs:      data.cSeqs,
+		Tree:       data.Tree.Copy(),
+		cFreq:      data.cFreq,
+		cFreqName:  data.cFreqName,
+		gtr:        data.gtr,
+		mnm:        data.mnm,
+		ecm:        data.ecm,
+		freqGroups: data.freqGroups,
+		root:       data.root,
+		rootID:     data.rootID,
 	}
 }
 
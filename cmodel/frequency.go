@@ -0,0 +1,92 @@
+package cmodel
+
+import (
+	"math"
+	"strconv"
+
+	"bitbucket.org/Davydov/godon/codon"
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+const (
+	// nucleotides is the order of nucleotides in the nucleotide
+	// frequencies.
+	nucleotides = "TCAG"
+	// minFreqProp is the minimal stick-breaking proportion for
+	// the estimated nucleotide frequencies.
+	minFreqProp = 1e-4
+)
+
+// initFrequency creates model codon frequencies which are estimated
+// and initializes them with the data frequencies.
+func (m *BaseModel) initFrequency() {
+	dcf := m.data.cFreq
+	m.cFreq = codon.Frequency{
+		Freq:  make([]float64, len(dcf.Freq)),
+		GCode: dcf.GCode,
+		NFreq: make([][]float64, 3),
+		Model: dcf.Model,
+	}
+	for pos := range m.cFreq.NFreq {
+		m.cFreq.NFreq[pos] = make([]float64, len(nucleotides))
+	}
+
+	m.freqProp = make([][]float64, m.data.freqGroups)
+	for g := range m.freqProp {
+		m.freqProp[g] = make([]float64, len(nucleotides)-1)
+		rest := 1.0
+		for i := range m.freqProp[g] {
+			f := dcf.NFreq[g][i]
+			if rest > 0 {
+				m.freqProp[g][i] = f / rest
+			}
+			m.freqProp[g][i] = math.Min(math.Max(m.freqProp[g][i], minFreqProp), 1-minFreqProp)
+			rest -= f
+		}
+	}
+	m.updateFrequency()
+}
+
+// updateFrequency computes nucleotide and codon frequencies from the
+// stick-breaking proportions.
+func (m *BaseModel) updateFrequency() {
+	for pos, nf := range m.cFreq.NFreq {
+		// F1X4 has the same frequencies for all the positions
+		prop := m.freqProp[pos%len(m.freqProp)]
+		rest := 1.0
+		for i, p := range prop {
+			nf[i] = rest * p
+			rest -= nf[i]
+		}
+		nf[len(prop)] = rest
+	}
+	copy(m.cFreq.Freq, codon.ProductFrequency(m.cFreq.GCode, m.cFreq.NFreq))
+}
+
+// addFrequencyParameters adds the stick-breaking proportions of the
+// estimated nucleotide frequencies to the parameter storage. onChange
+// is called if any of the parameters changes.
+func (m *BaseModel) addFrequencyParameters(fpg optimize.FloatParameterGenerator, onChange func()) {
+	for g := range m.freqProp {
+		suffix := ""
+		if len(m.freqProp) > 1 {
+			suffix = strconv.Itoa(g + 1)
+		}
+		for i := range m.freqProp[g] {
+			name := "f" + nucleotides[i:i+1] + suffix
+			if i > 0 {
+				name += "prop"
+			}
+			p := fpg(&m.freqProp[g][i], name)
+			p.SetOnChange(func() {
+				m.updateFrequency()
+				onChange()
+			})
+			p.SetPriorFunc(optimize.UniformPrior(minFreqProp, 1-minFreqProp, true, true))
+			p.SetProposalFunc(optimize.NormalProposal(0.01))
+			p.SetMin(minFreqProp)
+			p.SetMax(1 - minFreqProp)
+			m.parameters.Append(p)
+		}
+	}
+}
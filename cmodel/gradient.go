@@ -0,0 +1,255 @@
+package cmodel
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/gonum/blas"
+	"github.com/gonum/matrix/mat64"
+
+	"bitbucket.org/Davydov/godon/codon"
+)
+
+// gradientBuffers is a temporary storage for the branch-length
+// gradient computations. All the slices are indexed by node id.
+type gradientBuffers struct {
+	// down are the partial likelihoods of the subtree
+	down [][]float64
+	// pDown are the partial likelihoods of the subtree
+	// multiplied by the transition matrix of the branch
+	pDown [][]float64
+	// up are the partial likelihoods of the rest of the tree
+	// at the parent node (excluding the subtree)
+	up [][]float64
+	// outside are the partial likelihoods of the rest of the
+	// tree at the node (including the branch)
+	outside [][]float64
+	// log scale factors
+	downScale, upScale, outsideScale []float64
+	mul                              []float64
+}
+
+// newGradientBuffers creates new temporary buffers.
+func (m *BaseModel) newGradientBuffers() *gradientBuffers {
+	nni := m.data.Tree.MaxNodeID() + 1
+	NCodon := m.data.cFreq.GCode.NCodon
+	b := &gradientBuffers{
+		down:         make([][]float64, nni),
+		pDown:        make([][]float64, nni),
+		up:           make([][]float64, nni),
+		outside:      make([][]float64, nni),
+		downScale:    make([]float64, nni),
+		upScale:      make([]float64, nni),
+		outsideScale: make([]float64, nni),
+		mul:          make([]float64, NCodon),
+	}
+	for i := 0; i < nni; i++ {
+		b.down[i] = make([]float64, NCodon)
+		b.pDown[i] = make([]float64, NCodon)
+		b.up[i] = make([]float64, NCodon)
+		b.outside[i] = make([]float64, NCodon)
+	}
+	return b
+}
+
+// branchDerivatives computes derivatives of the transition matrices
+// with respect to the branch lengths for every class.
+func (m *BaseModel) branchDerivatives() (dP [][][]float64) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	cD := mat64.NewDense(NCodon, NCodon, nil)
+	tmp := make([]float64, NCodon*NCodon)
+	dP = make([][][]float64, len(m.qs))
+	for class := range m.qs {
+		dP[class] = make([][]float64, m.data.Tree.MaxNodeID()+1)
+		for _, node := range m.data.Tree.NodeIDArray() {
+			if node == nil || node.IsRoot() {
+				continue
+			}
+			var oclass int
+			for oclass = class - 1; oclass >= 0; oclass-- {
+				if m.qs[class][node.ID] == m.qs[oclass][node.ID] {
+					dP[class][node.ID] = dP[oclass][node.ID]
+					break
+				}
+			}
+			if oclass >= 0 {
+				continue
+			}
+			// P=e^(Qt/scale)
+			s := m.scale[node.ID]
+			d, err := m.qs[class][node.ID].DExp(cD, node.BranchLength/s, nil, tmp)
+			if err != nil {
+				panic("error computing matrix derivative")
+			}
+			for i := range d {
+				d[i] /= s
+			}
+			dP[class][node.ID] = d
+		}
+	}
+	return
+}
+
+// branchSubL computes likelihood for a given site class and position
+// and the derivatives of the likelihood with respect to the branch
+// lengths. The likelihood is res*exp(scale), derivatives for every
+// node are dres[node.ID]*exp(dscale[node.ID]).
+func (m *BaseModel) branchSubL(class, pos int, dP [][]float64, b *gradientBuffers, dres, dscale []float64) (res, scale float64) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	eQts := m.eQts[class]
+
+	// downward pass (pruning)
+	for node := range m.data.Tree.Terminals() {
+		cod := m.data.cSeqs[node.LeafID].Sequence[pos]
+		for l := byte(0); l < byte(NCodon); l++ {
+			if cod == codon.NOCODON || l == cod {
+				b.down[node.ID][l] = 1
+			} else {
+				b.down[node.ID][l] = 0
+			}
+		}
+		b.downScale[node.ID] = 0
+		impl.Dgemv(blas.NoTrans, NCodon, NCodon, 1, eQts[node.ID], NCodon, b.down[node.ID], 1, 0, b.pDown[node.ID], 1)
+	}
+
+	var root int
+	for _, node := range m.data.Tree.NodeOrder() {
+		down := b.down[node.ID]
+		for l := range down {
+			down[l] = 1
+		}
+		b.downScale[node.ID] = 0
+		for _, child := range node.ChildNodes() {
+			for l, v := range b.pDown[child.ID] {
+				down[l] *= v
+			}
+			b.downScale[node.ID] += b.downScale[child.ID]
+		}
+		b.downScale[node.ID] += scalePartial(down)
+		if node.IsRoot() {
+			root = node.ID
+			res = impl.Ddot(NCodon, m.cFreq.Freq, 1, down, 1)
+			scale = b.downScale[node.ID]
+			break
+		}
+		impl.Dgemv(blas.NoTrans, NCodon, NCodon, 1, eQts[node.ID], NCodon, down, 1, 0, b.pDown[node.ID], 1)
+	}
+
+	// upward pass in pre-order
+	copy(b.outside[root], m.cFreq.Freq)
+	b.outsideScale[root] = 0
+	order := m.data.Tree.NodeOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		node := order[i]
+		for _, child := range node.ChildNodes() {
+			up := b.up[child.ID]
+			copy(up, b.outside[node.ID])
+			b.upScale[child.ID] = b.outsideScale[node.ID]
+			for _, sibling := range node.ChildNodes() {
+				if sibling == child {
+					continue
+				}
+				for l, v := range b.pDown[sibling.ID] {
+					up[l] *= v
+				}
+				b.upScale[child.ID] += b.downScale[sibling.ID]
+			}
+			b.upScale[child.ID] += scalePartial(up)
+
+			// derivative for the branch
+			impl.Dgemv(blas.NoTrans, NCodon, NCodon, 1, dP[child.ID], NCodon, b.down[child.ID], 1, 0, b.mul, 1)
+			dres[child.ID] = impl.Ddot(NCodon, up, 1, b.mul, 1)
+			dscale[child.ID] = b.upScale[child.ID] + b.downScale[child.ID]
+
+			if !child.IsTerminal() {
+				outside := b.outside[child.ID]
+				impl.Dgemv(blas.Trans, NCodon, NCodon, 1, eQts[child.ID], NCodon, up, 1, 0, outside, 1)
+				b.outsideScale[child.ID] = b.upScale[child.ID] + scalePartial(outside)
+			}
+		}
+	}
+	return
+}
+
+// Gradient computes likelihood and its derivatives with respect to
+// the branch lengths using the downward and upward partial
+// likelihoods. Derivatives are only computed if branch lengths are
+// optimized and no aggregation is used.
+func (m *BaseModel) Gradient() (lnL float64, grad map[string]float64) {
+	lnL = m.Likelihood()
+	if !m.optBranch || m.aggMode != AggNone {
+		return lnL, nil
+	}
+
+	dP := m.branchDerivatives()
+
+	nni := m.data.Tree.MaxNodeID() + 1
+	nWorkers := m.workers()
+	tasks := make(chan int, len(m.patternPos))
+	results := make(chan []float64, nWorkers)
+
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			b := m.newGradientBuffers()
+			g := make([]float64, nni)
+			// derivatives of the pattern likelihood
+			dl := make([]float64, nni)
+			dlScale := make([]float64, nni)
+			// derivatives of the class likelihood
+			dres := make([]float64, nni)
+			dscale := make([]float64, nni)
+			for k := range tasks {
+				pos := m.patternPos[k]
+				if len(m.lettersF[pos]) == 1 {
+					// no letters in the current position
+					// probability = 1, derivative = 0
+					continue
+				}
+				for i := range dl {
+					dl[i] = 0
+					dlScale[i] = 0
+				}
+				for class, p := range m.prop[pos] {
+					if p <= smallProp {
+						continue
+					}
+					m.branchSubL(class, pos, dP[class], b, dres, dscale)
+					for _, node := range m.data.Tree.NodeIDArray() {
+						if node == nil || node.IsRoot() {
+							continue
+						}
+						dl[node.ID], dlScale[node.ID] = addScaled(dl[node.ID], dlScale[node.ID], dres[node.ID]*p, dscale[node.ID])
+					}
+				}
+				// d lnL = dL / L
+				for i, v := range dl {
+					if v != 0 {
+						g[i] += m.patternWeight[k] * v * math.Exp(dlScale[i]-m.l[k])
+					}
+				}
+			}
+			results <- g
+		}()
+	}
+
+	for k := range m.patternPos {
+		tasks <- k
+	}
+	close(tasks)
+
+	g := make([]float64, nni)
+	for i := 0; i < nWorkers; i++ {
+		for j, v := range <-results {
+			g[j] += v
+		}
+	}
+
+	grad = make(map[string]float64, nni)
+	for _, node := range m.data.Tree.NodeIDArray() {
+		if node == nil || node.IsRoot() {
+			continue
+		}
+		grad["br"+strconv.Itoa(node.ID)] = g[node.ID]
+	}
+	return
+}
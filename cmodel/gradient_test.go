@@ -0,0 +1,98 @@
+package cmodel
+
+import (
+	"math"
+	"runtime"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// checkGradient compares analytic derivatives with the finite
+// differences.
+func checkGradient(tst *testing.T, m optimize.Differentiable) {
+	L, grad := m.Gradient()
+	if len(grad) == 0 {
+		tst.Fatal("No analytic derivatives")
+	}
+	h := 1e-5
+	for _, par := range m.GetFloatParameters() {
+		g, ok := grad[par.Name()]
+		if !ok {
+			continue
+		}
+		v := par.Get()
+		par.Set(v + h)
+		L2 := m.Likelihood()
+		par.Set(v - h)
+		L1 := m.Likelihood()
+		par.Set(v)
+		d := (L2 - L1) / 2 / h
+		if math.Abs(d-g) > 1e-4*math.Max(1, math.Abs(d)) {
+			tst.Error(par.Name(), ": expected", d, ", got", g)
+		}
+	}
+	if L2 := m.Likelihood(); math.Abs(L-L2) > 1e-8 {
+		tst.Error("Likelihood changed: expected", L, ", got", L2)
+	}
+}
+
+func TestGradientM0D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	m := NewM0(data)
+	m.SetParameters(2, 0.5)
+	m.SetOptimizeBranchLengths()
+	checkGradient(tst, m)
+}
+
+func TestGradientBranchSiteD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	m := NewBranchSite(data, false)
+	m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+	m.SetOptimizeBranchLengths()
+	checkGradient(tst, m)
+
+	// with rescaling at every node
+	alwaysScale(func() {
+		m := NewBranchSite(data, false)
+		m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+		m.SetOptimizeBranchLengths()
+		checkGradient(tst, m)
+	})
+}
+
+func TestParallelGradientD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	m := NewBranchSite(data, false)
+	m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+	m.SetAggregationMode(AggObserved)
+	pars := m.GetFloatParameters()
+	x := pars.Values(nil)
+
+	procs := runtime.GOMAXPROCS(1)
+	defer runtime.GOMAXPROCS(procs)
+	l := optimize.NewLBFGSB()
+	l.SetOptimizable(m)
+	expected := append([]float64{}, l.EvaluateGradient(x)...)
+
+	runtime.GOMAXPROCS(4)
+	l = optimize.NewLBFGSB()
+	l.SetOptimizable(m)
+	for i, g := range l.EvaluateGradient(x) {
+		if math.Abs(g-expected[i]) > 1e-6 {
+			tst.Error("i=", i, "expected", expected[i], ", got", g)
+		}
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"math"
 	"testing"
 
+	"github.com/gonum/matrix/mat64"
 	"github.com/op/go-logging"
+
+	"bitbucket.org/Davydov/godon/optimize"
 )
 
 const (
@@ -117,6 +120,333 @@ func TestM0F0D3(tst *testing.T) {
 	}
 }
 
+/*** Test MG94 ***/
+func TestM0MGF0D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F0")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err = data.SetCodonModel("MG"); err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+
+	// with equal frequencies MG94 is equivalent to GY94
+	L := m0.Likelihood()
+	refL := -2836.196647
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+func TestM0MGF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err = data.SetCodonModel("MG"); err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+
+	L := m0.Likelihood()
+	// this comes from cmodel/misc/lnlref (m0 mg 2 0.5)
+	refL := -2828.446049
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+/*** Test GTR ***/
+
+// setHKYExchangeabilities sets GTR exchangeabilities equivalent to
+// the HKY-style kappa (A<->G exchangeability is fixed to one).
+func setHKYExchangeabilities(tst *testing.T, pars optimize.FloatParameters, kappa float64) {
+	for _, name := range []string{"rAC", "rAT", "rCG", "rGT"} {
+		if err := pars.SetByName(name, 1/kappa); err != nil {
+			tst.Error("Error: ", err)
+		}
+	}
+	if err := pars.SetByName("rCT", 1); err != nil {
+		tst.Error("Error: ", err)
+	}
+}
+
+func TestM0GTRF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	data.SetGTR()
+
+	m0 := NewM0(data)
+	m0.SetParameters(1, 0.5)
+	pars := m0.GetFloatParameters()
+	if err := pars.SetByName("kappa", 2); err == nil {
+		tst.Error("Expected no kappa parameter with GTR")
+	}
+	setHKYExchangeabilities(tst, pars, 2)
+
+	L := m0.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+func TestBranchSiteGTRF0D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F0")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	data.SetGTR()
+
+	p0, p1 := 0.946800, 0.000098
+
+	h1 := NewBranchSite(data, false)
+	h1.SetParameters(1, 0.020004, 1.000000, p0, p1)
+	setHKYExchangeabilities(tst, h1.GetFloatParameters(), 1.909912)
+	L := h1.Likelihood()
+	refL := -2467.931313
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+/*** Test multi-nucleotide changes ***/
+func TestM0MNMF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	data.SetMultiNucleotide()
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+	pars := m0.GetFloatParameters()
+	for _, name := range []string{"delta", "psi"} {
+		if err := pars.SetByName(name, 0); err != nil {
+			tst.Error("Error: ", err)
+		}
+	}
+
+	// no multi-nucleotide changes, equivalent to M0
+	L := m0.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	if err := pars.SetByName("delta", 0.5); err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err := pars.SetByName("psi", 0.1); err != nil {
+		tst.Error("Error: ", err)
+	}
+	L = m0.Likelihood()
+	// this comes from cmodel/misc/lnlref (m0 gy 2 0.5 0.5 0.1)
+	refL = -3173.671199
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+func TestM0MGMNMF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err = data.SetCodonModel("MG"); err != nil {
+		tst.Error("Error: ", err)
+	}
+	data.SetMultiNucleotide()
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+	pars := m0.GetFloatParameters()
+	if err := pars.SetByName("delta", 0.5); err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err := pars.SetByName("psi", 0.1); err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	L := m0.Likelihood()
+	// this comes from cmodel/misc/lnlref (m0 mg 2 0.5 0.5 0.1)
+	refL := -2919.105807
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+/*** Test ECM ***/
+
+// setKappaECM sets ECM exchangeabilities equivalent to kappa: kappa
+// for single transitions, one for single transversions and zero for
+// the multiple nucleotide changes.
+func setKappaECM(data *Data, kappa float64) {
+	gcode := data.cFreq.GCode
+	isPurine := func(n byte) bool { return n == 'A' || n == 'G' }
+	data.ecm = mat64.NewDense(gcode.NCodon, gcode.NCodon, nil)
+	for i1 := 0; i1 < gcode.NCodon; i1++ {
+		for i2 := 0; i2 < gcode.NCodon; i2++ {
+			c1 := gcode.NumCodon[byte(i1)]
+			c2 := gcode.NumCodon[byte(i2)]
+			dist := 0
+			s := 1.0
+			for pos := range c1 {
+				if c1[pos] == c2[pos] {
+					continue
+				}
+				dist++
+				if isPurine(c1[pos]) == isPurine(c2[pos]) {
+					s = kappa
+				}
+			}
+			if dist == 1 {
+				data.ecm.Set(i1, i2, s)
+			}
+		}
+	}
+}
+
+func TestM0ECMF3X4D1(tst *testing.T) {
+	for _, t := range []struct {
+		codonModel string
+		refL       float64
+	}{
+		{"GY", -2892.446106},
+		// this comes from cmodel/misc/lnlref (m0 mg 2 0.5)
+		{"MG", -2828.446049},
+	} {
+		data, err := GetTreeAlignment(data1, "F3X4")
+		if err != nil {
+			tst.Error("Error: ", err)
+		}
+		if err = data.SetCodonModel(t.codonModel); err != nil {
+			tst.Error("Error: ", err)
+		}
+		setKappaECM(data, 2)
+
+		m0 := NewM0(data)
+		m0.SetParameters(1, 0.5)
+		pars := m0.GetFloatParameters()
+		if err := pars.SetByName("kappa", 2); err == nil {
+			tst.Error("Expected no kappa parameter with ECM")
+		}
+
+		L := m0.Likelihood()
+		tst.Log(t.codonModel, ": L=", L, ", Ref=", t.refL, ", diff=", math.Abs(L-t.refL))
+		if math.IsNaN(L) || math.Abs(L-t.refL) > smallDiff {
+			tst.Error(t.codonModel, ": expected ", t.refL, ", got", L)
+		}
+	}
+}
+
+func TestM8ECMF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	m8 := NewM8(data, true, false, 4, 1, 1, false)
+	m8.SetParameters(0.8, 0.5, 1, 2, 5, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0)
+	refL := m8.Likelihood()
+
+	data, err = GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	setKappaECM(data, 2)
+	m8 = NewM8(data, true, false, 4, 1, 1, false)
+	m8.SetParameters(0.8, 0.5, 1, 1, 5, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0)
+	L := m8.Likelihood()
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+func TestBranchSiteECMF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	setKappaECM(data, 1.572572)
+
+	p0, p1 := 0.934681, 0.000000
+
+	h1 := NewBranchSite(data, false)
+	h1.SetParameters(1, 0.015173, 1.000000, p0, p1)
+	L := h1.Likelihood()
+
+	refL := -2474.003708
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+/*** Test estimated frequencies ***/
+func TestM0EstFreqF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err = data.SetEstimateFrequency(); err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+
+	// starting frequencies are empirical
+	L := m0.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	pars := m0.GetFloatParameters()
+	if err := pars.SetByName("fT1", 0.4); err != nil {
+		tst.Error("Error: ", err)
+	}
+	if err := pars.SetByName("fC3prop", 0.2); err != nil {
+		tst.Error("Error: ", err)
+	}
+	L = m0.Likelihood()
+	if math.IsNaN(L) || math.Abs(L-refL) < smallDiff {
+		tst.Error("Expected likelihood different from ", refL, ", got", L)
+	}
+
+	m0c := m0.Copy().(*M0)
+	Lc := m0c.Likelihood()
+	tst.Log("L=", L, ", copy L=", Lc)
+	if math.IsNaN(Lc) || math.Abs(L-Lc) > smallDiff {
+		tst.Error("Expected ", L, " for the copy, got", Lc)
+	}
+}
+
 /*** Test BranchSite ***/
 func TestBranchSiteF0D1(tst *testing.T) {
 	data, err := GetTreeAlignment(data1, "F0")
@@ -238,6 +568,201 @@ func TestBranchSiteF3X4D3(tst *testing.T) {
 	}
 }
 
+/*** Test branch model ***/
+func TestBranchModelF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	// with equal omegas branch model is equivalent to M0
+	bm := NewBranchModel(data, false, false)
+	bm.SetParameters(2, 0.5, 0.5)
+
+	L := bm.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	if n := len(bm.GetFloatParameters()); n != 3 {
+		tst.Error("Expected 3 parameters, got", n)
+	}
+
+	bm.SetParameters(2, 0.5, 2)
+	if newL := bm.Likelihood(); math.Abs(newL-L) < smallDiff {
+		tst.Error("Foreground omega has no effect on likelihood")
+	}
+}
+
+func TestBranchModelFreeRatioF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	bm := NewBranchModel(data, false, true)
+	bm.SetParameters(2, 0.5)
+
+	L := bm.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	// one omega per branch plus kappa
+	if n, ref := len(bm.GetFloatParameters()), data.Tree.NNodes(); n != ref {
+		tst.Error("Expected", ref, "parameters, got", n)
+	}
+}
+
+/*** Test clade models ***/
+func TestCladeModelF3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m2 := NewM2(data, true, 1, 1)
+	m2.SetParameters(0.8, 0.7, 0.1, 2, 2, 1, 1)
+	refL := m2.Likelihood()
+
+	// with equal omega2 all the models are equivalent to M2a
+	m2rel := NewM2Rel(data, 1, 1)
+	m2rel.SetParameters(0.8, 0.7, 0.1, 2, 2, 1, 1)
+
+	cmc := NewCladeModel(data, false, 1, 1)
+	cmc.SetParameters(0.8, 0.7, 0.1, 2, 2, 1, 1)
+
+	cmd := NewCladeModel(data, true, 1, 1)
+	cmd.SetParameters(0.8, 0.7, 0.1, 2, 2, 1, 1)
+	cmd.SetCladeParameters(1, 2, 2)
+
+	for _, m := range []*M2{m2rel, cmc, cmd} {
+		L := m.Likelihood()
+		tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+		if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+			tst.Error("Expected ", refL, ", got", L)
+		}
+	}
+
+	if n, ref := len(cmc.GetFloatParameters()), len(m2rel.GetFloatParameters())+1; n != ref {
+		tst.Error("Expected", ref, "parameters, got", n)
+	}
+
+	cmc.SetCladeParameters(1, 2, 0.5)
+	if L := cmc.Likelihood(); math.Abs(L-refL) < smallDiff {
+		tst.Error("Foreground omega2 has no effect on likelihood")
+	}
+}
+
+/*** Test M3 ***/
+func TestM3F3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	// with equal omegas M3 is equivalent to M0
+	m3 := NewM3(data, 3)
+	m3.SetParameters(2, []float64{0.5, 0.5, 0.5}, []float64{0.5, 0.3, 0.2})
+
+	L := m3.Likelihood()
+	refL := -2892.446106
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	_, _, p := m3.GetParameters()
+	for i, refP := range []float64{0.5, 0.3, 0.2} {
+		if math.Abs(p[i]-refP) > 1e-10 {
+			tst.Error("Expected p", i, "=", refP, ", got", p[i])
+		}
+	}
+
+	m3.SetParameters(2, []float64{0.05, 0.5, 3}, []float64{0.5, 0.3, 0.2})
+	m3.Final(true, false, false, false, false)
+	if len(m3.summary.SitePosteriorNEB) != data.cSeqs.Length() {
+		tst.Error("Expected NEB posterior for every site")
+	}
+}
+
+/*** Test M5, M6 & M10 ***/
+func TestM5M6F3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m5 := NewM5(data, 4)
+	m5.SetParameters(2, 0, 0.5, 0.8, 0, 0, 0)
+	L := m5.Likelihood()
+	// this comes from cmodel/misc/lnlref (m5 2 0.5 0.8 4)
+	refL := -2694.891453
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	// M6 with p0=1 is equivalent to M5
+	m6 := NewM6(data, 4)
+	m6.SetParameters(2, 1, 0.5, 0.8, 2, 0, 0)
+	L = m6.Likelihood()
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	m6.SetParameters(2, 0.7, 0.5, 0.8, 2, 0, 0)
+	L = m6.Likelihood()
+	// this comes from cmodel/misc/lnlref (m6 2 0.7 0.5 0.8 2 4)
+	refL = -2755.222914
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
+func TestM10F3X4D1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+
+	m7 := NewM8(data, false, false, 4, 1, 1, false)
+	m7.SetParameters(0, 0.5, 1.5, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	refL := m7.Likelihood()
+
+	// M10 with p0=1 is equivalent to M7
+	m10 := NewM10(data, 4, 3)
+	m10.SetParameters(2, 1, 3, 0.8, 0, 0.5, 1.5)
+	L := m10.Likelihood()
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+
+	m10.SetParameters(2, 0.9, 3, 0.8, 0, 0.5, 1.5)
+	L = m10.Likelihood()
+	// this comes from cmodel/misc/lnlref (m10 2 0.9 3 0.8 0.5 1.5 4 3)
+	refL = -2652.433616
+
+	tst.Log("L=", L, ", Ref=", refL, ", diff=", math.Abs(L-refL))
+	if math.IsNaN(L) || math.Abs(L-refL) > smallDiff {
+		tst.Error("Expected ", refL, ", got", L)
+	}
+}
+
 /*** Benchmark M0 ***/
 func BenchmarkM0F0D1(b *testing.B) {
 	data, err := GetTreeAlignment(data1, "F0")
@@ -0,0 +1,385 @@
+package cmodel
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+
+	"github.com/gonum/blas"
+
+	"bitbucket.org/Davydov/godon/tree"
+)
+
+// maxJumps is the maximum number of jumps (including virtual ones)
+// sampled on a branch during uniformization.
+const maxJumps = 1000
+
+// BranchSubstitutions stores the expected numbers of synonymous and
+// nonsynonymous substitutions on a branch.
+type BranchSubstitutions struct {
+	// NodeID is the id of the node below the branch.
+	NodeID int `json:"nodeID"`
+	// Synonymous is the expected number of synonymous
+	// substitutions.
+	Synonymous float64 `json:"synonymous"`
+	// Nonsynonymous is the expected number of nonsynonymous
+	// substitutions.
+	Nonsynonymous float64 `json:"nonsynonymous"`
+	// SiteSynonymous is the expected number of synonymous
+	// substitutions for every site.
+	SiteSynonymous []float64 `json:"siteSynonymous"`
+	// SiteNonsynonymous is the expected number of nonsynonymous
+	// substitutions for every site.
+	SiteNonsynonymous []float64 `json:"siteNonsynonymous"`
+}
+
+// SubstitutionMapping is the result of the stochastic mapping.
+type SubstitutionMapping struct {
+	// Samples is the number of sampled histories per site.
+	Samples int `json:"samples"`
+	// Tree is the tree with node ids.
+	Tree string `json:"tree"`
+	// Branches are the expected substitution counts per branch.
+	Branches []BranchSubstitutions `json:"branches"`
+}
+
+// sampleIndex samples an index with probability proportional to
+// the weight. An error is returned if all the weights are zero.
+func sampleIndex(rng *rand.Rand, w []float64) (int, error) {
+	sum := 0.0
+	// last is the last index with a non-zero weight
+	last := 0
+	for i, v := range w {
+		sum += v
+		if v > 0 {
+			last = i
+		}
+	}
+	if !(sum > 0) || math.IsInf(sum, 1) {
+		return 0, errors.New("Cannot sample from zero or invalid weights")
+	}
+	u := rng.Float64() * sum
+	for i, v := range w {
+		u -= v
+		if u < 0 {
+			return i, nil
+		}
+	}
+	// rounding errors
+	return last, nil
+}
+
+// uniformization stores the uniformized rate matrix of a branch
+// (Hobolth & Stone, 2009) and its' powers.
+type uniformization struct {
+	n int
+	// mu is the total rate of the uniformized process
+	mu float64
+	// powers are the powers of the jump matrix, powers[1] is the
+	// jump matrix itself
+	powers [][]float64
+}
+
+// newUniformization creates uniformization of the rate matrix
+// q (flattened) multiplied by the branch length t.
+func newUniformization(q []float64, n int, t float64) *uniformization {
+	u := &uniformization{n: n}
+	for i := 0; i < n; i++ {
+		u.mu = math.Max(u.mu, -q[i*n+i]*t)
+	}
+	id := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		id[i*n+i] = 1
+	}
+	u.powers = [][]float64{id}
+	if u.mu == 0 {
+		return u
+	}
+	b := make([]float64, n*n)
+	for i := range b {
+		b[i] = math.Max(0, id[i]+q[i]*t/u.mu)
+	}
+	u.powers = append(u.powers, b)
+	return u
+}
+
+// power returns k-th power of the jump matrix.
+func (u *uniformization) power(k int) []float64 {
+	n := u.n
+	for len(u.powers) <= k {
+		last := u.powers[len(u.powers)-1]
+		res := make([]float64, n*n)
+		impl.Dgemm(blas.NoTrans, blas.NoTrans, n, n, n, 1, last, n, u.powers[1], n, 0, res, n)
+		u.powers = append(u.powers, res)
+	}
+	return u.powers[k]
+}
+
+// samplePath samples a substitution history from state a to state b
+// conditioned on the end points, pab is the transition
+// probability. It returns the sequence of states after every real
+// substitution.
+func (u *uniformization) samplePath(rng *rand.Rand, a, b int, pab float64, path []int) ([]int, error) {
+	path = path[:0]
+	n := u.n
+	if u.mu == 0 {
+		return path, nil
+	}
+
+	// sample the number of jumps
+	r := rng.Float64() * pab
+	pois := math.Exp(-u.mu)
+	nJumps := 0
+	for ; nJumps < maxJumps; nJumps++ {
+		if nJumps > 0 {
+			pois *= u.mu / float64(nJumps)
+		}
+		r -= pois * u.power(nJumps)[a*n+b]
+		if r < 0 {
+			break
+		}
+		if float64(nJumps) > u.mu && pois < 1e-300 {
+			break
+		}
+	}
+
+	// sample the intermediate states
+	w := make([]float64, n)
+	c := a
+	for i := 1; i < nJumps; i++ {
+		rest := u.power(nJumps - i)
+		for k := range w {
+			w[k] = u.powers[1][c*n+k] * rest[k*n+b]
+		}
+		k, err := sampleIndex(rng, w)
+		if err != nil {
+			return nil, err
+		}
+		if k != c {
+			path = append(path, k)
+			c = k
+		}
+	}
+	if nJumps > 0 && c != b {
+		path = append(path, b)
+	}
+	return path, nil
+}
+
+// StochasticMapping samples substitution histories conditioned on
+// the data (Nielsen, 2002) for every site and returns the expected
+// numbers of synonymous and nonsynonymous substitutions for every
+// branch. A site class is sampled for every site according to its'
+// posterior, then node states are sampled and finally substitution
+// histories are sampled for every branch using uniformization.
+func (m *BaseModel) StochasticMapping(nSamples int) (*SubstitutionMapping, error) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nPos := m.data.cSeqs.Length()
+	nni := m.data.Tree.MaxNodeID() + 1
+	nClass := len(m.qs)
+	nodes := m.data.Tree.NodeOrder()
+
+	m.expBranchesIfNeeded()
+
+	// seeds are generated in advance to make results reproducible
+	posSeeds := make([]int64, nPos)
+	for i := range posSeeds {
+		posSeeds[i] = rand.Int63()
+	}
+	nodeSeeds := make([]int64, nni)
+	for i := range nodeSeeds {
+		nodeSeeds[i] = rand.Int63()
+	}
+
+	// sampled site classes and node states, sample s for
+	// position pos has index s*nPos+pos
+	classes := make([]int, nSamples*nPos)
+	states := make([]byte, nSamples*nPos*nni)
+
+	nWorkers := m.workers()
+	done := make(chan error, nWorkers)
+	tasks := make(chan int, nPos)
+
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			var err error
+			b := newAncestralBuffers(nni, NCodon)
+			classW := make([]float64, nClass)
+			w := make([]float64, NCodon)
+			// sample draws an index and records the first
+			// error
+			sample := func(rng *rand.Rand, w []float64) int {
+				i, e := sampleIndex(rng, w)
+				if e != nil && err == nil {
+					err = e
+				}
+				return i
+			}
+			for pos := range tasks {
+				if err != nil {
+					continue
+				}
+				rng := rand.New(rand.NewSource(posSeeds[pos]))
+				// class weights are computed relative to
+				// the largest log class likelihood
+				maxW := math.Inf(-1)
+				for class, p := range m.prop[pos] {
+					classW[class] = math.Inf(-1)
+					if p > smallProp {
+						if l, scale := m.marginalSubL(class, pos, b); l > 0 {
+							classW[class] = math.Log(p*l) + scale
+							maxW = math.Max(maxW, classW[class])
+						}
+					}
+				}
+				for class := range classW {
+					if math.IsInf(classW[class], -1) {
+						classW[class] = 0
+					} else {
+						classW[class] = math.Exp(classW[class] - maxW)
+					}
+				}
+				for s := 0; s < nSamples; s++ {
+					classes[s*nPos+pos] = sample(rng, classW)
+				}
+				for class := range classW {
+					if classW[class] == 0 {
+						continue
+					}
+					m.marginalSubL(class, pos, b)
+					for s := 0; s < nSamples; s++ {
+						idx := s*nPos + pos
+						if classes[idx] != class {
+							continue
+						}
+						st := states[idx*nni : (idx+1)*nni]
+						for i := len(nodes) - 1; i >= 0; i-- {
+							node := nodes[i]
+							if node.IsRoot() {
+								for l := range w {
+									w[l] = m.cFreq.Freq[l] * b.down[node.ID][l]
+								}
+								st[node.ID] = byte(sample(rng, w))
+							}
+							for _, child := range node.ChildNodes() {
+								q := m.eQts[class][child.ID][int(st[node.ID])*NCodon:]
+								for l := range w {
+									w[l] = q[l] * b.down[child.ID][l]
+								}
+								st[child.ID] = byte(sample(rng, w))
+							}
+						}
+					}
+				}
+			}
+			done <- err
+		}()
+	}
+
+	for pos := 0; pos < nPos; pos++ {
+		tasks <- pos
+	}
+	close(tasks)
+
+	var err error
+	for i := 0; i < nWorkers; i++ {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// indices of the samples for every class
+	byClass := make([][]int, nClass)
+	for idx, class := range classes {
+		byClass[class] = append(byClass[class], idx)
+	}
+
+	var branches []*tree.Node
+	for _, node := range m.data.Tree.NodeIDArray() {
+		if node != nil && !node.IsRoot() {
+			branches = append(branches, node)
+		}
+	}
+	res := &SubstitutionMapping{
+		Samples:  nSamples,
+		Tree:     m.data.Tree.BrString(),
+		Branches: make([]BranchSubstitutions, len(branches)),
+	}
+
+	gcode := m.data.cFreq.GCode
+	brTasks := make(chan int, len(branches))
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			var path []int
+			var err error
+			for i := range brTasks {
+				if err != nil {
+					continue
+				}
+				node := branches[i]
+				rng := rand.New(rand.NewSource(nodeSeeds[node.ID]))
+				syn := make([]float64, nPos)
+				nonsyn := make([]float64, nPos)
+				for class, samples := range byClass {
+					if len(samples) == 0 || err != nil {
+						continue
+					}
+					q := m.qs[class][node.ID].RateMatrix().RawMatrix().Data
+					u := newUniformization(q, NCodon, node.BranchLength/m.scale[node.ID])
+					p := m.eQts[class][node.ID]
+					for _, idx := range samples {
+						st := states[idx*nni : (idx+1)*nni]
+						a := int(st[node.Parent.ID])
+						b := int(st[node.ID])
+						path, err = u.samplePath(rng, a, b, p[a*NCodon+b], path)
+						if err != nil {
+							break
+						}
+						pos := idx % nPos
+						prev := a
+						for _, c := range path {
+							if gcode.Map[gcode.NumCodon[byte(prev)]] == gcode.Map[gcode.NumCodon[byte(c)]] {
+								syn[pos]++
+							} else {
+								nonsyn[pos]++
+							}
+							prev = c
+						}
+					}
+				}
+				br := BranchSubstitutions{
+					NodeID:            node.ID,
+					SiteSynonymous:    syn,
+					SiteNonsynonymous: nonsyn,
+				}
+				for pos := range syn {
+					syn[pos] /= float64(nSamples)
+					nonsyn[pos] /= float64(nSamples)
+					br.Synonymous += syn[pos]
+					br.Nonsynonymous += nonsyn[pos]
+				}
+				res.Branches[i] = br
+			}
+			done <- err
+		}()
+	}
+
+	for i := range branches {
+		brTasks <- i
+	}
+	close(brTasks)
+
+	for i := 0; i < nWorkers; i++ {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
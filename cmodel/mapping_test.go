@@ -0,0 +1,79 @@
+package cmodel
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/codon"
+)
+
+func TestStochasticMappingNoData(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	// without data the expected number of substitutions is the
+	// branch length
+	for _, seq := range data.cSeqs {
+		for i := range seq.Sequence {
+			seq.Sequence[i] = codon.NOCODON
+		}
+	}
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+
+	nPos := data.cSeqs.Length()
+	res, err := m0.StochasticMapping(200)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	nodes := data.Tree.NodeIDArray()
+	for _, br := range res.Branches {
+		expected := nodes[br.NodeID].BranchLength
+		got := (br.Synonymous + br.Nonsynonymous) / float64(nPos)
+		tst.Log("node=", br.NodeID, "expected=", expected, "got=", got)
+		if math.Abs(got-expected) > 0.05*expected+0.002 {
+			tst.Error("node=", br.NodeID, "expected ", expected, ", got", got)
+		}
+	}
+}
+
+func TestStochasticMappingD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	m := NewM2(data, true, 1, 1)
+	m.SetParameters(0.6, 0.5, 0.05, 3, 2, 1, 1)
+
+	rand.Seed(1)
+	res, err := m.StochasticMapping(5)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if len(res.Branches) != data.Tree.NNodes()-1 {
+		tst.Error("Wrong number of branches:", len(res.Branches))
+	}
+	for _, br := range res.Branches {
+		if br.Synonymous < 0 || br.Nonsynonymous < 0 {
+			tst.Error("Negative number of substitutions for node", br.NodeID)
+		}
+	}
+
+	rand.Seed(1)
+	if res2, _ := m.StochasticMapping(5); !reflect.DeepEqual(res, res2) {
+		tst.Error("Stochastic mapping is not reproducible")
+	}
+}
+
+func TestSampleIndexZero(tst *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	if _, err := sampleIndex(rng, []float64{0, 0, 0}); err == nil {
+		tst.Error("Expected an error for zero weights")
+	}
+	if i, err := sampleIndex(rng, []float64{0, 1, 0}); err != nil || i != 1 {
+		tst.Error("Expected index 1, got", i, err)
+	}
+}
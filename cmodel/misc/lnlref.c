@@ -0,0 +1,613 @@
+/* lnlref computes reference log-likelihoods and BEB posteriors for
+   the cmodel tests. It does not share any code with godon: the
+   likelihood is computed by a straightforward pruning algorithm,
+   while the eigen decomposition, the matrix exponentiation and the
+   discretization of the distributions come from PAML's tools.c.
+
+   Codon frequencies are always F3X4 computed from the alignment,
+   branch lengths are fixed to the values in the tree file.
+
+   Usage: lnlref alignment.fst tree.nwk command parameters
+
+   Commands:
+     m0 gy|mg kappa omega [delta psi]
+     m5 kappa omega alpha ncat
+     m6 kappa p0 omega alpha alpha2 ncat
+     m10 kappa p0 omega alpha p q ncatb ncatg
+     m2beb p0 p1prop omega0 omega2 kappa
+     m8beb p0 p q kappa omega ncatb
+
+   Gamma distributions are parametrized by the mean and the shape,
+   the mean of the second gamma of M6 is one, M10 uses gamma+1. All
+   the distributions are discretized using the mean method.
+*/
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <math.h>
+
+/* tools.c */
+int eigenQREV(double Q[], double pi[], int n, double Root[], double U[], double V[], double spacesqrtpi[]);
+int PMatUVRoot(double P[], double t, int n, double U[], double V[], double Root[]);
+int DiscreteBeta(double freq[], double x[], double p, double q, int K, int UseMedian);
+int DiscreteGamma(double freqK[], double rK[], double alpha, double beta, int K, int UseMedian);
+void GetIndexTernary(int *ix, int *iy, double *x, double *y, int itriangle, int K);
+
+#define NC 61
+#define MAXSEQ 100
+#define MAXNODE (2 * MAXSEQ)
+#define MAXLEN 100000
+#define GRID 10
+
+static const char *nucs = "TCAG";
+static const char *aas = "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG";
+
+/* sense codons */
+static char codons[NC][4];
+static char aa[NC];
+
+static int nseq, ncodon;
+static char *names[MAXSEQ];
+static char *seqs[MAXSEQ];
+/* codon indices of the sequences, -1 for missing */
+static int *cseqs[MAXSEQ];
+
+static double pi[NC], nfreq[3][4];
+static int mg94 = 0;
+static double delta = 0, psi = 0;
+
+typedef struct Node {
+   int nchild;
+   int child[MAXSEQ];
+   int seq;
+   double t;
+} Node;
+
+static Node nodes[MAXNODE];
+static int nnode, root;
+
+static void error(const char *msg)
+{
+   fprintf(stderr, "%s\n", msg);
+   exit(1);
+}
+
+static int nucIndex(char c)
+{
+   const char *p = strchr(nucs, c);
+   return (c && p) ? (int)(p - nucs) : -1;
+}
+
+static void initCode(void)
+{
+   int i, j = 0;
+   for (i = 0; i < 64; i++) {
+      if (aas[i] == '*')
+         continue;
+      codons[j][0] = nucs[i / 16];
+      codons[j][1] = nucs[i / 4 % 4];
+      codons[j][2] = nucs[i % 4];
+      codons[j][3] = 0;
+      aa[j] = aas[i];
+      j++;
+   }
+}
+
+static int codonIndex(const char *c)
+{
+   int i;
+   for (i = 0; i < NC; i++)
+      if (strncmp(codons[i], c, 3) == 0)
+         return i;
+   return -1;
+}
+
+static void readFasta(const char *fn)
+{
+   FILE *f = fopen(fn, "r");
+   char line[10000];
+   int i, len = 0;
+   if (!f)
+      error("cannot open alignment");
+   nseq = -1;
+   while (fgets(line, sizeof(line), f)) {
+      line[strcspn(line, "\r\n")] = 0;
+      if (line[0] == '>') {
+         if (++nseq >= MAXSEQ)
+            error("too many sequences");
+         names[nseq] = malloc(strlen(line));
+         strcpy(names[nseq], line + 1);
+         seqs[nseq] = calloc(MAXLEN, 1);
+         len = 0;
+         continue;
+      }
+      for (i = 0; line[i]; i++)
+         if (!isspace(line[i]) && len < MAXLEN - 1)
+            seqs[nseq][len++] = toupper(line[i]);
+   }
+   fclose(f);
+   nseq++;
+   ncodon = strlen(seqs[0]) / 3;
+   for (i = 0; i < nseq; i++) {
+      int j;
+      if ((int)strlen(seqs[i]) != ncodon * 3)
+         error("sequences of different length");
+      cseqs[i] = malloc(ncodon * sizeof(int));
+      for (j = 0; j < ncodon; j++)
+         cseqs[i][j] = codonIndex(seqs[i] + 3 * j);
+   }
+}
+
+static int parseNode(const char **s)
+{
+   int id = nnode++, i;
+   char name[1000];
+   Node *n = &nodes[id];
+   n->nchild = 0;
+   n->seq = -1;
+   n->t = 0;
+   if (**s == '(') {
+      (*s)++;
+      for (;;) {
+         int c = parseNode(s);
+         nodes[id].child[nodes[id].nchild++] = c;
+         if (**s == ',') {
+            (*s)++;
+            continue;
+         }
+         if (**s != ')')
+            error("tree parse error");
+         (*s)++;
+         break;
+      }
+   }
+   /* name or label */
+   for (i = 0; **s && !strchr(",():;", **s); (*s)++)
+      name[i++] = **s;
+   name[i] = 0;
+   if (nodes[id].nchild == 0) {
+      for (i = 0; i < nseq; i++)
+         if (strcmp(names[i], name) == 0)
+            nodes[id].seq = i;
+      if (nodes[id].seq < 0)
+         error("sequence not found");
+   }
+   if (**s == ':') {
+      (*s)++;
+      nodes[id].t = strtod(*s, (char **)s);
+   }
+   return id;
+}
+
+static void readTree(const char *fn)
+{
+   FILE *f = fopen(fn, "r");
+   char buf[100000], *p = buf;
+   const char *s;
+   int c;
+   if (!f)
+      error("cannot open tree");
+   while ((c = fgetc(f)) != EOF && p - buf < (long)sizeof(buf) - 1)
+      if (!isspace(c))
+         *p++ = c;
+   *p = 0;
+   fclose(f);
+   s = buf;
+   root = parseNode(&s);
+}
+
+/* F3X4 frequencies, stop codons and missing codons are ignored */
+static void f3x4(void)
+{
+   int i, j, k, pos;
+   double sum = 0;
+   memset(nfreq, 0, sizeof(nfreq));
+   for (i = 0; i < nseq; i++)
+      for (j = 0; j < ncodon; j++) {
+         if (cseqs[i][j] < 0)
+            continue;
+         for (pos = 0; pos < 3; pos++)
+            nfreq[pos][nucIndex(codons[cseqs[i][j]][pos])]++;
+      }
+   for (pos = 0; pos < 3; pos++) {
+      double s = 0;
+      for (k = 0; k < 4; k++)
+         s += nfreq[pos][k];
+      for (k = 0; k < 4; k++)
+         nfreq[pos][k] /= s;
+   }
+   for (i = 0; i < NC; i++) {
+      pi[i] = 1;
+      for (pos = 0; pos < 3; pos++)
+         pi[i] *= nfreq[pos][nucIndex(codons[i][pos])];
+      sum += pi[i];
+   }
+   for (i = 0; i < NC; i++)
+      pi[i] /= sum;
+}
+
+static int isTransition(char a, char b)
+{
+   return (strchr("AG", a) && strchr("AG", b)) || (strchr("CT", a) && strchr("CT", b));
+}
+
+/* rate matrix for the given kappa and omega, returns the average
+   rate */
+static double rateMatrix(double Q[], double kappa, double omega)
+{
+   int i, j, pos, ndiff, npos = 0;
+   double scale = 0;
+   for (i = 0; i < NC; i++) {
+      double rowSum = 0;
+      for (j = 0; j < NC; j++) {
+         double q;
+         Q[i * NC + j] = 0;
+         if (i == j)
+            continue;
+         for (pos = 0, ndiff = 0; pos < 3; pos++)
+            if (codons[i][pos] != codons[j][pos]) {
+               ndiff++;
+               npos = pos;
+            }
+         if (ndiff == 1) {
+            q = mg94 ? nfreq[npos][nucIndex(codons[j][npos])] : pi[j];
+            if (isTransition(codons[i][npos], codons[j][npos]))
+               q *= kappa;
+         } else {
+            q = ndiff == 2 ? delta : psi;
+            if (mg94)
+               for (pos = 0; pos < 3; pos++) {
+                  if (codons[i][pos] != codons[j][pos])
+                     q *= nfreq[pos][nucIndex(codons[j][pos])];
+               }
+            else
+               q *= pi[j];
+         }
+         if (aa[i] != aa[j])
+            q *= omega;
+         Q[i * NC + j] = q;
+         rowSum += q;
+      }
+      Q[i * NC + i] = -rowSum;
+      scale += pi[i] * rowSum;
+   }
+   return scale;
+}
+
+/* Class stores the eigen decomposition of a rate matrix */
+typedef struct Class {
+   double U[NC * NC], V[NC * NC], Root[NC];
+   double scale;
+} Class;
+
+static void setClass(Class *c, double kappa, double omega)
+{
+   double Q[NC * NC], space[NC];
+   c->scale = rateMatrix(Q, kappa, omega);
+   eigenQREV(Q, pi, NC, c->Root, c->U, c->V, space);
+}
+
+/* partial likelihoods of a subtree */
+static void partial(Class *c, double scale, int node, double *res)
+{
+   Node *n = &nodes[node];
+   int i, j, k, h;
+   if (n->nchild == 0) {
+      for (h = 0; h < ncodon; h++) {
+         int ci = cseqs[n->seq][h];
+         for (i = 0; i < NC; i++)
+            res[h * NC + i] = (ci < 0 || ci == i) ? 1 : 0;
+      }
+      return;
+   }
+   for (i = 0; i < ncodon * NC; i++)
+      res[i] = 1;
+   for (k = 0; k < n->nchild; k++) {
+      Node *ch = &nodes[n->child[k]];
+      double *cres = malloc(ncodon * NC * sizeof(double));
+      double P[NC * NC];
+      partial(c, scale, n->child[k], cres);
+      PMatUVRoot(P, ch->t / scale, NC, c->U, c->V, c->Root);
+      for (h = 0; h < ncodon; h++)
+         for (i = 0; i < NC; i++) {
+            double s = 0;
+            for (j = 0; j < NC; j++)
+               s += P[i * NC + j] * cres[h * NC + j];
+            res[h * NC + i] *= s;
+         }
+      free(cres);
+   }
+}
+
+/* site likelihoods for a class */
+static void siteLikelihoods(Class *c, double scale, double *l)
+{
+   double *res = malloc(ncodon * NC * sizeof(double));
+   int h, i;
+   partial(c, scale, root, res);
+   for (h = 0; h < ncodon; h++) {
+      l[h] = 0;
+      for (i = 0; i < NC; i++)
+         l[h] += pi[i] * res[h * NC + i];
+   }
+   free(res);
+}
+
+/* log-likelihood of a mixture of omegas, the rate matrices are
+   scaled by the average rate of the mixture */
+static double mixture(double kappa, int n, double omegas[], double props[])
+{
+   Class *c = malloc(n * sizeof(Class));
+   double *l = malloc(ncodon * sizeof(double));
+   double *sl = calloc(ncodon, sizeof(double));
+   double scale = 0, lnL = 0;
+   int i, h;
+   for (i = 0; i < n; i++) {
+      setClass(&c[i], kappa, omegas[i]);
+      scale += props[i] * c[i].scale;
+   }
+   for (i = 0; i < n; i++) {
+      siteLikelihoods(&c[i], scale, l);
+      for (h = 0; h < ncodon; h++)
+         sl[h] += props[i] * l[h];
+   }
+   for (h = 0; h < ncodon; h++)
+      lnL += log(sl[h]);
+   free(c);
+   free(l);
+   free(sl);
+   return lnL;
+}
+
+/* discrete gamma with the given mean and shape */
+static void gamma(double mean, double alpha, int K, double omegas[])
+{
+   double freq[1000];
+   DiscreteGamma(freq, omegas, alpha, alpha / mean, K, 0);
+}
+
+static double m5(int argc, char **argv, int m)
+{
+   double kappa, p0 = 1, omega, alpha, alpha2 = 0, p = 0, q = 0;
+   double omegas[200], props[200], freq[200];
+   int n1, n2 = 0, i;
+   kappa = atof(argv[0]);
+   switch (m) {
+   case 5:
+      if (argc != 4)
+         error("m5 kappa omega alpha ncat");
+      omega = atof(argv[1]);
+      alpha = atof(argv[2]);
+      n1 = atoi(argv[3]);
+      break;
+   case 6:
+      if (argc != 6)
+         error("m6 kappa p0 omega alpha alpha2 ncat");
+      p0 = atof(argv[1]);
+      omega = atof(argv[2]);
+      alpha = atof(argv[3]);
+      alpha2 = atof(argv[4]);
+      n1 = n2 = atoi(argv[5]);
+      break;
+   default:
+      if (argc != 8)
+         error("m10 kappa p0 omega alpha p q ncatb ncatg");
+      p0 = atof(argv[1]);
+      omega = atof(argv[2]);
+      alpha = atof(argv[3]);
+      p = atof(argv[4]);
+      q = atof(argv[5]);
+      n1 = atoi(argv[6]);
+      n2 = atoi(argv[7]);
+   }
+   if (m == 10) {
+      DiscreteBeta(freq, omegas, p, q, n1, 0);
+      gamma(omega - 1, alpha, n2, omegas + n1);
+      for (i = 0; i < n2; i++)
+         omegas[n1 + i] += 1;
+   } else {
+      gamma(omega, alpha, n1, omegas);
+      if (m == 6)
+         gamma(1, alpha2, n2, omegas + n1);
+   }
+   for (i = 0; i < n1; i++)
+      props[i] = p0 / n1;
+   for (i = 0; i < n2; i++)
+      props[n1 + i] = (1 - p0) / n2;
+   return mixture(kappa, n1 + n2, omegas, props);
+}
+
+/* bebPosterior prints the posterior of the selected classes given
+   log-likelihoods of the grid points and the posterior at every
+   grid point */
+static void bebPosterior(int npoint, double lnL[], double *post)
+{
+   double maxL = lnL[0], sum = 0;
+   double *res = calloc(ncodon, sizeof(double));
+   int i, h;
+   for (i = 1; i < npoint; i++)
+      if (lnL[i] > maxL)
+         maxL = lnL[i];
+   for (i = 0; i < npoint; i++) {
+      double w = exp(lnL[i] - maxL);
+      sum += w;
+      for (h = 0; h < ncodon; h++)
+         res[h] += w * post[(long)i * ncodon + h];
+   }
+   for (h = 0; h < ncodon; h++)
+      printf("%d\t%.6f\n", h + 1, res[h] / sum);
+   free(res);
+}
+
+/* M2a BEB: p0 and p1 on the ternary grid, omega0 ~ U(0, 1),
+   omega2 ~ U(1, 11), kappa and branch lengths are fixed */
+static void m2beb(int argc, char **argv)
+{
+   double p0, p1, omega0, omega2, kappa, scale;
+   double omegas[3], props[3];
+   double *l0[GRID], *l2[GRID], *l1, *lnL, *post;
+   Class *c = malloc(sizeof(Class));
+   int i, iw0, iw2, itr, h, npoint = GRID * GRID * GRID * GRID;
+   if (argc != 5)
+      error("m2beb p0 p1prop omega0 omega2 kappa");
+   p0 = atof(argv[0]);
+   p1 = (1 - p0) * atof(argv[1]);
+   omega0 = atof(argv[2]);
+   omega2 = atof(argv[3]);
+   kappa = atof(argv[4]);
+
+   omegas[0] = omega0;
+   omegas[1] = 1;
+   omegas[2] = omega2;
+   props[0] = p0;
+   props[1] = p1;
+   props[2] = 1 - p0 - p1;
+   printf("lnL\t%.6f\n", mixture(kappa, 3, omegas, props));
+
+   /* the scale is fixed at the parameter values */
+   scale = 0;
+   for (i = 0; i < 3; i++) {
+      setClass(c, kappa, omegas[i]);
+      scale += props[i] * c->scale;
+   }
+
+   l1 = malloc(ncodon * sizeof(double));
+   setClass(c, kappa, 1);
+   siteLikelihoods(c, scale, l1);
+   for (i = 0; i < GRID; i++) {
+      l0[i] = malloc(ncodon * sizeof(double));
+      setClass(c, kappa, (i + 0.5) / GRID);
+      siteLikelihoods(c, scale, l0[i]);
+      l2[i] = malloc(ncodon * sizeof(double));
+      setClass(c, kappa, 1 + (i + 0.5) * 10 / GRID);
+      siteLikelihoods(c, scale, l2[i]);
+   }
+
+   lnL = calloc(npoint, sizeof(double));
+   post = malloc((long)npoint * ncodon * sizeof(double));
+   i = 0;
+   for (itr = 0; itr < GRID * GRID; itr++) {
+      int ix, iy;
+      double x, y;
+      GetIndexTernary(&ix, &iy, &x, &y, itr, GRID);
+      for (iw0 = 0; iw0 < GRID; iw0++)
+         for (iw2 = 0; iw2 < GRID; iw2++, i++)
+            for (h = 0; h < ncodon; h++) {
+               double sel = (1 - x - y) * l2[iw2][h];
+               double l = x * l0[iw0][h] + y * l1[h] + sel;
+               lnL[i] += log(l);
+               post[(long)i * ncodon + h] = sel / l;
+            }
+   }
+   bebPosterior(npoint, lnL, post);
+}
+
+/* M8 BEB: p0 ~ U(0, 1), p, q ~ U(0, 2), omega ~ U(1, 11), kappa and
+   branch lengths are fixed */
+static void m8beb(int argc, char **argv)
+{
+   double p0, p, q, kappa, omega, scale;
+   double omegas[101], props[101], freq[100];
+   double *lb[GRID][GRID], *lw[GRID], *l, *lnL, *post;
+   Class *c = malloc(sizeof(Class));
+   int i, j, k, ncatb, ip0, ip, iq, iw, h, npoint = GRID * GRID * GRID * GRID;
+   if (argc != 6)
+      error("m8beb p0 p q kappa omega ncatb");
+   p0 = atof(argv[0]);
+   p = atof(argv[1]);
+   q = atof(argv[2]);
+   kappa = atof(argv[3]);
+   omega = atof(argv[4]);
+   ncatb = atoi(argv[5]);
+   if (ncatb > 100)
+      error("too many categories");
+
+   DiscreteBeta(freq, omegas, p, q, ncatb, 0);
+   for (i = 0; i < ncatb; i++)
+      props[i] = p0 / ncatb;
+   omegas[ncatb] = omega;
+   props[ncatb] = 1 - p0;
+   printf("lnL\t%.6f\n", mixture(kappa, ncatb + 1, omegas, props));
+
+   /* the scale is fixed at the parameter values */
+   scale = 0;
+   for (i = 0; i <= ncatb; i++) {
+      setClass(c, kappa, omegas[i]);
+      scale += props[i] * c->scale;
+   }
+
+   l = malloc(ncodon * sizeof(double));
+   for (i = 0; i < GRID; i++)
+      for (j = 0; j < GRID; j++) {
+         lb[i][j] = calloc(ncodon, sizeof(double));
+         DiscreteBeta(freq, omegas, (i + 0.5) * 2 / GRID, (j + 0.5) * 2 / GRID, ncatb, 0);
+         for (k = 0; k < ncatb; k++) {
+            setClass(c, kappa, omegas[k]);
+            siteLikelihoods(c, scale, l);
+            for (h = 0; h < ncodon; h++)
+               lb[i][j][h] += l[h] / ncatb;
+         }
+      }
+   for (i = 0; i < GRID; i++) {
+      lw[i] = malloc(ncodon * sizeof(double));
+      setClass(c, kappa, 1 + (i + 0.5) * 10 / GRID);
+      siteLikelihoods(c, scale, lw[i]);
+   }
+
+   lnL = calloc(npoint, sizeof(double));
+   post = malloc((long)npoint * ncodon * sizeof(double));
+   i = 0;
+   for (ip0 = 0; ip0 < GRID; ip0++) {
+      double pr = (ip0 + 0.5) / GRID;
+      for (ip = 0; ip < GRID; ip++)
+         for (iq = 0; iq < GRID; iq++)
+            for (iw = 0; iw < GRID; iw++, i++)
+               for (h = 0; h < ncodon; h++) {
+                  double sel = (1 - pr) * lw[iw][h];
+                  double lh = pr * lb[ip][iq][h] + sel;
+                  lnL[i] += log(lh);
+                  post[(long)i * ncodon + h] = sel / lh;
+               }
+   }
+   bebPosterior(npoint, lnL, post);
+}
+
+int main(int argc, char **argv)
+{
+   const char *cmd;
+   if (argc < 4)
+      error("usage: lnlref alignment.fst tree.nwk command parameters");
+   initCode();
+   readFasta(argv[1]);
+   readTree(argv[2]);
+   f3x4();
+   cmd = argv[3];
+   argc -= 4;
+   argv += 4;
+
+   if (strcmp(cmd, "m0") == 0) {
+      double omegas[1], props[1] = {1};
+      if (argc != 3 && argc != 5)
+         error("m0 gy|mg kappa omega [delta psi]");
+      mg94 = strcmp(argv[0], "mg") == 0;
+      if (argc == 5) {
+         delta = atof(argv[3]);
+         psi = atof(argv[4]);
+      }
+      omegas[0] = atof(argv[2]);
+      printf("lnL\t%.6f\n", mixture(atof(argv[1]), 1, omegas, props));
+   } else if (strcmp(cmd, "m5") == 0)
+      printf("lnL\t%.6f\n", m5(argc, argv, 5));
+   else if (strcmp(cmd, "m6") == 0)
+      printf("lnL\t%.6f\n", m5(argc, argv, 6));
+   else if (strcmp(cmd, "m10") == 0)
+      printf("lnL\t%.6f\n", m5(argc, argv, 10));
+   else if (strcmp(cmd, "m2beb") == 0)
+      m2beb(argc, argv);
+   else if (strcmp(cmd, "m8beb") == 0)
+      m8beb(argc, argv);
+   else
+      error("unknown command");
+   return 0;
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/gonum/blas/cgo"
 	"github.com/gonum/matrix/mat64"
 
+	"bitbucket.org/Davydov/godon/bio"
 	"bitbucket.org/Davydov/godon/codon"
 	"bitbucket.org/Davydov/godon/optimize"
 	"bitbucket.org/Davydov/godon/tree"
@@ -50,12 +51,24 @@ type TreeOptimizable interface {
 	SetMaxBranchLength(float64)
 	// SetAggregationMode changes the aggregation mode.
 	SetAggregationMode(AggMode)
+	// SetCache enables or disables the partial likelihood cache.
+	SetCache(enabled bool)
 	// GetTreeString returns tree in a newick format.
 	GetTreeString() string
 	// Final performs analysis after optimization is complete.
 	Final(neb, beb, codonRates, siteRates, codonOmega bool)
 	// Summary returns summary of the object for JSON export.
 	Summary() interface{}
+	// Ancestral returns the ancestral sequence reconstruction for
+	// all the internal nodes.
+	Ancestral() []AncestralNode
+	// StochasticMapping returns the expected numbers of
+	// synonymous and nonsynonymous substitutions per branch
+	// using nSamples sampled substitution histories.
+	StochasticMapping(nSamples int) (*SubstitutionMapping, error)
+	// Simulate simulates an alignment of nPos codons, it returns
+	// the sequences and the site class of every codon.
+	Simulate(nPos int) (bio.Sequences, []int)
 }
 
 // TreeOptimizableSiteClass is a special case of TreeOptimizable which
@@ -106,6 +119,21 @@ type BaseModel struct {
 	// aggregation mode
 	aggMode AggMode
 
+	// cFreq is codon frequencies used by the model, they are
+	// different from the data frequencies if estimated
+	cFreq codon.Frequency
+	// freqProp are stick-breaking proportions defining the
+	// estimated nucleotide frequencies (nil if frequencies are
+	// not estimated)
+	freqProp [][]float64
+
+	// gtr are GTR nucleotide exchangeabilities (nil if kappa is
+	// used instead)
+	gtr []float64
+	// delta and psi are relative rates of double and triple
+	// nucleotide changes (zero unless enabled in data)
+	delta, psi float64
+
 	// remember computations wee need to perform
 	expAllBr bool
 	expBr    []bool
@@ -113,14 +141,31 @@ type BaseModel struct {
 	// this is a list of exponentiated matrices
 	eQts [][][]float64
 
-	// likelihoods per position
+	// site patterns, likelihood is computed only once for every
+	// pattern; patterns is the pattern index of every position,
+	// patternPos is the first position of every pattern and
+	// patternWeight is the number of positions with the pattern
+	patterns      []int
+	patternPos    []int
+	patternWeight []float64
+
+	// likelihoods per pattern
 	prunAllPos bool
 	prunPos    []bool
 	l          []float64
 
+	// cache of partial likelihoods, nil if disabled
+	cache *partialCache
+	// noCache disables the cache
+	noCache bool
+
 	// fatness is the number of positions to process
 	// at a time
 	fatness int
+
+	// nThreads is the number of threads used for the likelihood
+	// computations, zero means all the available threads
+	nThreads int
 }
 
 // NewBaseModel creates a new base Model.
@@ -139,10 +184,19 @@ func NewBaseModel(data *Data, model Model) (bm *BaseModel) {
 		expBr:    make([]bool, data.Tree.MaxNodeID()+1),
 		prop:     make([][]float64, data.cSeqs.Length()),
 		nclass:   nclass,
-		l:        make([]float64, data.cSeqs.Length()),
-		prunPos:  make([]bool, data.cSeqs.Length()),
 		fatness:  fatness,
 	}
+	bm.cFreq = data.cFreq
+	if data.freqGroups > 0 {
+		bm.initFrequency()
+	}
+	if data.gtr {
+		bm.gtr = []float64{1, 1, 1, 1, 1, 1}
+	}
+	if data.mnm {
+		bm.delta = 0.1
+		bm.psi = 0.01
+	}
 	p := make([]float64, nclass)
 	for i := range bm.prop {
 		bm.prop[i] = p
@@ -152,6 +206,7 @@ func NewBaseModel(data *Data, model Model) (bm *BaseModel) {
 	}
 	data.Tree.NodeOrder()
 	bm.ReorderAlignment()
+	bm.setupPatterns()
 	return
 }
 
@@ -161,7 +216,21 @@ func (m *BaseModel) Copy() (newM *BaseModel) {
 	copy(newM.prop[0], m.prop[0])
 	newM.as = m.as
 	newM.optBranch = m.optBranch
+	newM.maxBrLen = m.maxBrLen
 	newM.rshuffle = m.rshuffle
+	newM.aggMode = m.aggMode
+	newM.nThreads = m.nThreads
+	newM.noCache = m.noCache
+	newM.setupPatterns()
+	copy(newM.gtr, m.gtr)
+	newM.delta = m.delta
+	newM.psi = m.psi
+	if m.freqProp != nil {
+		for i := range m.freqProp {
+			copy(newM.freqProp[i], m.freqProp[i])
+		}
+		newM.updateFrequency()
+	}
 	return
 }
 
@@ -171,6 +240,26 @@ func (m *BaseModel) SetAdaptive(as *optimize.AdaptiveSettings) {
 	m.setupParameters()
 }
 
+// SetThreads limits the number of threads used for the likelihood
+// computations, zero means all the available threads.
+func (m *BaseModel) SetThreads(n int) {
+	m.nThreads = n
+}
+
+// SetCache enables or disables the partial likelihood cache.
+func (m *BaseModel) SetCache(enabled bool) {
+	m.noCache = !enabled
+	m.setupCache()
+}
+
+// workers returns the number of threads to use.
+func (m *BaseModel) workers() int {
+	if m.nThreads > 0 {
+		return m.nThreads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
 // GetOptimizeBranchLengths returns true if branch-length
 // optimization is enabled.
 func (m *BaseModel) GetOptimizeBranchLengths() bool {
@@ -181,6 +270,7 @@ func (m *BaseModel) GetOptimizeBranchLengths() bool {
 func (m *BaseModel) SetOptimizeBranchLengths() {
 	m.optBranch = true
 	m.setupParameters()
+	m.setupCache()
 }
 
 // SetMaxBranchLength changes the maximum branch length for
@@ -240,9 +330,113 @@ func (m *BaseModel) addBranchParameters(fpg optimize.FloatParameterGenerator) {
 	}
 }
 
+// addNucParameters adds the nucleotide-level substitution
+// parameters: kappa or, if GTR is used, five free exchangeabilities
+// (A<->G exchangeability is fixed to one); and the rates of double
+// and triple nucleotide changes (delta and psi) and the nucleotide
+// frequencies if enabled. Neither kappa nor GTR exchangeabilities
+// are used with the empirical codon model. onChange is called if
+// any of the parameters changes.
+func (m *BaseModel) addNucParameters(fpg optimize.FloatParameterGenerator, kappa *float64, onChange func()) {
+	switch {
+	case m.data.ecm != nil:
+		// exchangeabilities are fixed
+	case m.gtr == nil:
+		kappa := fpg(kappa, "kappa")
+		kappa.SetOnChange(onChange)
+		kappa.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
+		kappa.SetProposalFunc(optimize.NormalProposal(0.01))
+		kappa.SetMin(1e-2)
+		kappa.SetMax(100)
+		m.parameters.Append(kappa)
+	default:
+		for _, name := range []string{"rAC", "rAT", "rCG", "rCT", "rGT"} {
+			r := fpg(&m.gtr[codon.NucPairIndex(name[1], name[2])], name)
+			r.SetOnChange(onChange)
+			r.SetPriorFunc(optimize.UniformPrior(0, 20, false, true))
+			r.SetProposalFunc(optimize.NormalProposal(0.01))
+			r.SetMin(1e-2)
+			r.SetMax(100)
+			m.parameters.Append(r)
+		}
+	}
+
+	if m.data.mnm {
+		delta := fpg(&m.delta, "delta")
+		delta.SetOnChange(onChange)
+		delta.SetPriorFunc(optimize.ExponentialPrior(1, true))
+		delta.SetProposalFunc(optimize.NormalProposal(0.01))
+		delta.SetMin(0)
+		delta.SetMax(100)
+		m.parameters.Append(delta)
+
+		psi := fpg(&m.psi, "psi")
+		psi.SetOnChange(onChange)
+		psi.SetPriorFunc(optimize.ExponentialPrior(1, true))
+		psi.SetProposalFunc(optimize.NormalProposal(0.01))
+		psi.SetMin(0)
+		psi.SetMax(100)
+		m.parameters.Append(psi)
+	}
+
+	if m.freqProp != nil {
+		m.addFrequencyParameters(fpg, onChange)
+	}
+}
+
+// setTransitionMatrix creates a transition matrix given the vector
+// of rates (nil for the equal rates) using the nucleotide-level
+// parameters (or the empirical codon model exchangeabilities) and
+// the codon frequencies of the model, and sets it to e.
+func (m *BaseModel) setTransitionMatrix(e *codon.EMatrix, kappa, omega float64, rates []float64) {
+	var Q *mat64.Dense
+	var s float64
+	if m.data.ecm != nil {
+		Q, s = codon.CreateECMTransitionMatrix(m.cFreq, m.data.ecm, omega, rates, e.Q)
+	} else {
+		Q, s = codon.CreateRateTransitionMatrix(m.cFreq, kappa, omega, rates, m.gtr, m.delta, m.psi, e.Q)
+	}
+	e.CF = m.cFreq
+	e.Set(Q, s)
+}
+
 // SetAggregationMode changes the aggregation mode.
 func (m *BaseModel) SetAggregationMode(mode AggMode) {
 	m.aggMode = mode
+	m.setupPatterns()
+}
+
+// setupPatterns compresses the alignment into site patterns. For the
+// random aggregation every position is a separate pattern, since the
+// aggregated states depend on the position.
+func (m *BaseModel) setupPatterns() {
+	if m.aggMode == AggRandom {
+		nPos := m.data.cSeqs.Length()
+		m.patterns = make([]int, nPos)
+		m.patternPos = make([]int, nPos)
+		for pos := range m.patterns {
+			m.patterns[pos] = pos
+			m.patternPos[pos] = pos
+		}
+	} else {
+		m.patternPos, m.patterns = m.data.cSeqs.Patterns()
+	}
+	m.patternWeight = make([]float64, len(m.patternPos))
+	for _, k := range m.patterns {
+		m.patternWeight[k]++
+	}
+	m.l = make([]float64, len(m.patternPos))
+	m.prunPos = make([]bool, len(m.patternPos))
+	m.prunAllPos = false
+	m.setupCache()
+}
+
+// expandPatterns copies the values computed for the first position of
+// every pattern to the other positions with the same pattern.
+func (m *BaseModel) expandPatterns(v []float64) {
+	for pos, k := range m.patterns {
+		v[pos] = v[m.patternPos[k]]
+	}
 }
 
 // ReorderAlignment reorders codon alignment so order of nodes and
@@ -292,6 +486,7 @@ func (m *BaseModel) ExpBranch(br int) {
 		}
 	}
 	m.expBr[br] = true
+	m.invalidateBranch(br)
 	m.prunAllPos = false
 }
 
@@ -315,7 +510,7 @@ func (m *BaseModel) ExpBranches() {
 	tasks := make(chan expTask, nTasks)
 	var wg sync.WaitGroup
 
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < m.workers(); i++ {
 		wg.Add(1)
 		go func() {
 			tmp := make([]float64, m.data.cFreq.GCode.NCodon*m.data.cFreq.GCode.NCodon)
@@ -355,6 +550,9 @@ func (m *BaseModel) ExpBranches() {
 	close(tasks)
 	wg.Wait()
 	m.expAllBr = true
+	if m.cache != nil {
+		m.cache.invalidateAll()
+	}
 }
 
 // expBranchesIfNeeded performes matrix exponentiation only if it is
@@ -382,23 +580,25 @@ func (m *BaseModel) GetTreeString() string {
 	return m.data.Tree.ClassString()
 }
 
-// singlePosLikelihood computes likelihood for tasks send trhough channel
-// and puts results into slice m.l.
+// singlePosLikelihood computes likelihood for tasks (patterns) send
+// trhough channel and puts results into slice m.l.
 func (m *BaseModel) singlePosLikelihood(tasks chan int, done chan struct{}) {
 	nni := m.data.Tree.MaxNodeID() + 1
 	plh := make([][]float64, nni)
 	for i := 0; i < nni; i++ {
 		plh[i] = make([]float64, m.data.cFreq.GCode.NCodon+1)
 	}
-	for pos := range tasks {
-		if pos < 0 {
+	for k := range tasks {
+		if k < 0 {
 			break
 		}
-		if m.prunAllPos && m.prunPos[pos] {
+		if m.prunAllPos && m.prunPos[k] {
 			continue
 		}
-		res := 0.0
+		pos := m.patternPos[k]
+		res, resScale := 0.0, 0.0
 		for class, p := range m.prop[pos] {
+			var l, scale float64
 			switch {
 			case p <= smallProp:
 				// if proportion is to small
@@ -406,32 +606,33 @@ func (m *BaseModel) singlePosLikelihood(tasks chan int, done chan struct{}) {
 			case len(m.lettersF[pos]) == 1:
 				// no letters in the current position
 				// probability = 1, res += 0
-				res += 1 * p
+				l = 1
 			case m.aggMode == AggFixed && len(m.lettersF[pos]) == 2:
-				res += m.fixedSubL(class, pos, plh) * p
+				l, scale = m.fixedSubL(class, pos, plh)
 			case m.aggMode == AggObserved:
-				res += m.observedSubL(class, pos, plh, m.lettersF[pos], m.lettersA[pos]) * p
+				l, scale = m.observedSubL(class, pos, plh, m.lettersF[pos], m.lettersA[pos])
 			case m.aggMode == AggRandom:
 				spos := m.rshuffle[pos]
-				res += m.observedSubL(class, pos, plh, m.lettersF[spos], m.lettersA[spos]) * p
+				l, scale = m.observedSubL(class, pos, plh, m.lettersF[spos], m.lettersA[spos])
 			case m.aggMode == AggObservedNew:
 				schema := m.schemas[pos]
 				if schema == nil {
 					schema = m.observedStates(m.lettersF[pos], m.lettersA[pos])
 					m.schemas[pos] = schema
 				}
-				res += m.aggSubL(class, pos, plh, schema) * p
+				l, scale = m.aggSubL(class, pos, plh, schema)
 			default:
-				res += m.fullSubL(class, pos, plh) * p
+				l, scale = m.fullSubL(class, pos, plh)
 			}
+			res, resScale = addScaled(res, resScale, l*p, scale)
 		}
-		m.l[pos] = math.Log(math.Max(res, math.SmallestNonzeroFloat64))
-		m.prunPos[pos] = true
+		m.l[k] = logScaled(res, resScale)
+		m.prunPos[k] = true
 	}
 	done <- struct{}{}
 }
 
-// fatPosLikelihood reads several positions from tasks and computes
+// fatPosLikelihood reads several patterns from tasks and computes
 // likelihood for them using fatSubL.
 func (m *BaseModel) fatPosLikelihood(tasks chan int, done chan struct{}) {
 	nni := m.data.Tree.MaxNodeID() + 1
@@ -440,24 +641,35 @@ func (m *BaseModel) fatPosLikelihood(tasks chan int, done chan struct{}) {
 		plh[i] = make([]float64, m.data.cFreq.GCode.NCodon*m.fatness)
 	}
 	positions := make([]int, 0, m.fatness)
-
-	for pos := range tasks {
-		if pos >= 0 {
-			if m.prunAllPos && m.prunPos[pos] {
+	ks := make([]int, 0, m.fatness)
+	// class likelihoods and the total likelihoods with the log
+	// scale factors
+	l := make([]float64, m.fatness)
+	scale := make([]float64, m.fatness)
+	res := make([]float64, m.fatness)
+	resScale := make([]float64, m.fatness)
+
+	for k := range tasks {
+		if k >= 0 {
+			if m.prunAllPos && m.prunPos[k] {
 				continue
 			}
-			positions = append(positions, pos)
+			ks = append(ks, k)
+			positions = append(positions, m.patternPos[k])
 			if len(positions) < m.fatness {
 				continue
 			}
 		}
 
 		if len(positions) == 0 {
-			// we can only get here if pos < 0
+			// we can only get here if k < 0
 			break
 		}
 
-		res := make([]float64, len(positions))
+		for i := range positions {
+			res[i] = 0
+			resScale[i] = 0
+		}
 		// here we assume that all proportions
 		// are identical; if it's not the case,
 		// special care should be taken in
@@ -468,16 +680,20 @@ func (m *BaseModel) fatPosLikelihood(tasks chan int, done chan struct{}) {
 				// if proportion is to small
 				continue
 			}
-			m.fatSubL(class, positions, plh, res, p)
+			m.fatSubL(class, positions, plh, l[:len(positions)], scale[:len(positions)])
+			for i := range positions {
+				res[i], resScale[i] = addScaled(res[i], resScale[i], l[i]*p, scale[i])
+			}
 		}
-		for i := range res {
-			m.l[positions[i]] = math.Log(math.Max(res[i], math.SmallestNonzeroFloat64))
-			m.prunPos[positions[i]] = true
+		for i, k := range ks {
+			m.l[k] = logScaled(res[i], resScale[i])
+			m.prunPos[k] = true
 		}
 
 		positions = positions[:0]
+		ks = ks[:0]
 
-		if pos < 0 {
+		if k < 0 {
 			break
 		}
 
@@ -495,21 +711,29 @@ func (m *BaseModel) Likelihood() (lnL float64) {
 		panic("incorrect proportion length")
 	}
 
-	nPos := m.data.cSeqs.Length()
-	nWorkers := runtime.GOMAXPROCS(0)
+	nPatterns := len(m.patternPos)
+	// with the cache tasks are blocks of patterns
+	nTasks := nPatterns
+	if m.cache != nil {
+		nTasks = (nPatterns + m.fatness - 1) / m.fatness
+	}
+	nWorkers := m.workers()
 	done := make(chan struct{}, nWorkers)
-	tasks := make(chan int, nPos)
+	tasks := make(chan int, nTasks)
 
 	for i := 0; i < nWorkers; i++ {
-		if m.fatness > 1 && m.aggMode == AggNone {
+		switch {
+		case m.cache != nil:
+			go m.cachedPosLikelihood(tasks, done)
+		case m.fatness > 1 && m.aggMode == AggNone:
 			go m.fatPosLikelihood(tasks, done)
-		} else {
+		default:
 			go m.singlePosLikelihood(tasks, done)
 		}
 	}
 
-	for pos := 0; pos < nPos; pos++ {
-		tasks <- pos
+	for k := 0; k < nTasks; k++ {
+		tasks <- k
 	}
 	for i := 0; i < nWorkers; i++ {
 		tasks <- -1
@@ -521,8 +745,12 @@ func (m *BaseModel) Likelihood() (lnL float64) {
 		<-done
 	}
 
-	for i := 0; i < nPos; i++ {
-		lnL += m.l[i]
+	if m.cache != nil {
+		m.cache.clean(m.prop[0])
+	}
+
+	for k := 0; k < nPatterns; k++ {
+		lnL += m.patternWeight[k] * m.l[k]
 	}
 	m.prunAllPos = true
 	if math.IsNaN(lnL) {
@@ -539,17 +767,21 @@ func (m *BaseModel) Likelihood() (lnL float64) {
 
 // classLikelihood returns an array (slice) of likelihoods for every
 // site class, this can be used to perform NEB/BEB (Naive/Bayes
-// empirical Bayes) analysis.
+// empirical Bayes) analysis. Likelihoods of every position are
+// multiplied by the same factor to avoid underflow, so only the
+// ratios between the classes are meaningful.
 func (m *BaseModel) classLikelihoods() (res [][]float64) {
 	res = make([][]float64, m.model.GetNClass())
+	scales := make([][]float64, len(res))
 	nPos := m.data.cSeqs.Length()
 	for i := range res {
 		res[i] = make([]float64, nPos)
+		scales[i] = make([]float64, nPos)
 	}
 
 	m.expBranchesIfNeeded()
 
-	nWorkers := runtime.GOMAXPROCS(0)
+	nWorkers := m.workers()
 	done := make(chan struct{}, nWorkers)
 	tasks := make(chan int, nPos)
 
@@ -572,7 +804,9 @@ func (m *BaseModel) classLikelihoods() (res [][]float64) {
 						// probability = 1
 						res[class][pos] = 1 * p
 					default:
-						res[class][pos] = m.fullSubL(class, pos, plh) * p
+						l, scale := m.fullSubL(class, pos, plh)
+						res[class][pos] = l * p
+						scales[class][pos] = scale
 					}
 				}
 			}
@@ -580,7 +814,7 @@ func (m *BaseModel) classLikelihoods() (res [][]float64) {
 		}()
 	}
 
-	for pos := 0; pos < nPos; pos++ {
+	for _, pos := range m.patternPos {
 		tasks <- pos
 	}
 	close(tasks)
@@ -590,6 +824,12 @@ func (m *BaseModel) classLikelihoods() (res [][]float64) {
 		<-done
 	}
 
+	for class := range res {
+		m.expandPatterns(res[class])
+		m.expandPatterns(scales[class])
+	}
+	commonScale(res, scales)
+
 	return
 }
 
@@ -645,16 +885,20 @@ func (m *BaseModel) PrintPosterior(posterior []float64) {
 	}
 }
 
-// fatSubL computes likelihood for set of positions. It uses larger plh vector.
-// res should be zeroed before the call. p is the proportion of site class.
-func (m *BaseModel) fatSubL(class int, positions []int, plh [][]float64, res []float64, p float64) {
+// fatSubL computes likelihood for set of positions. It uses larger
+// plh vector. Likelihoods are stored to res and the log scale factors
+// to scale.
+func (m *BaseModel) fatSubL(class int, positions []int, plh [][]float64, res, scale []float64) {
 	NCodon := m.data.cFreq.GCode.NCodon
 
 	nPos := len(positions)
 
-	if len(positions) != len(res) {
+	if len(positions) != len(res) || len(positions) != len(scale) {
 		panic("length of positions doesn't match length of results")
 	}
+	for i := range scale {
+		scale[i] = 0
+	}
 
 	for i, pos := range positions {
 		for node := range m.data.Tree.Terminals() {
@@ -687,17 +931,19 @@ func (m *BaseModel) fatSubL(class int, positions []int, plh [][]float64, res []f
 				plh[node.ID][i] *= v
 			}
 		}
+		scalePartialFat(plh[node.ID][:NCodon*nPos], nPos, scale)
 
 		if node.IsRoot() {
-			impl.Dgemv(blas.Trans, NCodon, nPos, p, plh[node.ID], nPos, m.data.cFreq.Freq, 1, 1, res, 1)
+			impl.Dgemv(blas.Trans, NCodon, nPos, 1, plh[node.ID], nPos, m.cFreq.Freq, 1, 0, res, 1)
 			break
 		}
 
 	}
 }
 
-// fullSubL calculates likelihood for given site class and position.
-func (m *BaseModel) fullSubL(class, pos int, plh [][]float64) (res float64) {
+// fullSubL calculates likelihood for given site class and position,
+// the likelihood is res*exp(scale).
+func (m *BaseModel) fullSubL(class, pos int, plh [][]float64) (res, scale float64) {
 	NCodon := m.data.cFreq.GCode.NCodon
 
 	for i := 0; i < m.data.Tree.MaxNodeID()+1; i++ {
@@ -727,9 +973,10 @@ func (m *BaseModel) fullSubL(class, pos int, plh [][]float64) (res float64) {
 				plh[node.ID][l1] *= mul[l1]
 			}
 		}
+		scale += scalePartial(plh[node.ID][:NCodon])
 
 		if node.IsRoot() {
-			res = impl.Ddot(NCodon, m.data.cFreq.Freq, 1, plh[node.ID], 1)
+			res = impl.Ddot(NCodon, m.cFreq.Freq, 1, plh[node.ID], 1)
 			break
 		}
 
@@ -0,0 +1,61 @@
+package cmodel
+
+import (
+	"math"
+	"testing"
+)
+
+// noPatterns disables site pattern compression.
+func noPatterns(m *BaseModel) {
+	nPos := m.data.cSeqs.Length()
+	m.patterns = make([]int, nPos)
+	m.patternPos = make([]int, nPos)
+	m.patternWeight = make([]float64, nPos)
+	for pos := range m.patterns {
+		m.patterns[pos] = pos
+		m.patternPos[pos] = pos
+		m.patternWeight[pos] = 1
+	}
+	m.l = make([]float64, nPos)
+	m.prunPos = make([]bool, nPos)
+	m.prunAllPos = false
+}
+
+func TestPatternsD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	m := NewBranchSite(data, false)
+	if len(m.patternPos) >= data.cSeqs.Length() {
+		tst.Error("Expected less patterns than positions, got", len(m.patternPos))
+	}
+
+	for _, mode := range []AggMode{AggNone, AggObserved, AggFixed, AggObservedNew} {
+		m := NewBranchSite(data, false)
+		m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+		m.SetAggregationMode(mode)
+		L := m.Likelihood()
+
+		u := NewBranchSite(data, false)
+		u.SetParameters(2, 0.5, 2, 0.6, 0.2)
+		u.SetAggregationMode(mode)
+		noPatterns(u.BaseModel)
+		LU := u.Likelihood()
+
+		if math.Abs(L-LU) > 1e-6 {
+			tst.Error("mode=", mode, "expected ", LU, ", got", L)
+		}
+	}
+
+	m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+	classes := []float64{0, 0, 1, 1}
+	neb := m.NEBPosterior(classes)
+	noPatterns(m.BaseModel)
+	for i, p := range m.NEBPosterior(classes) {
+		if math.Abs(p-neb[i]) > 1e-8 {
+			tst.Error("pos=", i, "expected NEB", p, ", got", neb[i])
+		}
+	}
+}
@@ -115,3 +115,137 @@ func TestBranchSiteBebD3(tst *testing.T) {
 	}
 	comparePosterior(beb, referenceBeb, tst)
 }
+
+// checkProbabilities checks that all the values are probabilities.
+func checkProbabilities(posterior []float64, nPos int, tst *testing.T) {
+	if len(posterior) != nPos {
+		tst.Fatal("Expected", nPos, "posterior values, got", len(posterior))
+	}
+	for i, p := range posterior {
+		if math.IsNaN(p) || p < 0 || p > 1+1e-10 {
+			tst.Error("Expected probability at position", i+1, ", got", p)
+		}
+	}
+}
+
+func TestTernaryPoint(tst *testing.T) {
+	// values of GetIndexTernary from PAML
+	for _, t := range []struct {
+		i, j   int
+		p0, p1 float64
+	}{
+		{0, 0, 1. / 30, 28. / 30},
+		{1, 1, 2. / 30, 26. / 30},
+		{3, 5, 8. / 30, 20. / 30},
+		{9, 17, 26. / 30, 2. / 30},
+		{9, 18, 28. / 30, 1. / 30},
+	} {
+		p0, p1 := ternaryPoint(t.i, t.j, bebGridSize)
+		if math.Abs(p0-t.p0) > 1e-10 || math.Abs(p1-t.p1) > 1e-10 {
+			tst.Error("Triangle", t.i, t.j, ": expected", t.p0, t.p1, ", got", p0, p1)
+		}
+	}
+
+	// centers of the triangles with equal area average to the
+	// center of the simplex
+	s0, s1 := 0.0, 0.0
+	for i := 0; i < bebGridSize; i++ {
+		for j := 0; j <= 2*i; j++ {
+			p0, p1 := ternaryPoint(i, j, bebGridSize)
+			s0 += p0
+			s1 += p1
+		}
+	}
+	n := float64(bebGridSize * bebGridSize)
+	if math.Abs(s0/n-1./3) > 1e-10 || math.Abs(s1/n-1./3) > 1e-10 {
+		tst.Error("Expected average proportions of 1/3, got", s0/n, s1/n)
+	}
+}
+
+func TestM2aBebD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	m := NewM2(data, true, 1, 1)
+	m.SetParameters(0.6, 0.5, 0.05, 3, 2, 1, 1)
+
+	// BEB with a single grid point at the parameter values is NEB
+	m.expBranchesIfNeeded()
+	l0, s0 := m.omegaClassLikelihoods(0)
+	l1, s1 := m.omegaClassLikelihoods(1)
+	l2, s2 := m.omegaClassLikelihoods(2)
+	commonScale([][]float64{l0, l1, l2}, [][]float64{s0, s1, s2})
+	p0, p1 := m.p0, (1-m.p0)*m.p1prop
+	posterior := bebPosterior(1, data.cSeqs.Length(), func(point, pos int) (l, lSel float64) {
+		lSel = (1 - p0 - p1) * l2[pos]
+		return p0*l0[pos] + p1*l1[pos] + lSel, lSel
+	})
+
+	m.Final(true, true, false, false, false)
+	neb := m.summary.SitePosteriorNEB
+	for i := range neb {
+		if math.Abs(neb[i]-posterior[i]) > 1e-8 {
+			tst.Error("Expected ", neb[i], ", got", posterior[i])
+		}
+	}
+	beb := m.summary.SitePosteriorBEB
+	checkProbabilities(beb, data.cSeqs.Length(), tst)
+	referenceBeb := map[int]float64{
+		// this comes from cmodel/misc/lnlref (m2beb)
+		1:   0.000019,
+		2:   0.001036,
+		70:  0.434977,
+		74:  0.313748,
+		87:  0.370402,
+		96:  0.477779,
+		116: 0.269205,
+		162: 0.299714,
+		186: 0.379175,
+		195: 0.273312,
+	}
+	comparePosterior(beb, referenceBeb, tst)
+}
+
+func TestM8BebD1(tst *testing.T) {
+	if testing.Short() {
+		tst.Skip("skipping test in short mode.")
+	}
+
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Error("Error: ", err)
+	}
+	m := NewM8(data, true, false, 4, 1, 1, false)
+	m.SetParameters(0.8, 0.5, 1, 2, 5, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0)
+	L := m.Likelihood()
+
+	m.Final(false, true, false, false, false)
+	beb := m.summary.SitePosteriorBEB
+	checkProbabilities(beb, data.cSeqs.Length(), tst)
+	referenceBeb := map[int]float64{
+		// this comes from cmodel/misc/lnlref (m8beb)
+		1:   0.000201,
+		2:   0.004207,
+		23:  0.228645,
+		55:  0.360060,
+		70:  0.786408,
+		74:  0.529698,
+		85:  0.310449,
+		87:  0.632061,
+		96:  0.717711,
+		116: 0.459016,
+		151: 0.227992,
+		154: 0.311298,
+		162: 0.510578,
+		186: 0.610348,
+		191: 0.251595,
+		195: 0.484417,
+	}
+	comparePosterior(beb, referenceBeb, tst)
+
+	// parameters should be restored after BEB
+	if math.Abs(m.Likelihood()-L) > smallDiff {
+		tst.Error("Expected likelihood ", L, " after BEB, got", m.Likelihood())
+	}
+}
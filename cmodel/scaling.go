@@ -0,0 +1,117 @@
+package cmodel
+
+import (
+	"math"
+)
+
+// scaleThreshold is the threshold for partial likelihood
+// rescaling. If the maximum partial likelihood of a node is smaller
+// than this value, partial likelihoods are divided by the maximum and
+// the logarithm of the maximum is added to the scale factor. This
+// prevents underflow for large trees.
+var scaleThreshold = 1e-20
+
+// Likelihood values which can underflow are represented by a pair of
+// a value and a log scale factor, i.e. l = v*exp(scale).
+
+// scalePartial rescales partial likelihoods of the states if the
+// maximum is below the threshold and returns the log scale factor
+// (zero if no scaling was performed).
+func scalePartial(plh []float64) float64 {
+	max := 0.0
+	for _, v := range plh {
+		max = math.Max(max, v)
+	}
+	if max >= scaleThreshold || max == 0 {
+		return 0
+	}
+	for i := range plh {
+		plh[i] /= max
+	}
+	return math.Log(max)
+}
+
+// scalePartialStates is similar to scalePartial but only rescales the
+// listed states.
+func scalePartialStates(plh []float64, states []int) float64 {
+	max := 0.0
+	for _, l := range states {
+		max = math.Max(max, plh[l])
+	}
+	if max >= scaleThreshold || max == 0 {
+		return 0
+	}
+	for _, l := range states {
+		plh[l] /= max
+	}
+	return math.Log(max)
+}
+
+// scalePartialFat rescales partial likelihoods for several positions
+// stored in the fatSubL layout (state*nPos+position), log scale
+// factors are added to scale.
+func scalePartialFat(plh []float64, nPos int, scale []float64) {
+	for i := 0; i < nPos; i++ {
+		max := 0.0
+		for j := i; j < len(plh); j += nPos {
+			max = math.Max(max, plh[j])
+		}
+		if max >= scaleThreshold || max == 0 {
+			continue
+		}
+		for j := i; j < len(plh); j += nPos {
+			plh[j] /= max
+		}
+		scale[i] += math.Log(max)
+	}
+}
+
+// addScaled returns the sum of two scaled values a*exp(aScale) and
+// b*exp(bScale) using the larger scale factor.
+func addScaled(a, aScale, b, bScale float64) (float64, float64) {
+	switch {
+	case b == 0:
+		return a, aScale
+	case a == 0:
+		return b, bScale
+	case aScale >= bScale:
+		return a + b*math.Exp(bScale-aScale), aScale
+	}
+	return b + a*math.Exp(aScale-bScale), bScale
+}
+
+// logScaled returns the logarithm of a scaled value.
+func logScaled(v, scale float64) float64 {
+	return math.Log(math.Max(v, math.SmallestNonzeroFloat64)) + scale
+}
+
+// commonScale rescales scaled likelihoods of every position to the
+// same (maximal) scale factor. This is required if likelihoods of
+// a position are compared or combined. ls are the values and scales
+// are the corresponding log scale factors, both are updated; the
+// same slices can appear several times.
+func commonScale(ls, scales [][]float64) {
+	if len(ls) == 0 {
+		return
+	}
+	max := make([]float64, len(ls[0]))
+	for pos := range max {
+		max[pos] = math.Inf(-1)
+	}
+	for i, l := range ls {
+		for pos, s := range scales[i] {
+			if l[pos] != 0 {
+				max[pos] = math.Max(max[pos], s)
+			}
+		}
+	}
+	for i, l := range ls {
+		for pos, s := range scales[i] {
+			if math.IsInf(max[pos], -1) || s == max[pos] {
+				continue
+			}
+			l[pos] *= math.Exp(s - max[pos])
+			scales[i][pos] = max[pos]
+		}
+	}
+}
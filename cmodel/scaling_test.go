@@ -0,0 +1,168 @@
+package cmodel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// alwaysScale computes f with rescaling at every node.
+func alwaysScale(f func()) {
+	defer func(saved float64) {
+		scaleThreshold = saved
+	}(scaleThreshold)
+	// partial likelihoods never exceed one
+	scaleThreshold = 2
+	f()
+}
+
+func TestScalingD1(tst *testing.T) {
+	data, err := GetTreeAlignment(data1, "F3X4")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	for _, mode := range []AggMode{AggNone, AggObserved, AggFixed, AggObservedNew} {
+		newModel := func() *BranchSite {
+			m := NewBranchSite(data, false)
+			m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+			m.SetAggregationMode(mode)
+			return m
+		}
+		L := newModel().Likelihood()
+		var LScaled float64
+		alwaysScale(func() {
+			LScaled = newModel().Likelihood()
+		})
+		if math.Abs(L-LScaled) > 1e-6 {
+			tst.Error("mode=", mode, "expected ", L, ", got", LScaled)
+		}
+	}
+
+	m := NewBranchSite(data, false)
+	m.SetParameters(2, 0.5, 2, 0.6, 0.2)
+	classes := []float64{0, 0, 1, 1}
+	neb := m.NEBPosterior(classes)
+	nodes := m.Ancestral()
+	alwaysScale(func() {
+		for i, p := range m.NEBPosterior(classes) {
+			if math.Abs(p-neb[i]) > 1e-8 {
+				tst.Error("pos=", i, "expected NEB", neb[i], ", got", p)
+			}
+		}
+		for i, node := range m.Ancestral() {
+			if node.Joint != nodes[i].Joint || node.Marginal != nodes[i].Marginal {
+				tst.Error("node=", node.NodeID, "ancestral sequences differ with scaling")
+			}
+			for pos, p := range node.MarginalProb {
+				if math.Abs(p-nodes[i].MarginalProb[pos]) > 1e-8 {
+					tst.Error("node=", node.NodeID, "pos=", pos, "expected ", nodes[i].MarginalProb[pos], ", got", p)
+				}
+			}
+		}
+	})
+}
+
+// largeTreeData returns data simulated with M0 on a caterpillar
+// tree with 300 leaves and long branches.
+func largeTreeData(tst *testing.T) *Data {
+	// caterpillar tree with long branches, the likelihood of a
+	// position is much smaller than the smallest float64
+	nLeaves := 300
+	var b bytes.Buffer
+	for i := 1; i < nLeaves; i++ {
+		fmt.Fprintf(&b, "(t%d:1,", i)
+	}
+	fmt.Fprintf(&b, "t%d:1", nLeaves)
+	b.WriteString(strings.Repeat("):1", nLeaves-2))
+	b.WriteString(");\n")
+
+	dir, err := ioutil.TempDir("", "godon")
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	defer os.RemoveAll(dir)
+	treeFn := path.Join(dir, "tree.nwk")
+	if err := ioutil.WriteFile(treeFn, []byte(b.String()), 0644); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	data, err := NewTreeData(1, treeFn)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if err := data.Unroot(); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	m := NewM0(data)
+	m.SetParameters(2, 0.5)
+	seqs, _ := m.Simulate(20)
+	rdata, err := data.Replicate(seqs)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	return rdata
+}
+
+func TestScalingLargeTree(tst *testing.T) {
+	if testing.Short() {
+		tst.Skip("skipping test in short mode.")
+	}
+
+	rdata := largeTreeData(tst)
+	r := NewM0(rdata)
+	r.SetParameters(2, 0.5)
+	L := r.Likelihood()
+	// without scaling the site likelihoods are clamped to the
+	// smallest float64
+	if math.IsInf(L, 0) || math.IsNaN(L) || L >= float64(rdata.Length())*math.Log(math.SmallestNonzeroFloat64) {
+		tst.Error("Expected likelihood below float64 range, got", L)
+	}
+
+	r.SetAggregationMode(AggObservedNew)
+	LAgg := r.Likelihood()
+	if math.IsInf(LAgg, 0) || math.IsNaN(LAgg) {
+		tst.Error("Invalid aggregated likelihood", LAgg)
+	}
+}
+
+func TestScalingLargeTreeAncestral(tst *testing.T) {
+	if testing.Short() {
+		tst.Skip("skipping test in short mode.")
+	}
+
+	data := largeTreeData(tst)
+	m := NewM0(data)
+	m.SetParameters(2, 0.5)
+
+	// without scaling the posteriors are NaN and the joint
+	// reconstruction consists of the first codon only
+	first := data.cFreq.GCode.NumCodon[0]
+	for _, node := range m.Ancestral() {
+		for pos, p := range node.MarginalProb {
+			if math.IsNaN(p) || p <= 0 || p > 1+1e-8 {
+				tst.Fatal("node=", node.NodeID, "pos=", pos, "wrong probability", p)
+			}
+		}
+		if node.Joint == strings.Repeat(first, data.Length()) {
+			tst.Error("node=", node.NodeID, "joint reconstruction is not informative")
+		}
+	}
+
+	res, err := m.StochasticMapping(2)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	total := 0.0
+	for _, br := range res.Branches {
+		total += br.Synonymous + br.Nonsynonymous
+	}
+	if total == 0 || math.IsNaN(total) {
+		tst.Error("Wrong total number of substitutions:", total)
+	}
+}
@@ -0,0 +1,61 @@
+package cmodel
+
+import (
+	"bytes"
+	"math/rand"
+
+	"bitbucket.org/Davydov/godon/bio"
+)
+
+// Simulate evolves nPos codons down the tree using the model
+// parameters. For every position the site class is sampled
+// according to the class proportions, the root codon is sampled from
+// the codon frequencies. It returns the sequences of the leaves and
+// the site class of every codon.
+func (m *BaseModel) Simulate(nPos int) (seqs bio.Sequences, classes []int) {
+	NCodon := m.data.cFreq.GCode.NCodon
+	nodes := m.data.Tree.NodeOrder()
+	m.expBranchesIfNeeded()
+	rng := rand.New(rand.NewSource(rand.Int63()))
+
+	states := make([][]byte, m.data.Tree.MaxNodeID()+1)
+	for i := range states {
+		states[i] = make([]byte, nPos)
+	}
+	classes = make([]int, nPos)
+
+	// the weights are probabilities, so sampling cannot fail
+	sample := func(w []float64) int {
+		i, err := sampleIndex(rng, w)
+		if err != nil {
+			panic(err)
+		}
+		return i
+	}
+
+	for pos := 0; pos < nPos; pos++ {
+		// proportions are the same for all the positions
+		class := sample(m.prop[0])
+		classes[pos] = class
+		for i := len(nodes) - 1; i >= 0; i-- {
+			node := nodes[i]
+			if node.IsRoot() {
+				states[node.ID][pos] = byte(sample(m.cFreq.Freq))
+			}
+			parent := int(states[node.ID][pos])
+			for _, child := range node.ChildNodes() {
+				p := m.eQts[class][child.ID][parent*NCodon : (parent+1)*NCodon]
+				states[child.ID][pos] = byte(sample(p))
+			}
+		}
+	}
+
+	for node := range m.data.Tree.Terminals() {
+		var b bytes.Buffer
+		for _, c := range states[node.ID] {
+			b.WriteString(m.data.cFreq.GCode.NumCodon[c])
+		}
+		seqs = append(seqs, bio.Sequence{Name: node.Name, Sequence: b.String()})
+	}
+	return
+}
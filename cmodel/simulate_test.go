@@ -0,0 +1,98 @@
+package cmodel
+
+import (
+	"math"
+	"path"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/codon"
+)
+
+func TestSimulateM2(tst *testing.T) {
+	data, err := NewTreeData(1, path.Join("testdata", data1+".nwk"))
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if err := data.Unroot(); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	m := NewM2(data, true, 1, 1)
+	m.SetParameters(0.6, 0.5, 0.05, 3, 2, 1, 1)
+
+	nPos := 5000
+	seqs, classes := m.Simulate(nPos)
+	if len(seqs) != data.Tree.NLeaves() {
+		tst.Error("Wrong number of sequences:", len(seqs))
+	}
+	for _, seq := range seqs {
+		if len(seq.Sequence) != nPos*3 {
+			tst.Error("Wrong sequence length:", len(seq.Sequence))
+		}
+	}
+
+	counts := make([]float64, m.GetNClass())
+	for _, class := range classes {
+		counts[class]++
+	}
+	for class, p := range m.prop[0] {
+		got := counts[class] / float64(nPos)
+		if math.Abs(got-p) > 0.03 {
+			tst.Error("class=", class, "expected proportion ", p, ", got", got)
+		}
+	}
+}
+
+func TestSimulateTreeDataMG(tst *testing.T) {
+	data, err := NewTreeData(1, path.Join("testdata", data1+".nwk"))
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	// MG94 does not require an alignment
+	if err := data.SetCodonModel("MG"); err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if data.cFreq.Model != codon.MG94 {
+		tst.Error("Wrong codon model:", data.cFreq.Model)
+	}
+	m0 := NewM0(data)
+	m0.SetParameters(2, 0.5)
+	if seqs, _ := m0.Simulate(10); len(seqs) != data.Tree.NLeaves() {
+		tst.Error("Wrong number of sequences:", len(seqs))
+	}
+}
+
+func TestSimulateReplicate(tst *testing.T) {
+	for _, model := range []string{"GY", "MG"} {
+		data, err := GetTreeAlignment(data1, "F3X4")
+		if err != nil {
+			tst.Fatal("Error: ", err)
+		}
+		if err := data.SetCodonModel(model); err != nil {
+			tst.Fatal("Error: ", err)
+		}
+		m0 := NewM0(data)
+		m0.SetParameters(2, 0.5)
+
+		seqs, _ := m0.Simulate(data.Length())
+		rdata, err := data.Replicate(seqs)
+		if err != nil {
+			tst.Fatal("Error: ", err)
+		}
+		if rdata.Length() != data.Length() {
+			tst.Error("Wrong replicate length:", rdata.Length())
+		}
+		if rdata.cFreq.Model != data.cFreq.Model {
+			tst.Error("model=", model, "wrong replicate codon model:", rdata.cFreq.Model)
+		}
+
+		r0 := NewM0(rdata)
+		r0.SetParameters(2, 0.5)
+		L := r0.Likelihood()
+		if math.IsNaN(L) || math.IsInf(L, 0) || L > 0 {
+			tst.Error("Invalid likelihood:", L)
+		}
+		if L == m0.Likelihood() {
+			tst.Error("Replicate likelihood is equal to the original")
+		}
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"path"
+	"sort"
 
 	"github.com/op/go-logging"
+
+	"bitbucket.org/Davydov/godon/tree"
 )
 
 // log is a global logging variable.
@@ -54,3 +57,36 @@ func floatRange(start, step float64, n uint) (res []float64) {
 	}
 	return
 }
+
+// branchClasses groups non-root branches using the key function. It
+// returns a sorted list of keys and a key index for every node ID
+// (index for the root is zero).
+func branchClasses(t *tree.Tree, key func(*tree.Node) int) (keys []int, index []int) {
+	nodes := t.NodeIDArray()
+	index = make([]int, len(nodes))
+
+	present := make(map[int]bool)
+	for _, node := range nodes {
+		if node == nil || node.IsRoot() {
+			continue
+		}
+		present[key(node)] = true
+	}
+	keys = make([]int, 0, len(present))
+	for k := range present {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	pos := make(map[int]int, len(keys))
+	for i, k := range keys {
+		pos[k] = i
+	}
+	for _, node := range nodes {
+		if node == nil || node.IsRoot() {
+			continue
+		}
+		index[node.ID] = pos[key(node)]
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package codon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/gonum/matrix/mat64"
+
+	"bitbucket.org/Davydov/godon/bio"
+)
+
+// ReadExchangeability reads an empirical codon model (ECM)
+// exchangeability matrix from a reader. The file should contain
+// either a lower-triangular matrix (as in PAML, the codon frequencies
+// following the matrix are ignored) or a full symmetric matrix.
+// Codons are ordered alphabetically (TTT, TTC, TTA, ...) and stop
+// codons are skipped.
+func ReadExchangeability(rd io.Reader, gcode *bio.GeneticCode) (*mat64.Dense, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Split(bufio.ScanWords)
+
+	var values []float64
+	for scanner.Scan() {
+		v, err := strconv.ParseFloat(scanner.Text(), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	n := gcode.NCodon
+	nTri := n * (n - 1) / 2
+	s := mat64.NewDense(n, n, nil)
+	switch len(values) {
+	case nTri, nTri + n:
+		k := 0
+		for i := 1; i < n; i++ {
+			for j := 0; j < i; j++ {
+				s.Set(i, j, values[k])
+				s.Set(j, i, values[k])
+				k++
+			}
+		}
+	case n * n:
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if math.Abs(values[i*n+j]-values[j*n+i]) > 1e-8 {
+					return nil, errors.New("exchangeability matrix is not symmetric")
+				}
+				if i != j {
+					s.Set(i, j, values[i*n+j])
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("wrong number of exchangeabilities in file (%d), expected %d or %d", len(values), nTri, n*n)
+	}
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if s.At(i, j) < 0 {
+				return nil, errors.New("negative exchangeability")
+			}
+		}
+	}
+	return s, nil
+}
+
+// CreateECMTransitionMatrix creates a transition matrix for the
+// empirical codon model with omega (ECM+omega). Exchangeabilities s
+// replace the kappa term, the rate is multiplied by the target codon
+// frequency (GY94) or by the product of the target nucleotide
+// frequencies of the changed codon positions (MG94), and
+// nonsynonymous changes are additionally multiplied by omega. If
+// rates is not nil, the rate is multiplied by the average rate of
+// the changed codon positions.
+func CreateECMTransitionMatrix(cf Frequency, s *mat64.Dense, omega float64, rates []float64, m *mat64.Dense) (*mat64.Dense, float64) {
+	if m == nil {
+		m = mat64.NewDense(cf.GCode.NCodon, cf.GCode.NCodon, nil)
+	}
+	for i1 := 0; i1 < cf.GCode.NCodon; i1++ {
+		for i2 := 0; i2 < cf.GCode.NCodon; i2++ {
+			if i1 == i2 {
+				m.Set(i1, i2, 0)
+				continue
+			}
+			c1 := cf.GCode.NumCodon[byte(i1)]
+			c2 := cf.GCode.NumCodon[byte(i2)]
+			rate := s.At(i1, i2)
+			if cf.Model == MG94 {
+				for pos := 0; pos < len(c1); pos++ {
+					if c1[pos] != c2[pos] {
+						rate *= cf.NFreq[pos][rAlphabet[c2[pos]]]
+					}
+				}
+			} else {
+				rate *= cf.Freq[i2]
+			}
+			if rates != nil {
+				r := 0.0
+				n := 0
+				for pos := 0; pos < len(c1); pos++ {
+					if c1[pos] != c2[pos] {
+						r += rates[pos]
+						n++
+					}
+				}
+				rate *= r / float64(n)
+			}
+			if cf.GCode.Map[c1] != cf.GCode.Map[c2] {
+				rate *= omega
+			}
+			m.Set(i1, i2, rate)
+		}
+	}
+	for i1 := 0; i1 < cf.GCode.NCodon; i1++ {
+		rowSum := 0.0
+		for i2 := 0; i2 < cf.GCode.NCodon; i2++ {
+			rowSum += m.At(i1, i2)
+		}
+		m.Set(i1, i1, -rowSum)
+	}
+	scale := 0.0
+	for i := 0; i < cf.GCode.NCodon; i++ {
+		scale += -cf.Freq[i] * m.At(i, i)
+	}
+
+	if scale < smallScale {
+		return mat64.NewDense(cf.GCode.NCodon, cf.GCode.NCodon, nil), 0
+	}
+	return m, scale
+}
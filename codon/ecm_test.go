@@ -0,0 +1,75 @@
+package codon
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/bio"
+)
+
+// singleNucleotideExchangeability returns a lower-triangular
+// exchangeability matrix allowing only single nucleotide changes.
+func singleNucleotideExchangeability(gcode *bio.GeneticCode) string {
+	var buf bytes.Buffer
+	for i := 1; i < gcode.NCodon; i++ {
+		for j := 0; j < i; j++ {
+			dist, _, _ := codonDistance(gcode.NumCodon[byte(i)], gcode.NumCodon[byte(j)])
+			if dist == 1 {
+				buf.WriteString("1 ")
+			} else {
+				buf.WriteString("0 ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+func TestECMTransitionMatrix(tst *testing.T) {
+	cf := F3X4(testSequences(tst))
+	s, err := ReadExchangeability(bytes.NewBufferString(singleNucleotideExchangeability(cf.GCode)), cf.GCode)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	mg, _ := MG94Frequency(cf)
+	for _, cf := range []Frequency{cf, mg} {
+		Q, scale := CreateECMTransitionMatrix(cf, s, 0.3, nil, nil)
+		refQ, refScale := CreateTransitionMatrix(cf, 1, 0.3, nil)
+		if math.Abs(scale-refScale) > 1e-10 {
+			tst.Error("Expected scale", refScale, ", got", scale)
+		}
+		for i := 0; i < cf.GCode.NCodon; i++ {
+			for j := 0; j < cf.GCode.NCodon; j++ {
+				if math.Abs(Q.At(i, j)-refQ.At(i, j)) > 1e-10 {
+					tst.Error("Model", cf.Model, ": expected Q[", i, j, "]=", refQ.At(i, j), ", got", Q.At(i, j))
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestReadExchangeabilityFull(tst *testing.T) {
+	gcode := bio.GeneticCodes[1]
+	var buf bytes.Buffer
+	for i := 0; i < gcode.NCodon; i++ {
+		for j := 0; j < gcode.NCodon; j++ {
+			fmt.Fprint(&buf, i+j, " ")
+		}
+	}
+	s, err := ReadExchangeability(&buf, gcode)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if s.At(2, 3) != 5 || s.At(3, 2) != 5 || s.At(1, 1) != 0 {
+		tst.Error("Wrong exchangeabilities read")
+	}
+
+	_, err = ReadExchangeability(bytes.NewBufferString("1 2 3"), gcode)
+	if err == nil {
+		tst.Error("Expected an error for a wrong number of exchangeabilities")
+	}
+}
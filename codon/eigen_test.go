@@ -1,9 +1,11 @@
 package codon
 
 import (
-	"github.com/gonum/matrix/mat64"
+	"math"
 	"testing"
 
+	"github.com/gonum/matrix/mat64"
+
 	"bitbucket.org/Davydov/godon/bio"
 )
 
@@ -58,3 +60,57 @@ func BenchmarkEigen2(b *testing.B) {
 		}
 	}
 }
+
+func TestRateMatrix(t *testing.T) {
+	gcode := bio.GeneticCodes[1]
+	NCodon := gcode.NCodon
+	cs := []Sequence{
+		{GCode: gcode},
+	}
+
+	cf := F0(cs)
+	q, s := CreateTransitionMatrix(cf, 2.1, 0.25, nil)
+	e := NewEMatrix(cf)
+	e.Set(q, s)
+	if err := e.Eigen(); err != nil {
+		t.Fatal("Error: ", err)
+	}
+	e.ScaleD(2)
+	r := e.RateMatrix()
+	for i := 0; i < NCodon; i++ {
+		for j := 0; j < NCodon; j++ {
+			if math.Abs(r.At(i, j)-2*q.At(i, j)) > 1e-10 {
+				t.Fatalf("Expected %v, got %v (i=%d, j=%d)", 2*q.At(i, j), r.At(i, j), i, j)
+			}
+		}
+	}
+}
+
+func TestDExp(t *testing.T) {
+	gcode := bio.GeneticCodes[1]
+	NCodon := gcode.NCodon
+	cs := []Sequence{
+		{GCode: gcode},
+	}
+
+	cf := F0(cs)
+	q, s := CreateTransitionMatrix(cf, 2.1, 0.25, nil)
+	e := NewEMatrix(cf)
+	e.Set(q, s)
+	if err := e.Eigen(); err != nil {
+		t.Fatal("Error: ", err)
+	}
+	cD := mat64.NewDense(NCodon, NCodon, nil)
+	br, h := 0.3, 1e-6
+	p1, _ := e.Exp(cD, br-h, nil, nil)
+	p2, _ := e.Exp(cD, br+h, nil, nil)
+	dp, err := e.DExp(cD, br, nil, nil)
+	if err != nil {
+		t.Fatal("Error: ", err)
+	}
+	for i := range dp {
+		if d := (p2[i] - p1[i]) / 2 / h; math.Abs(dp[i]-d) > 1e-6 {
+			t.Fatalf("Expected %v, got %v (i=%d)", d, dp[i], i)
+		}
+	}
+}
@@ -134,6 +134,23 @@ func (m *EMatrix) Eigen() (err error) {
 	return nil
 }
 
+// RateMatrix returns the rate matrix corresponding to the
+// eigendecomposition, i.e. Q scaled by ScaleD. Eigendecomposition
+// should be performed before the call.
+func (m *EMatrix) RateMatrix() *mat64.Dense {
+	rows, cols := m.Q.Dims()
+	res := mat64.NewDense(rows, cols, nil)
+	if m.Scale < smallScale {
+		return res
+	}
+	if m.v == nil {
+		panic("RateMatrix called before eigendecomposition")
+	}
+	res.Mul(m.v, m.d)
+	res.Mul(res, m.iv)
+	return res
+}
+
 // Exp computes P=e^Qt and writes it to cD matrix.
 func (m *EMatrix) Exp(cD *mat64.Dense, t float64, res []float64, tmp []float64) ([]float64, error) {
 	rows, cols := m.Q.Dims()
@@ -186,3 +203,52 @@ func (m *EMatrix) Exp(cD *mat64.Dense, t float64, res []float64, tmp []float64)
 	}
 	return res, nil
 }
+
+// DExp computes the derivative of P=e^Qt with respect to t,
+// dP/dt=V*diag(lambda*e^(lambda*t))*V^-1, and writes it to res. cD
+// and tmp are used as temporary storage.
+func (m *EMatrix) DExp(cD *mat64.Dense, t float64, res []float64, tmp []float64) ([]float64, error) {
+	rows, cols := m.Q.Dims()
+	if cols != rows {
+		return nil, errors.New("D isn't a square matrix")
+	}
+	if res == nil {
+		res = make([]float64, cols*rows)
+	}
+	if m.Scale < smallScale {
+		// zero matrix, P is always identity
+		for i := range res {
+			res[i] = 0
+		}
+		return res, nil
+	}
+
+	if tmp == nil {
+		tmp = make([]float64, cols*rows)
+	}
+
+	for i := 0; i < rows; i++ {
+		d := m.d.At(i, i)
+		cD.Set(i, i, d*math.Exp(d*t))
+	}
+
+	//equivalent if tmp.Mul(m.v, cD)
+	impl.Dgemm(blas.NoTrans, blas.NoTrans,
+		rows, cols, cols,
+		1,
+		m.v.RawMatrix().Data, cols,
+		cD.RawMatrix().Data, cols,
+		0,
+		tmp, cols)
+
+	//equivalent of res.Mul(tmp, m.iv)
+	impl.Dgemm(blas.NoTrans, blas.NoTrans,
+		rows, cols, cols,
+		1,
+		tmp, cols,
+		m.iv.RawMatrix().Data, cols,
+		0,
+		res, cols)
+
+	return res, nil
+}
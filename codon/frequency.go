@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math"
 	"strconv"
 
 	"bitbucket.org/Davydov/godon/bio"
@@ -14,10 +15,29 @@ var (
 	rAlphabet = map[byte]byte{'T': 0, 'C': 1, 'A': 2, 'G': 3}
 )
 
+// Model is a codon model parametrization, i.e. the way
+// equilibrium frequencies enter the substitution rates.
+type Model int
+
+const (
+	// GY94 is the Goldman & Yang (1994) parametrization, the rate is
+	// multiplied by the target codon frequency.
+	GY94 Model = iota
+	// MG94 is the Muse & Gaut (1994) parametrization, the rate is
+	// multiplied by the target nucleotide frequency at the
+	// changed position.
+	MG94
+)
+
 // Frequency is array (slice) of codon frequencies.
 type Frequency struct {
 	Freq  []float64
 	GCode *bio.GeneticCode
+	// NFreq is position-specific nucleotide frequencies (3x4),
+	// they are used by the MG94 parametrization.
+	NFreq [][]float64
+	// Model is the codon model parametrization.
+	Model Model
 }
 
 // ReadFrequency reads codon frequencies from a reader. It should be
@@ -51,6 +71,7 @@ func ReadFrequency(rd io.Reader, gcode *bio.GeneticCode) (Frequency, error) {
 	if i < gcode.NCodon {
 		return cf, errors.New("not enough frequencies in file")
 	}
+	cf.NFreq = cf.nucleotideFrequency()
 	return cf, nil
 
 }
@@ -65,11 +86,16 @@ func F0(cali Sequences) Frequency {
 	for i := 0; i < gcode.NCodon; i++ {
 		cf.Freq[i] = 1 / float64(gcode.NCodon)
 	}
+	cf.NFreq = make([][]float64, 3)
+	for pos := range cf.NFreq {
+		cf.NFreq[pos] = []float64{0.25, 0.25, 0.25, 0.25}
+	}
 	return cf
 }
 
-// F3X4 computes F3X4-style frequencies based on the alignment.
-func F3X4(cali Sequences) (cf Frequency) {
+// positionFrequency computes position-specific nucleotide
+// frequencies (3x4) observed in the alignment.
+func positionFrequency(cali Sequences) [][]float64 {
 	gcode := cali[0].GCode
 	poscf := make([][]float64, 3)
 	for i := 0; i < 3; i++ {
@@ -88,20 +114,167 @@ func F3X4(cali Sequences) (cf Frequency) {
 		}
 	}
 
-	cf = Frequency{
+	for _, nf := range poscf {
+		normalize(nf)
+	}
+	return poscf
+}
+
+// normalize divides all the values by their sum.
+func normalize(f []float64) {
+	sum := 0.0
+	for _, v := range f {
+		sum += v
+	}
+	for i := range f {
+		f[i] /= sum
+	}
+}
+
+// F1X4 computes F1X4-style frequencies based on the alignment, i.e.
+// the same nucleotide frequencies are used for all the codon
+// positions.
+func F1X4(cali Sequences) Frequency {
+	gcode := cali[0].GCode
+	poscf := positionFrequency(cali)
+	nf := make([]float64, 4)
+	for _, pf := range poscf {
+		for i, f := range pf {
+			nf[i] += f / 3
+		}
+	}
+	for i := range poscf {
+		copy(poscf[i], nf)
+	}
+
+	return Frequency{
+		Freq:  ProductFrequency(gcode, poscf),
+		GCode: gcode,
+		NFreq: poscf,
+	}
+}
+
+// F3X4 computes F3X4-style frequencies based on the alignment.
+func F3X4(cali Sequences) Frequency {
+	gcode := cali[0].GCode
+	poscf := positionFrequency(cali)
+
+	return Frequency{
+		Freq:  ProductFrequency(gcode, poscf),
+		GCode: gcode,
+		NFreq: poscf,
+	}
+}
+
+// CF3X4 computes corrected F3X4 frequencies (Kosakovsky Pond et al.,
+// 2010). Position-specific nucleotide frequencies are adjusted so
+// that nucleotide frequencies of the resulting codon frequencies
+// (which exclude stop codons) match the observed ones.
+func CF3X4(cali Sequences) Frequency {
+	const (
+		maxIter = 1000
+		eps     = 1e-12
+	)
+	gcode := cali[0].GCode
+	obs := positionFrequency(cali)
+	poscf := make([][]float64, 3)
+	for i := range poscf {
+		poscf[i] = make([]float64, 4)
+		copy(poscf[i], obs[i])
+	}
+
+	cf := Frequency{
+		GCode: gcode,
+		NFreq: poscf,
+	}
+	// iterative proportional fitting
+	for iter := 0; iter < maxIter; iter++ {
+		cf.Freq = ProductFrequency(gcode, poscf)
+		marg := cf.nucleotideFrequency()
+		maxDiff := 0.0
+		for pos := range poscf {
+			for i := range poscf[pos] {
+				maxDiff = math.Max(maxDiff, math.Abs(marg[pos][i]-obs[pos][i]))
+				if marg[pos][i] > 0 {
+					poscf[pos][i] *= obs[pos][i] / marg[pos][i]
+				}
+			}
+			normalize(poscf[pos])
+		}
+		if maxDiff < eps {
+			break
+		}
+	}
+	cf.Freq = ProductFrequency(gcode, poscf)
+
+	return cf
+}
+
+// F61 computes empirical codon frequencies (observed codon counts)
+// based on the alignment.
+func F61(cali Sequences) Frequency {
+	gcode := cali[0].GCode
+	cf := Frequency{
 		Freq:  make([]float64, gcode.NCodon),
 		GCode: gcode,
 	}
 
-	sum := float64(0)
+	for _, cs := range cali {
+		for _, codon := range cs.Sequence {
+			if codon == NOCODON {
+				continue
+			}
+			cf.Freq[codon]++
+		}
+	}
+	normalize(cf.Freq)
+	cf.NFreq = cf.nucleotideFrequency()
+
+	return cf
+}
+
+// ProductFrequency computes codon frequencies as a normalized
+// product of position-specific nucleotide frequencies.
+func ProductFrequency(gcode *bio.GeneticCode, nfreq [][]float64) []float64 {
+	freq := make([]float64, gcode.NCodon)
 	for ci, cs := range gcode.NumCodon {
-		cf.Freq[ci] = poscf[0][rAlphabet[cs[0]]] * poscf[1][rAlphabet[cs[1]]] * poscf[2][rAlphabet[cs[2]]]
-		sum += cf.Freq[ci]
+		freq[ci] = nfreq[0][rAlphabet[cs[0]]] * nfreq[1][rAlphabet[cs[1]]] * nfreq[2][rAlphabet[cs[2]]]
 	}
+	normalize(freq)
+	return freq
+}
 
-	for ci := range cf.Freq {
-		cf.Freq[ci] /= sum
+// nucleotideFrequency computes position-specific nucleotide
+// frequencies as marginals of the codon frequencies.
+func (cf Frequency) nucleotideFrequency() [][]float64 {
+	nfreq := make([][]float64, 3)
+	for pos := range nfreq {
+		nfreq[pos] = make([]float64, 4)
 	}
+	for ci, cs := range cf.GCode.NumCodon {
+		for pos := range nfreq {
+			nfreq[pos][rAlphabet[cs[pos]]] += cf.Freq[ci]
+		}
+	}
+	return nfreq
+}
 
-	return
+// MG94Frequency returns frequencies for the MG94 parametrization.
+// MG94 model is only time-reversible if the codon frequencies are
+// a product of position-specific nucleotide frequencies, so codon
+// frequencies are recomputed from the nucleotide frequencies. The
+// second returned value is the maximum absolute change of a codon
+// frequency.
+func MG94Frequency(cf Frequency) (Frequency, float64) {
+	freq := ProductFrequency(cf.GCode, cf.NFreq)
+	maxDiff := 0.0
+	for i, f := range freq {
+		maxDiff = math.Max(maxDiff, math.Abs(f-cf.Freq[i]))
+	}
+	return Frequency{
+		Freq:  freq,
+		GCode: cf.GCode,
+		NFreq: cf.NFreq,
+		Model: MG94,
+	}, maxDiff
 }
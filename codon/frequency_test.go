@@ -0,0 +1,72 @@
+package codon
+
+import (
+	"math"
+	"testing"
+
+	"bitbucket.org/Davydov/godon/bio"
+)
+
+// testSequences returns a small codon alignment.
+func testSequences(tst *testing.T) Sequences {
+	seqs := bio.Sequences{
+		{Name: "a", Sequence: "ATGTTTCCCAAAGGGTATTGCACG"},
+		{Name: "b", Sequence: "ATGTTCCCGAAGGGATACTGTACA"},
+		{Name: "c", Sequence: "ATGCTTCCAAAAGGTTATTGCACT"},
+	}
+	cali, err := ToCodonSequences(seqs, bio.GeneticCodes[1])
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	return cali
+}
+
+// checkSum checks that the codon frequencies sum up to one.
+func checkSum(tst *testing.T, cf Frequency) {
+	sum := 0.0
+	for _, f := range cf.Freq {
+		sum += f
+	}
+	if math.Abs(sum-1) > 1e-10 {
+		tst.Error("Expected frequencies sum to be 1, got", sum)
+	}
+}
+
+func TestF1X4(tst *testing.T) {
+	cf := F1X4(testSequences(tst))
+	checkSum(tst, cf)
+	for pos := 1; pos < 3; pos++ {
+		for i := range cf.NFreq[pos] {
+			if cf.NFreq[pos][i] != cf.NFreq[0][i] {
+				tst.Error("Expected equal nucleotide frequencies at all positions, got", cf.NFreq)
+			}
+		}
+	}
+}
+
+func TestF61(tst *testing.T) {
+	cali := testSequences(tst)
+	cf := F61(cali)
+	checkSum(tst, cf)
+	// ATG is found once in every sequence
+	atg := cf.Freq[cali[0].GCode.CodonNum["ATG"]]
+	if math.Abs(atg-3./24) > 1e-10 {
+		tst.Error("Expected ATG frequency of", 3./24, ", got", atg)
+	}
+}
+
+func TestCF3X4(tst *testing.T) {
+	cali := testSequences(tst)
+	cf := CF3X4(cali)
+	checkSum(tst, cf)
+	obs := positionFrequency(cali)
+	marg := cf.nucleotideFrequency()
+	for pos := range obs {
+		for i := range obs[pos] {
+			if math.Abs(obs[pos][i]-marg[pos][i]) > 1e-8 {
+				tst.Error("Expected nucleotide frequencies", obs, ", got", marg)
+				return
+			}
+		}
+	}
+}
@@ -36,11 +36,19 @@ func Sum(m *mat64.Dense) (s float64) {
 
 // CreateTransitionMatrix creates a transition matrix.
 func CreateTransitionMatrix(cf Frequency, kappa, omega float64, m *mat64.Dense) (*mat64.Dense, float64) {
-	return CreateRateTransitionMatrix(cf, kappa, omega, []float64{1, 1, 1}, m)
+	return CreateRateTransitionMatrix(cf, kappa, omega, nil, nil, 0, 0, m)
 }
 
-// CreateRateTransitionMatrix creates a transition matrix given the vector of rates.
-func CreateRateTransitionMatrix(cf Frequency, kappa, omega float64, rates []float64, m *mat64.Dense) (*mat64.Dense, float64) {
+// CreateRateTransitionMatrix creates a transition matrix given the
+// vector of rates. If rates is nil, all the codon positions have the
+// same rate. If gtr is not nil, it should contain six GTR nucleotide
+// exchangeabilities (ordered as in NucPairIndex), kappa is ignored
+// in this case. Delta and psi are the relative rates of double and
+// triple nucleotide changes (zero disables them); for such changes
+// the position rates are averaged, and neither kappa nor gtr is
+// applied. Parametrization (GY94 or MG94) is defined by the
+// frequency model.
+func CreateRateTransitionMatrix(cf Frequency, kappa, omega float64, rates, gtr []float64, delta, psi float64, m *mat64.Dense) (*mat64.Dense, float64) {
 	//fmt.Println("kappa=", kappa, ", omega=", omega)
 	if m == nil {
 		m = mat64.NewDense(cf.GCode.NCodon, cf.GCode.NCodon, nil)
@@ -56,12 +64,32 @@ func CreateRateTransitionMatrix(cf Frequency, kappa, omega float64, rates []floa
 			dist, transitions, pos := codonDistance(c1, c2)
 
 			if dist > 1 {
-				m.Set(i1, i2, 0)
+				rate := delta
+				if dist == 3 {
+					rate = psi
+				}
+				if rate != 0 {
+					rate *= multiNucleotideRate(cf, c1, c2, i2, rates)
+				}
+				if cf.GCode.Map[c1] != cf.GCode.Map[c2] {
+					rate *= omega
+				}
+				m.Set(i1, i2, rate)
 				continue
 			}
-			m.Set(i1, i2, rates[pos])
-			m.Set(i1, i2, m.At(i1, i2)*cf.Freq[i2])
-			if transitions == 1 {
+			if rates != nil {
+				m.Set(i1, i2, rates[pos])
+			} else {
+				m.Set(i1, i2, 1)
+			}
+			if cf.Model == MG94 {
+				m.Set(i1, i2, m.At(i1, i2)*cf.NFreq[pos][rAlphabet[c2[pos]]])
+			} else {
+				m.Set(i1, i2, m.At(i1, i2)*cf.Freq[i2])
+			}
+			if gtr != nil {
+				m.Set(i1, i2, m.At(i1, i2)*gtr[NucPairIndex(c1[pos], c2[pos])])
+			} else if transitions == 1 {
 				m.Set(i1, i2, m.At(i1, i2)*kappa)
 			}
 			if cf.GCode.Map[c1] != cf.GCode.Map[c2] {
@@ -139,6 +167,44 @@ func PrintUnQ(Q *mat64.Dense, gcode bio.GeneticCode) {
 	}
 }
 
+// multiNucleotideRate computes the rate of a double or a triple
+// nucleotide change from codon c1 to codon c2 (codon number i2)
+// without delta, psi and omega.
+func multiNucleotideRate(cf Frequency, c1, c2 string, i2 int, rates []float64) float64 {
+	f := 1.0
+	rate := 0.0
+	n := 0
+	for pos := 0; pos < len(c1); pos++ {
+		if c1[pos] == c2[pos] {
+			continue
+		}
+		if cf.Model == MG94 {
+			f *= cf.NFreq[pos][rAlphabet[c2[pos]]]
+		}
+		if rates != nil {
+			rate += rates[pos]
+		} else {
+			rate++
+		}
+		n++
+	}
+	if cf.Model != MG94 {
+		f = cf.Freq[i2]
+	}
+	return f * rate / float64(n)
+}
+
+// NucPairIndex returns the index of a pair of nucleotides (e.g. 'A'
+// and 'G') in the array of six GTR exchangeabilities. The order is
+// TC, TA, TG, CA, CG, AG.
+func NucPairIndex(n1, n2 byte) int {
+	i, j := int(rAlphabet[n1]), int(rAlphabet[n2])
+	if i > j {
+		i, j = j, i
+	}
+	return i*(5-i)/2 + j - 1
+}
+
 // codonDistance computes distance, number of transitions and
 // difference position for two codons.
 func codonDistance(c1, c2 string) (dist, transitions, pos int) {
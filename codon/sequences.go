@@ -138,6 +138,28 @@ func (seqs Sequences) Fixed() (fixed []bool) {
 	return
 }
 
+// Patterns compresses the alignment into unique site patterns
+// (identical alignment columns). It returns the first position of
+// every pattern and the pattern index for every position.
+func (seqs Sequences) Patterns() (first []int, patterns []int) {
+	patterns = make([]int, seqs.Length())
+	index := make(map[string]int)
+	column := make([]byte, len(seqs))
+	for pos := range patterns {
+		for i, seq := range seqs {
+			column[i] = seq.Sequence[pos]
+		}
+		k, ok := index[string(column)]
+		if !ok {
+			k = len(first)
+			index[string(column)] = k
+			first = append(first, pos)
+		}
+		patterns[pos] = k
+	}
+	return
+}
+
 // Letters returns a set of present and absent codons at each position
 // of the alignment.
 func (seqs Sequences) Letters() (found [][]int, absent [][]int) {
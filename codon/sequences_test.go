@@ -0,0 +1,35 @@
+package codon
+
+import (
+	"testing"
+
+	"bitbucket.org/Davydov/godon/bio"
+)
+
+func TestPatterns(tst *testing.T) {
+	gcode := bio.GeneticCodes[1]
+	seqs, err := ToCodonSequences(bio.Sequences{
+		{Name: "a", Sequence: "AAAGGGAAAAAANNN"},
+		{Name: "b", Sequence: "AAAGGGAAGAAANNN"},
+	}, gcode)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+
+	first, patterns := seqs.Patterns()
+	refFirst := []int{0, 1, 2, 4}
+	refPatterns := []int{0, 1, 2, 0, 3}
+	if len(first) != len(refFirst) {
+		tst.Fatal("Expected ", refFirst, ", got", first)
+	}
+	for i := range first {
+		if first[i] != refFirst[i] {
+			tst.Error("Expected ", refFirst, ", got", first)
+		}
+	}
+	for i := range patterns {
+		if patterns[i] != refPatterns[i] {
+			tst.Error("Expected ", refPatterns, ", got", patterns)
+		}
+	}
+}
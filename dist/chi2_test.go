@@ -0,0 +1,42 @@
+package dist
+
+import (
+	"testing"
+)
+
+// Test chi-square distribution function and its' quantile agree.
+func TestChi2(tst *testing.T) {
+	for _, df := range []float64{1, 2, 5} {
+		for _, p := range []float64{0.05, 0.5, 0.9, 0.99} {
+			x := QuantileChi2(p, df)
+			if !appreq(CDFChi2(x, df), p) {
+				tst.Errorf("CDFChi2(%g, %g)=%g, expected %g", x, df, CDFChi2(x, df), p)
+			}
+			if !appreq(SurvivalChi2(x, df), 1-p) {
+				tst.Errorf("SurvivalChi2(%g, %g)=%g, expected %g", x, df, SurvivalChi2(x, df), 1-p)
+			}
+		}
+	}
+	// qchisq(0.95, df=1)
+	if !appreq(SurvivalChi2(3.841459, 1), 0.05) {
+		tst.Error("Wrong chi2_1 tail probability:", SurvivalChi2(3.841459, 1))
+	}
+}
+
+// Test 50:50 mixture of point mass and chi2_1.
+func TestChi2Mixture(tst *testing.T) {
+	weights := []float64{0.5, 0.5}
+	// 2.705543 is the 0.95 quantile of the mixture
+	if !appreq(SurvivalChi2Mixture(2.705543, weights), 0.05) {
+		tst.Error("Wrong mixture tail probability:", SurvivalChi2Mixture(2.705543, weights))
+	}
+	if !appreq(CDFChi2Mixture(2.705543, weights), 0.95) {
+		tst.Error("Wrong mixture CDF:", CDFChi2Mixture(2.705543, weights))
+	}
+	if SurvivalChi2Mixture(0, weights) != 0.5 || CDFChi2Mixture(0, weights) != 0.5 {
+		tst.Error("Wrong point mass")
+	}
+	if SurvivalChi2Mixture(-1, weights) != 1 || CDFChi2Mixture(-1, weights) != 0 {
+		tst.Error("Wrong negative statistics")
+	}
+}
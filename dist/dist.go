@@ -112,6 +112,59 @@ l4:
 	return
 }
 
+// CDFChi2 returns the distribution function of the chi-square
+// distribution with df degrees of freedom.
+func CDFChi2(x, df float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	return mathext.GammaInc(df/2, x/2)
+}
+
+// SurvivalChi2 returns the upper tail probability Prob{X>x} of the
+// chi-square distribution with df degrees of freedom. It is more
+// precise than 1-CDFChi2 for small probabilities.
+func SurvivalChi2(x, df float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return mathext.GammaIncComp(df/2, x/2)
+}
+
+// CDFChi2Mixture returns the distribution function of a mixture of
+// chi-square distributions. weights[i] is the weight of the
+// distribution with i degrees of freedom, chi-square with zero
+// degrees of freedom is the point mass at zero. E.g. weights 0.5,
+// 0.5 define the 50:50 mixture of the point mass and chi2_1.
+func CDFChi2Mixture(x float64, weights []float64) (res float64) {
+	if x < 0 {
+		return 0
+	}
+	for df, w := range weights {
+		if df == 0 {
+			res += w
+		} else {
+			res += w * CDFChi2(x, float64(df))
+		}
+	}
+	return
+}
+
+// SurvivalChi2Mixture returns the upper tail probability Prob{X>x}
+// of a mixture of chi-square distributions (see CDFChi2Mixture).
+func SurvivalChi2Mixture(x float64, weights []float64) (res float64) {
+	for df, w := range weights {
+		if df == 0 {
+			if x < 0 {
+				res += w
+			}
+		} else {
+			res += w * SurvivalChi2(x, float64(df))
+		}
+	}
+	return
+}
+
 // QuantileGamma returns quantile for gamma distribution.
 func QuantileGamma(prob, alpha, beta float64) float64 {
 	return QuantileChi2(prob, 2.0*(alpha)) / (2.0 * (beta))
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"bitbucket.org/Davydov/godon/bio"
+	"bitbucket.org/Davydov/godon/cmodel"
+)
+
+// readSummaryParameters reads maximum likelihood parameter values
+// from the godon JSON output. Both optimize (optimizer
+// maxLParameters) and single branch test (H1 maxLParameters) outputs
+// are supported.
+func readSummaryParameters(filename string) (map[string]float64, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var s struct {
+		Optimizer struct {
+			MaxLParameters map[string]float64 `json:"maxLParameters"`
+		} `json:"optimizer"`
+		H1 HypSummary
+	}
+	err = json.Unmarshal(contents, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(s.Optimizer.MaxLParameters) > 0:
+		return s.Optimizer.MaxLParameters, nil
+	case len(s.H1.MaxLParameters) > 0:
+		return s.H1.MaxLParameters, nil
+	}
+	return nil, errors.New("no maximum likelihood parameters found in the summary")
+}
+
+// writeAncestral writes ancestral sequences to a FASTA file. If joint
+// is false, the marginal reconstruction is written.
+func writeAncestral(filename string, nodes []cmodel.AncestralNode, joint bool) error {
+	seqs := make(bio.Sequences, len(nodes))
+	for i, node := range nodes {
+		seqs[i] = bio.Sequence{
+			Name:     fmt.Sprintf("node%d", node.NodeID),
+			Sequence: node.Marginal,
+		}
+		if joint {
+			seqs[i].Sequence = node.Joint
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(seqs.String() + "\n")
+	return err
+}
+
+// logParameters logs model parameter values.
+func logParameters(m cmodel.TreeOptimizableSiteClass) {
+	for _, par := range m.GetFloatParameters() {
+		log.Infof("%s=%v", par.Name(), par.Get())
+	}
+}
+
+// ancestral performs the ancestral sequence reconstruction.
+func ancestral() (summary AncestralSummary) {
+	//transfer options from asr command
+	alignmentFileName = asrAlignmentFileName
+	treeFileName = asrTreeFileName
+	model = asrModel
+
+	// without fitted parameters the reconstruction would use the
+	// default parameter values
+	if *asrSummaryF == "" && *startF == "" {
+		log.Fatal("Model parameters are required, use --summary or --start")
+	}
+
+	data, err := newData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ms := newModelSettings(data)
+	m, err := ms.createInitalized(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// reconstruction requires all the positions
+	m.SetAggregationMode(cmodel.AggNone)
+
+	if *asrSummaryF != "" {
+		par, err := readSummaryParameters(*asrSummaryF)
+		if err != nil {
+			log.Fatal("Error reading summary:", err)
+		}
+		setStart(m, par)
+	}
+
+	summary.LnL = m.Likelihood()
+	log.Noticef("lnL=%v", summary.LnL)
+	logParameters(m)
+
+	summary.Tree = data.Tree.BrString()
+	log.Noticef("Tree with node ids: %s", summary.Tree)
+
+	summary.Nodes = m.Ancestral()
+
+	for _, node := range summary.Nodes {
+		log.Infof("node%d joint: %s", node.NodeID, node.Joint)
+		log.Infof("node%d marginal: %s", node.NodeID, node.Marginal)
+	}
+
+	if *asrJointF != "" {
+		if err := writeAncestral(*asrJointF, summary.Nodes, true); err != nil {
+			log.Error("Error writing joint reconstruction:", err)
+		}
+	}
+	if *asrMarginalF != "" {
+		if err := writeAncestral(*asrMarginalF, summary.Nodes, false); err != nil {
+			log.Error("Error writing marginal reconstruction:", err)
+		}
+	}
+
+	return
+}
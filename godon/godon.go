@@ -91,16 +91,18 @@ var (
 	// optimize flags
 	alignmentFileName = opt.Arg("alignment", "sequence alignment").Required().ExistingFile()
 	treeFileName      = opt.Arg("tree", "starting phylogenetic tree").Required().ExistingFile()
-	fixw              = opt.Flag("fix-w", "fix omega=1 (for the branch-site and M8 models)").Short('f').Bool()
+	fixw              = opt.Flag("fix-w", "fix omega=1 (for the branch-site and M8 models), use one-ratio for the branch model, M2a_rel for CmC, M0 for M3, M5 for M6, M7 for M10").Short('f').Bool()
 	outTreeF          = opt.Flag("out-tree", "write tree to a file").String()
 	printFull         = opt.Flag("full-likelihood", "print full (non-aggregated) likelihood in the end of optimization").Bool()
+	profileParameters = opt.Flag("profile", "compute profile likelihood confidence intervals for the comma-separated list of parameters (e.g. omega2,kappa)").String()
+	mappingSamples    = opt.Flag("stochastic-mapping", "sample N substitution histories per site and report expected numbers of synonymous and nonsynonymous substitutions per branch").Default("0").Int()
 
 	// hypTest flags
 	hTest      = app.Command("test", "Run test for positive selection")
 	hTestModel = hTest.Arg("model",
-		"model type (BS for branch site, BSG for branch-site + gamma, M2a vs M1a or M8)").
+		"model type (BS for branch site, BSG for branch-site + gamma, M2a vs M1a, M8, BM for one-ratio vs branch model, CmC vs M2a_rel, M3 vs M0, M6 vs M5 or M10 vs M7)").
 		Required().
-		Enum("BS", "BSG", "M8", "M2a")
+		Enum("BS", "BSG", "M8", "M2a", "BM", "CmC", "M3", "M6", "M10")
 	hTestAlignmentFileName = hTest.Arg("alignment", "sequence alignment").Required().ExistingFile()
 	hTestTreeFileName      = hTest.Arg("tree", "starting phylogenetic tree").Required().ExistingFile()
 	sThr                   = hTest.Flag("significance-threshold",
@@ -121,18 +123,62 @@ var (
 			Bool()
 	noLeavesTest = hTest.Flag("no-leaves", "don't test leaves (for BS & BSG)").
 			Bool()
+	bootstrap = hTest.Flag("bootstrap", "compute parametric bootstrap p-value using N replicates simulated under H0").
+			Int()
+
+	// asr flags
+	asr      = app.Command("asr", "Run ancestral sequence reconstruction")
+	asrModel = asr.Arg("model",
+		"model type (M0, BS, M8, etc)").
+		Required().String()
+	asrAlignmentFileName = asr.Arg("alignment", "sequence alignment").Required().ExistingFile()
+	asrTreeFileName      = asr.Arg("tree", "phylogenetic tree").Required().ExistingFile()
+	asrSummaryF          = asr.Flag("summary", "read model parameters from the godon JSON output (optimize or test H1); required unless --start is used").ExistingFile()
+	asrJointF            = asr.Flag("joint-out", "write the joint reconstruction to a FASTA file").String()
+	asrMarginalF         = asr.Flag("marginal-out", "write the marginal reconstruction to a FASTA file").String()
+
+	// simulate flags
+	sim      = app.Command("simulate", "Simulate a codon alignment")
+	simModel = sim.Arg("model",
+		"model type (M0, BS, M8, etc)").
+		Required().String()
+	simTreeFileName  = sim.Arg("tree", "phylogenetic tree").Required().ExistingFile()
+	simOutF          = sim.Arg("output", "output alignment (FASTA)").Required().String()
+	simLength        = sim.Flag("length", "number of codons to simulate (default: template alignment length)").Int()
+	simAlignmentF    = sim.Flag("template", "template alignment used for the codon frequencies (otherwise equal frequencies or --codon-frequency-file)").ExistingFile()
+	simSummaryF      = sim.Flag("summary", "read model parameters from the godon JSON output (optimize or test H1)").ExistingFile()
+	simParameters    = sim.Flag("parameter", "set model parameter value (e.g. --parameter omega=0.5), can be repeated").Short('P').StringMap()
+	simClassesF      = sim.Flag("classes-out", "write the site class of every codon to a file").String()
+
+	// scan flags
+	scan      = app.Command("scan", "Compute likelihood on a grid of one or two parameters")
+	scanModel = scan.Arg("model",
+		"model type (M0, BS, M8, etc)").
+		Required().String()
+	scanAlignmentFileName = scan.Arg("alignment", "sequence alignment").Required().ExistingFile()
+	scanTreeFileName      = scan.Arg("tree", "phylogenetic tree").Required().ExistingFile()
+	scanGrid              = scan.Arg("grid", "parameter grid as name=from:to:step (e.g. kappa=0.5:5:0.1), one or two parameters").Required().Strings()
+	scanOptimize          = scan.Flag("optimize", "re-optimize the other parameters at every grid point (otherwise they are held at the starting point)").Bool()
+	scanTableF            = scan.Flag("table", "write tab-separated likelihood table to a file").String()
 
 	//model parameters
 	gcodeID       = app.Flag("gcode", "NCBI genetic code id, standard by default").Default("1").Int()
 	fgBranch      = app.Flag("fg-branch", "foreground branch number").Default("-1").Int()
 	maxBrLen      = app.Flag("max-branch-length", "maximum branch length").Default("100").Float64()
 	noOptBrLen    = app.Flag("no-branch-length", "don't optimize branch lengths").Short('n').Bool()
-	cFreq         = app.Flag("codon-frequency", "codon frequecny (F0 or F3X4)").Default("F3X4").String()
+	cFreq         = app.Flag("codon-frequency", "codon frequency (F0, F1X4, F3X4, CF3X4 or F61)").Default("F3X4").Action(setCFreq).String()
 	cFreqFileName = app.Flag("codon-frequency-file", "codon frequencies file (overrides --codon-frequency)").ExistingFile()
+	estFreq       = app.Flag("estimate-frequency", "estimate nucleotide frequencies (F1X4, F3X4 or CF3X4) by maximum likelihood").Bool()
+	codonModel    = app.Flag("codon-model", "codon model parametrization: GY (GY94, target codon frequency) or MG (MG94, target nucleotide frequency)").Default("GY").Enum("GY", "MG")
+	gtr           = app.Flag("gtr", "use five GTR nucleotide exchangeabilities instead of kappa").Bool()
+	mnm           = app.Flag("multi-nucleotide", "allow instantaneous double and triple nucleotide changes (delta and psi)").Bool()
+	ecmFileName   = app.Flag("ecm-file", "empirical codon model exchangeability matrix file (ECM+omega, replaces kappa)").ExistingFile()
 	ncatsr        = app.Flag("ncat-site-rate", "number of categories for the site rate variation (no variation by default)").Default("1").Int()
 	ncatcr        = app.Flag("ncat-codon-rate", "number of categories for the codon rate variation (no variation by default)").Default("1").Int()
 	proportional  = app.Flag("proportional", "use three rates and three proportions instead of gamma distribution").Bool()
-	ncatb         = app.Flag("ncat-beta", "number of the categories for the beta distribution (models M7&M8)").Default("4").Int()
+	ncatb         = app.Flag("ncat-beta", "number of the categories for the beta distribution (models M7, M8 & M10)").Default("4").Int()
+	ncatw         = app.Flag("ncat-omega", "number of the omega categories (model M3) or the gamma categories (models M5, M6 & M10)").Default("3").Int()
+	freeRatio     = app.Flag("free-ratio", "use a separate omega for every branch (branch model)").Bool()
 
 	// optimizer parameters
 	startF    = app.Flag("start", "read start position from the trajectory or JSON file").Short('s').ExistingFile()
@@ -160,6 +206,7 @@ var (
 	codonRates = app.Flag("codon-rates", "perform NEB analysis of codon rates").Default("false").Bool()
 	siteRates  = app.Flag("site-rates", "perform NEB analysis of site rates").Default("false").Bool()
 	codonOmega = app.Flag("codon-omega", "perform NEB analysis of codon omega").Default("false").Bool()
+	stdErrors  = app.Flag("std-errors", "compute standard errors and confidence intervals from the observed information matrix").Bool()
 
 	// mcmc parameters
 	accept = app.Flag("report-acceptance", "report acceptance rate every N iterations").Default("200").Int()
@@ -178,6 +225,7 @@ var (
 		Default("none").Enum("none", "observed", "observed_new", "fixed", "random")
 	// technical
 	nThreads   = app.Flag("procs", "number of threads to use").Short('p').Int()
+	noCache    = app.Flag("no-cache", "don't cache partial likelihoods (saves up to 256 MiB per model)").Bool()
 	seed       = app.Flag("seed", "random generator seed, default time based").Short('S').Default("-1").Int64()
 	cpuProfile = app.Flag("cpu-profile", "write cpu profile to file").String()
 
@@ -194,10 +242,20 @@ var (
 
 	trajF *os.File
 
+	// cFreqSet is true if --codon-frequency is specified
+	// explicitly
+	cFreqSet bool
+
 	checkpointDB *bolt.DB
 	mainBucket   = []byte("main")
 )
 
+// setCFreq records that --codon-frequency is specified.
+func setCFreq(*kingpin.ParseContext) error {
+	cFreqSet = true
+	return nil
+}
+
 func compareCmdLineOrSave() {
 	keyCmdLine := []byte("cmdLine")
 	cmdLineCp, err := checkpoint.LoadData(checkpointDB, keyCmdLine)
@@ -336,6 +394,24 @@ func main() {
 			callSummary.Tests = hTestSummary
 			summary = &callSummary
 		}
+	case asr.FullCommand():
+		asrSummary := ancestral()
+		summary = struct {
+			*CallSummary
+			AncestralSummary
+		}{&callSummary, asrSummary}
+	case sim.FullCommand():
+		simSummary := simulation()
+		summary = struct {
+			*CallSummary
+			SimulationSummary
+		}{&callSummary, simSummary}
+	case scan.FullCommand():
+		scanSummary := likelihoodScan()
+		summary = struct {
+			*CallSummary
+			ScanSummary
+		}{&callSummary, scanSummary}
 	default:
 		log.Fatalf("command %v not implemented", cmd)
 	}
@@ -2,9 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
 
 	"bitbucket.org/Davydov/godon/checkpoint"
 	"bitbucket.org/Davydov/godon/cmodel"
+	"bitbucket.org/Davydov/godon/dist"
 )
 
 const (
@@ -85,21 +92,84 @@ func hypTest() (tests []HypTestSummary, optimizations []OptimizationSummary) {
 			log.Noticef("Testing branch %d/%d", i+1, len(toTest))
 			nodes[nid].Class = 1
 			log.Noticef("Foreground branch: %s", data.Tree.ShortClassString())
-			tests = append(tests, performSingleTest(data))
+			test := performTest(data)
+			test.Branch = nid
+			tests = append(tests, test)
 			nodes[nid].Class = 0
 		}
 
 		if len(toTest) == 0 {
 			log.Warningf("No branches to test")
+		} else {
+			adjustTests(tests)
 		}
 	} else {
 		// update testAllBranches so we know that only one test was performed
 		*testAllBranches = false
-		tests = append(tests, performSingleTest(data))
+		tests = append(tests, performTest(data))
 	}
 	return tests, optimizations
 }
 
+// adjustPValues returns Bonferroni, Holm and Benjamini-Hochberg
+// adjusted p-values.
+func adjustPValues(p []float64) (bonferroni, holm, bh []float64) {
+	n := len(p)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return p[order[i]] < p[order[j]]
+	})
+
+	bonferroni = make([]float64, n)
+	for i, v := range p {
+		bonferroni[i] = math.Min(1, v*float64(n))
+	}
+
+	// step-down, adjusted p-values are non-decreasing
+	holm = make([]float64, n)
+	maxP := 0.0
+	for k, i := range order {
+		maxP = math.Max(maxP, math.Min(1, p[i]*float64(n-k)))
+		holm[i] = maxP
+	}
+
+	// step-up, adjusted p-values are non-increasing
+	bh = make([]float64, n)
+	minP := 1.0
+	for k := n - 1; k >= 0; k-- {
+		i := order[k]
+		minP = math.Min(minP, p[i]*float64(n)/float64(k+1))
+		bh[i] = minP
+	}
+	return
+}
+
+// adjustTests adjusts p-values for multiple testing and logs the
+// summary table.
+func adjustTests(tests []HypTestSummary) {
+	// only the branch-site tests are adjusted, they always have
+	// the asymptotic p-value
+	p := make([]float64, len(tests))
+	for i, test := range tests {
+		p[i] = *test.PValue
+	}
+	bonferroni, holm, bh := adjustPValues(p)
+
+	log.Notice("branch\tD\tp-value\tBonferroni\tHolm\tBH")
+	for i := range tests {
+		tests[i].Adjusted = &AdjustedPValues{
+			Bonferroni: bonferroni[i],
+			Holm:       holm[i],
+			BH:         bh[i],
+		}
+		log.Noticef("%d\t%g\t%g\t%g\t%g\t%g", tests[i].Branch, tests[i].D,
+			p[i], bonferroni[i], holm[i], bh[i])
+	}
+}
+
 // saveSummary saves summary to checkpoint
 func saveSummary(summary interface{}, key []byte) {
 	var b []byte = []byte{}
@@ -129,6 +199,153 @@ func loadSummary(keyFinal0, keyFinal1 []byte) (*checkpoint.PseudoObject, *checkp
 	return final0Summary, final1Summary, true
 }
 
+// sharedParameters maps all the H1 parameters starting with prefix
+// to a single H0 parameter.
+func sharedParameters(m cmodel.TreeOptimizableSiteClass, prefix, h0Name string) map[string]string {
+	sharedPar := make(map[string]string)
+	par := m.GetFloatParameters()
+	for _, name := range par.Names(nil) {
+		if strings.HasPrefix(name, prefix) {
+			sharedPar[name] = h0Name
+		}
+	}
+	return sharedPar
+}
+
+// h1Start converts H0 parameters to the H1 starting point. Extra
+// parameters are set to their default values, shared parameters are
+// copied from the corresponding H0 parameter.
+func h1Start(h0par map[string]float64, extraPar map[string]float64, sharedPar map[string]string) map[string]float64 {
+	for parName, parVal := range extraPar {
+		h0par[parName] = parVal
+	}
+	h0names := make(map[string]bool, len(sharedPar))
+	for parName, h0Name := range sharedPar {
+		h0par[parName] = h0par[h0Name]
+		h0names[h0Name] = true
+	}
+	for h0Name := range h0names {
+		if _, ok := sharedPar[h0Name]; !ok {
+			delete(h0par, h0Name)
+		}
+	}
+	return h0par
+}
+
+// h0Start converts H1 parameters to the H0 starting point. Extra
+// parameters are removed, shared H0 parameters are taken from the
+// first (in the alphabetical order) corresponding H1 parameter.
+func h0Start(h1par map[string]float64, extraPar map[string]float64, sharedPar map[string]string) map[string]float64 {
+	for parName := range extraPar {
+		delete(h1par, parName)
+	}
+	names := make([]string, 0, len(sharedPar))
+	for parName := range sharedPar {
+		names = append(names, parName)
+	}
+	sort.Strings(names)
+	values := make(map[string]float64, len(sharedPar))
+	for _, parName := range names {
+		h0Name := sharedPar[parName]
+		if _, ok := values[h0Name]; !ok {
+			values[h0Name] = h1par[parName]
+		}
+		delete(h1par, parName)
+	}
+	for h0Name, val := range values {
+		h1par[h0Name] = val
+	}
+	return h1par
+}
+
+// lrtPValue returns the null distribution name and the p-value for
+// the LRT statistic d with df degrees of freedom. If omega is fixed
+// to one on the boundary of the parameter space under H0 (the
+// branch-site model and M8), the 50:50 mixture of the point mass at
+// zero and chi2_1 is used (Self & Liang, 1987). M3 vs M0 uses chi2
+// as in Yang et al. (2000). For M6 vs M5 and M10 vs M7 p0=1 is on
+// the boundary and the parameters of the second component are not
+// identifiable under H0, so there is no valid asymptotic null
+// distribution; nil p-value is returned and the parametric bootstrap
+// should be used instead.
+func lrtPValue(d float64, df int) (string, *float64) {
+	if *model == "M6" || *model == "M10" {
+		return "none (use --bootstrap)", nil
+	}
+	name := fmt.Sprintf("chi2_%d", df)
+	weights := make([]float64, df+1)
+	weights[df] = 1
+	if df == 1 && (*model == "BS" || *model == "BSG" || *model == "M8") {
+		name = "50:50 mixture of 0 and chi2_1"
+		weights[0] = 0.5
+		weights[1] = 0.5
+	}
+	p := 1.0
+	if d > 0 {
+		p = dist.SurvivalChi2Mixture(d, weights)
+	}
+	return name, &p
+}
+
+// performTest performs a test for given data and the parametric
+// bootstrap if requested.
+func performTest(data *cmodel.Data) (summary HypTestSummary) {
+	summary = performSingleTest(data)
+	if *bootstrap > 0 {
+		summary.Bootstrap = parametricBootstrap(data, summary)
+	}
+	return
+}
+
+// parametricBootstrap simulates replicate alignments under H0 using
+// the maximum likelihood parameters, and performs the test for
+// every replicate. The empirical p-value is computed using the
+// observed and the replicate LRT statistics.
+func parametricBootstrap(data *cmodel.Data, test HypTestSummary) *BootstrapSummary {
+	// replicates should neither use the checkpoint nor compute
+	// NEB & BEB
+	defer func(db *bolt.DB, runFinal bool) {
+		checkpointDB = db
+		*final = runFinal
+	}(checkpointDB, *final)
+	checkpointDB = nil
+	*final = false
+
+	ms := newModelSettings(data)
+	ms.fixw = true
+	ms.startF = ""
+	m0, err := ms.createInitalized(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setStart(m0, test.H0.MaxLParameters)
+
+	lrt := 2 * (test.H1.MaxLnL - test.H0.MaxLnL)
+	res := &BootstrapSummary{
+		Replicates: *bootstrap,
+		NullLRT:    make([]float64, *bootstrap),
+	}
+	nExceed := 0
+	for i := range res.NullLRT {
+		log.Noticef("Bootstrap replicate %d/%d", i+1, *bootstrap)
+		seqs, _ := m0.Simulate(data.Length())
+		rdata, err := data.Replicate(seqs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rtest := performSingleTest(rdata)
+		res.NullLRT[i] = 2 * (rtest.H1.MaxLnL - rtest.H0.MaxLnL)
+		log.Noticef("Bootstrap replicate D=%g", res.NullLRT[i])
+		if res.NullLRT[i] >= lrt {
+			nExceed++
+		}
+	}
+	res.PValue = float64(nExceed+1) / float64(*bootstrap+1)
+	log.Noticef("Bootstrap p-value=%g (D=%g)", res.PValue, lrt)
+
+	return res
+}
+
 // performSingleTest preforms a test for given data
 func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 	summary.Tree = data.Tree.ClassString()
@@ -149,6 +366,10 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 	case *model == "M2a":
 		extraPar["omega2"] = 1
 		extraPar["p1prop"] = 1
+	case *model == "M6" || *model == "M10":
+		extraPar["p0"] = 1
+	case *model == "BM" || *model == "CmC" || *model == "M3":
+		// H1 omegas are taken from H0 omega, see sharedPar
 	default:
 		log.Fatalf("Unknown model '%v'", *model)
 	}
@@ -188,6 +409,16 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 	res1.Hypothesis = "H1"
 	summary.Optimizations = append(summary.Optimizations, res1)
 
+	// names of H1 parameters which are equal to an H0 parameter
+	// under the null hypothesis (H1 name -> H0 name)
+	var sharedPar map[string]string
+	switch *model {
+	case "BM", "M3":
+		sharedPar = sharedParameters(m1, "omega", "omega")
+	case "CmC":
+		sharedPar = sharedParameters(m1, "omega2_", "omega2")
+	}
+
 	var l0, l1 float64
 	l0 = res0.Optimizer.GetMaxLikelihood()
 	l1 = res1.Optimizer.GetMaxLikelihood()
@@ -209,10 +440,7 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 			updated = true
 			justUpdatedH0 = false
 
-			h0par := res0.Optimizer.GetMaxLikelihoodParameters()
-			for parName, parVal := range extraPar {
-				h0par[parName] = parVal
-			}
+			h0par := h1Start(res0.Optimizer.GetMaxLikelihoodParameters(), extraPar, sharedPar)
 
 			log.Noticef("Rerunning H1 because of negative LR (D=%g)",
 				lrt)
@@ -245,10 +473,7 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 			// H1-like point
 			justUpdatedH0 = true
 
-			h1par := res1.Optimizer.GetMaxLikelihoodParameters()
-			for parName := range extraPar {
-				delete(h1par, parName)
-			}
+			h1par := h0Start(res1.Optimizer.GetMaxLikelihoodParameters(), extraPar, sharedPar)
 
 			log.Noticef("Rerunning H0, trying to reduce LR (D=%g)",
 				lrt)
@@ -267,10 +492,7 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 	// get rid of sligtly positive LRT; this should require maximum one extra
 	// likelihood computation
 	if lrt := 2 * (l1 - l0); lrt > minLrt && (lrt <= *sThr || !*thorough) && !finalAvail {
-		h1par := res1.Optimizer.GetMaxLikelihoodParameters()
-		for parName := range extraPar {
-			delete(h1par, parName)
-		}
+		h1par := h0Start(res1.Optimizer.GetMaxLikelihoodParameters(), extraPar, sharedPar)
 
 		o0.method = "none"
 		log.Noticef("Rerunning H0, trying to reduce LR (D=%g)",
@@ -288,10 +510,7 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 	// one last round of getting rid of negative lrt, maximum one extra
 	// likelihood computation
 	if lrt := 2 * (l1 - l0); lrt < 0 && !finalAvail {
-		h0par := res0.Optimizer.GetMaxLikelihoodParameters()
-		for parName, parVal := range extraPar {
-			h0par[parName] = parVal
-		}
+		h0par := h1Start(res0.Optimizer.GetMaxLikelihoodParameters(), extraPar, sharedPar)
 
 		o1.method = "none"
 
@@ -357,5 +576,16 @@ func performSingleTest(data *cmodel.Data) (summary HypTestSummary) {
 		summary.H0.MaxLnL,
 		summary.H1.MaxLnL)
 
+	summary.D = 2 * (summary.H1.MaxLnL - summary.H0.MaxLnL)
+	summary.DF = len(m1.GetFloatParameters()) - len(m0.GetFloatParameters())
+	summary.NullDistribution, summary.PValue = lrtPValue(summary.D, summary.DF)
+	if summary.PValue != nil {
+		log.Noticef("D=%g, df=%d, p-value=%g (%s)",
+			summary.D, summary.DF, *summary.PValue, summary.NullDistribution)
+	} else {
+		log.Noticef("D=%g, df=%d, no asymptotic p-value, use --bootstrap",
+			summary.D, summary.DF)
+	}
+
 	return
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAdjustPValues(tst *testing.T) {
+	p := []float64{0.001, 0.04, 0.03, 0.5, 0.02}
+	// reference values are from R p.adjust
+	refBonferroni := []float64{0.005, 0.2, 0.15, 1, 0.1}
+	refHolm := []float64{0.005, 0.09, 0.09, 0.5, 0.08}
+	refBH := []float64{0.005, 0.05, 0.05, 0.5, 0.05}
+
+	bonferroni, holm, bh := adjustPValues(p)
+	for i := range p {
+		if math.Abs(bonferroni[i]-refBonferroni[i]) > 1e-10 {
+			tst.Error("Bonferroni: expected", refBonferroni[i], "got", bonferroni[i])
+		}
+		if math.Abs(holm[i]-refHolm[i]) > 1e-10 {
+			tst.Error("Holm: expected", refHolm[i], "got", holm[i])
+		}
+		if math.Abs(bh[i]-refBH[i]) > 1e-10 {
+			tst.Error("BH: expected", refBH[i], "got", bh[i])
+		}
+	}
+}
+
+func TestLRTPValue(tst *testing.T) {
+	defer func(m string) { *model = m }(*model)
+
+	for _, t := range []struct {
+		model string
+		d     float64
+		df    int
+		p     float64
+	}{
+		// 50:50 mixture of 0 and chi2_1
+		{"BS", 2.705543, 1, 0.05},
+		{"M8", 2.705543, 1, 0.05},
+		// chi2
+		{"M2a", 5.991465, 2, 0.05},
+		{"M3", 9.487729, 4, 0.05},
+		{"BS", 0, 1, 1},
+	} {
+		*model = t.model
+		name, p := lrtPValue(t.d, t.df)
+		if p == nil || math.Abs(*p-t.p) > 1e-6 {
+			tst.Error(t.model, ": expected p-value", t.p, "got", p, "(", name, ")")
+		}
+	}
+
+	// no valid asymptotic null distribution
+	for _, m := range []string{"M6", "M10"} {
+		*model = m
+		if _, p := lrtPValue(10, 2); p != nil {
+			tst.Error(m, ": expected no p-value, got", *p)
+		}
+	}
+}
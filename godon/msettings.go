@@ -13,14 +13,17 @@ type modelSettings struct {
 	data         *cmodel.Data
 	fixw         bool
 	ncatb        int
+	ncatw        int
 	ncatsr       int
 	ncatcr       int
 	proportional bool
+	freeRatio    bool
 
 	noOptBrLen  bool
 	maxBrLen    float64
 	aggModeName string
 	aggMode     cmodel.AggMode
+	noCache     bool
 
 	startF    string
 	randomize bool
@@ -34,13 +37,16 @@ func newModelSettings(data *cmodel.Data) *modelSettings {
 		data:         data,
 		fixw:         *fixw,
 		ncatb:        *ncatb,
+		ncatw:        *ncatw,
 		ncatsr:       *ncatsr,
 		ncatcr:       *ncatcr,
 		proportional: *proportional,
+		freeRatio:    *freeRatio,
 
 		noOptBrLen:  *noOptBrLen,
 		maxBrLen:    *maxBrLen,
 		aggModeName: *aggregate,
+		noCache:     *noCache,
 
 		startF:    *startF,
 		randomize: *randomize,
@@ -62,6 +68,22 @@ func (ms *modelSettings) createModel(copy bool) (cmodel.TreeOptimizableSiteClass
 		mname = "M1a"
 	}
 
+	if ms.name == "CmC" && ms.fixw == true {
+		mname = "M2a_rel"
+	}
+
+	if ms.name == "M3" && ms.fixw == true {
+		mname = "M0"
+	}
+
+	if ms.name == "M6" && ms.fixw == true {
+		mname = "M5"
+	}
+
+	if ms.name == "M10" && ms.fixw == true {
+		mname = "M7"
+	}
+
 	switch mname {
 	case "M0":
 		log.Info("Using M0 model")
@@ -77,6 +99,46 @@ func (ms *modelSettings) createModel(copy bool) (cmodel.TreeOptimizableSiteClass
 		log.Info("Using M2a model")
 		log.Infof("%d site gamma categories, %d codon rate categories", ms.ncatsr, ms.ncatcr)
 		return cmodel.NewM2(data, true, ms.ncatsr, ms.ncatcr), nil
+	case "M2a_rel":
+		log.Info("Using M2a_rel model")
+		log.Infof("%d site gamma categories, %d codon rate categories", ms.ncatsr, ms.ncatcr)
+		return cmodel.NewM2Rel(data, ms.ncatsr, ms.ncatcr), nil
+	case "CmC":
+		log.Info("Using clade model C")
+		log.Infof("%d site gamma categories, %d codon rate categories", ms.ncatsr, ms.ncatcr)
+		return cmodel.NewCladeModel(data, false, ms.ncatsr, ms.ncatcr), nil
+	case "CmD":
+		log.Info("Using clade model D")
+		log.Infof("%d site gamma categories, %d codon rate categories", ms.ncatsr, ms.ncatcr)
+		return cmodel.NewCladeModel(data, true, ms.ncatsr, ms.ncatcr), nil
+	case "M3":
+		log.Info("Using M3 model")
+		log.Infof("%d omega categories", ms.ncatw)
+		if ms.ncatw < 2 {
+			return nil, errors.New("M3 requires at least two omega categories")
+		}
+		return cmodel.NewM3(data, ms.ncatw), nil
+	case "M5":
+		log.Info("Using M5 model")
+		log.Infof("%d gamma categories", ms.ncatw)
+		if ms.ncatw < 2 {
+			return nil, errors.New("M5 requires at least two gamma categories")
+		}
+		return cmodel.NewM5(data, ms.ncatw), nil
+	case "M6":
+		log.Info("Using M6 model")
+		log.Infof("%d gamma categories", ms.ncatw)
+		if ms.ncatw < 2 {
+			return nil, errors.New("M6 requires at least two gamma categories")
+		}
+		return cmodel.NewM6(data, ms.ncatw), nil
+	case "M10":
+		log.Info("Using M10 model")
+		log.Infof("%d beta categories, %d gamma categories", ms.ncatb, ms.ncatw)
+		if ms.ncatb < 2 || ms.ncatw < 2 {
+			return nil, errors.New("M10 requires at least two beta and two gamma categories")
+		}
+		return cmodel.NewM10(data, ms.ncatb, ms.ncatw), nil
 	case "M7":
 		log.Info("Using M7 model")
 		log.Infof("%d beta categories, %d site gamma categories, %d codon rate categories", ms.ncatb, ms.ncatsr, ms.ncatcr)
@@ -101,6 +163,16 @@ func (ms *modelSettings) createModel(copy bool) (cmodel.TreeOptimizableSiteClass
 	case "BS":
 		log.Info("Using branch site model")
 		return cmodel.NewBranchSite(data, ms.fixw), nil
+	case "BM":
+		switch {
+		case ms.fixw:
+			log.Info("Using one-ratio branch model")
+		case ms.freeRatio:
+			log.Info("Using free-ratio branch model")
+		default:
+			log.Info("Using branch model")
+		}
+		return cmodel.NewBranchModel(data, ms.fixw, ms.freeRatio), nil
 	}
 	return nil, errors.New("Unknown model specification")
 }
@@ -154,6 +226,11 @@ func (ms *modelSettings) createInitalized(copy bool) (cmodel.TreeOptimizableSite
 	}
 	m.SetAggregationMode(ms.aggMode)
 
+	if ms.noCache {
+		log.Info("Partial likelihood cache is disabled")
+		m.SetCache(false)
+	}
+
 	if ms.startF != "" {
 		l, err := lastLine(ms.startF)
 		par := m.GetFloatParameters()
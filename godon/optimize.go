@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"bitbucket.org/Davydov/godon/checkpoint"
 	"bitbucket.org/Davydov/godon/cmodel"
@@ -15,17 +16,54 @@ func newData() (*cmodel.Data, error) {
 		return nil, err
 	}
 
+	err = setupData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// setupData applies command line parameters to data.
+func setupData(data *cmodel.Data) (err error) {
 	if !*noOptBrLen {
 		err = data.Unroot()
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	if len(*cFreqFileName) > 0 {
 		err := data.SetCodonFreqFromFile(*cFreqFileName)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+
+	err = data.SetCodonModel(*codonModel)
+	if err != nil {
+		return err
+	}
+
+	if *estFreq {
+		err = data.SetEstimateFrequency()
+		if err != nil {
+			return err
+		}
+	}
+
+	if *gtr {
+		data.SetGTR()
+	}
+
+	if *mnm {
+		data.SetMultiNucleotide()
+	}
+
+	if len(*ecmFileName) > 0 {
+		err = data.SetECMFromFile(*ecmFileName)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -39,7 +77,7 @@ func newData() (*cmodel.Data, error) {
 		}
 	}
 
-	return data, nil
+	return nil
 }
 
 // runOptimization runs optimization for model with optimizers
@@ -100,6 +138,9 @@ func runOptimization(m cmodel.TreeOptimizableSiteClass, o *optimizerSettings, st
 	}
 
 	opt.Run(o.iterations)
+	if o.stdErrors {
+		opt.ComputeUncertainty()
+	}
 	summary.Optimizer = opt.Summary()
 
 	opt.PrintResults(quiet)
@@ -169,13 +210,43 @@ func optimization() OptimizationSummary {
 
 	key := []byte(*model + ":" + data.Tree.ShortClassString())
 
+	var profileNames []string
+	if *profileParameters != "" {
+		profileNames = strings.Split(*profileParameters, ",")
+		par := m.GetFloatParameters().GetMap()
+		for _, name := range profileNames {
+			if _, ok := par[name]; !ok {
+				log.Fatalf("Unknown parameter %s", name)
+			}
+		}
+	}
+
 	summary := runOptimization(m, o, nil, 1, key, false)
 
+	if len(profileNames) > 0 {
+		setStart(m, summary.Optimizer.GetMaxLikelihoodParameters())
+		summary.Profiles = profileLikelihood(m, o, profileNames)
+	}
+
 	if *final {
 		m.Final(*neb, *beb, *codonRates, *siteRates, *codonOmega)
 	}
 	summary.Model = m.Summary()
 
+	if *mappingSamples > 0 {
+		log.Noticef("Stochastic mapping (%d samples)", *mappingSamples)
+		mapping, err := m.StochasticMapping(*mappingSamples)
+		if err != nil {
+			log.Error("Stochastic mapping failed:", err)
+		} else {
+			summary.StochasticMapping = mapping
+			log.Infof("Tree with node ids: %s", mapping.Tree)
+			for _, br := range mapping.Branches {
+				log.Infof("br%d: synonymous=%0.3f, nonsynonymous=%0.3f", br.NodeID, br.Synonymous, br.Nonsynonymous)
+			}
+		}
+	}
+
 	if !*noOptBrLen {
 		err := data.Root()
 		if err != nil {
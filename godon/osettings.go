@@ -25,6 +25,8 @@ type optimizerSettings struct {
 	trajF *os.File
 
 	seed int64
+
+	stdErrors bool
 }
 
 // newOptimizerSettings creates a new optimizerSettings from
@@ -46,6 +48,8 @@ func newOptimizerSettings(model cmodel.TreeOptimizableSiteClass) *optimizerSetti
 		trajF: trajF,
 
 		seed: *seed,
+
+		stdErrors: *stdErrors,
 	}
 }
 
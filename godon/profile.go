@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bitbucket.org/Davydov/godon/cmodel"
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// profileLikelihood computes profile likelihoods of the parameters
+// re-optimizing all the other parameters with the optimizer
+// settings. Model should be at the maximum likelihood point.
+func profileLikelihood(m cmodel.TreeOptimizableSiteClass, o *optimizerSettings, names []string) (profiles []*optimize.Profile) {
+	maximize := func(f optimize.Optimizable) float64 {
+		opt, err := o.create()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opt.SetOptimizable(f)
+		opt.Run(o.iterations)
+		par := f.GetFloatParameters()
+		err = par.SetFromMap(opt.Summary().GetMaxLikelihoodParameters())
+		if err != nil {
+			log.Error("Error setting maximum likelihood parameters:", err)
+		}
+		return opt.GetMaxL()
+	}
+
+	for _, name := range names {
+		log.Noticef("Computing profile likelihood for %s", name)
+		p, err := optimize.ProfileLikelihood(m, name, maximize)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Noticef("%s: profile 95%% CI=[%v, %v]", name, p.CI[0], p.CI[1])
+		profiles = append(profiles, p)
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/Davydov/godon/optimize"
+)
+
+// scanGridParameter is a grid for a single parameter.
+type scanGridParameter struct {
+	name   string
+	values []float64
+}
+
+// parseGrid parses grid specification in the form
+// name=from:to:step.
+func parseGrid(s string) (g scanGridParameter, err error) {
+	fields := strings.SplitN(s, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return g, fmt.Errorf("wrong grid specification %s (should be name=from:to:step)", s)
+	}
+	g.name = fields[0]
+	fields = strings.Split(fields[1], ":")
+	if len(fields) != 3 {
+		return g, fmt.Errorf("wrong grid specification %s (should be name=from:to:step)", s)
+	}
+	var v [3]float64
+	for i, f := range fields {
+		v[i], err = strconv.ParseFloat(f, 64)
+		if err != nil {
+			return g, fmt.Errorf("wrong grid specification %s: %v", s, err)
+		}
+	}
+	from, to, step := v[0], v[1], v[2]
+	if step <= 0 || to < from {
+		return g, fmt.Errorf("wrong grid specification %s (from should not exceed to and step should be positive)", s)
+	}
+	// small tolerance to include the right end
+	n := int(math.Floor((to-from)/step+1e-9)) + 1
+	g.values = make([]float64, n)
+	for i := range g.values {
+		g.values[i] = from + float64(i)*step
+	}
+	return g, nil
+}
+
+// writeScanTable writes the scan results to a tab-separated file.
+func writeScanTable(filename string, summary ScanSummary) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = fmt.Fprintf(f, "%s\tlnL\n", strings.Join(summary.Parameters, "\t")); err != nil {
+		return err
+	}
+	for _, p := range summary.Points {
+		for _, v := range p.Values {
+			if _, err = fmt.Fprintf(f, "%v\t", v); err != nil {
+				return err
+			}
+		}
+		if _, err = fmt.Fprintf(f, "%v\n", p.LnL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// likelihoodScan computes likelihood on a grid of parameter values.
+func likelihoodScan() (summary ScanSummary) {
+	//transfer options from scan command
+	alignmentFileName = scanAlignmentFileName
+	treeFileName = scanTreeFileName
+	model = scanModel
+
+	if len(*scanGrid) > 2 {
+		log.Fatal("Only one or two parameters can be scanned")
+	}
+
+	data, err := newData()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ms := newModelSettings(data)
+	m, err := ms.createInitalized(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	par := m.GetFloatParameters()
+	pmap := par.GetMap()
+	grid := make([]scanGridParameter, len(*scanGrid))
+	for i, s := range *scanGrid {
+		grid[i], err = parseGrid(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := pmap[grid[i].name]; !ok {
+			log.Fatalf("Unknown parameter %s", grid[i].name)
+		}
+		summary.Parameters = append(summary.Parameters, grid[i].name)
+	}
+	if len(grid) == 2 && grid[0].name == grid[1].name {
+		log.Fatal("Scanned parameters should be different")
+	}
+	// the second parameter is optional
+	if len(grid) == 1 {
+		grid = append(grid, scanGridParameter{values: []float64{0}})
+	}
+
+	// fixed is used for re-optimization
+	fixed := optimize.Fix(m, summary.Parameters...)
+	o := newOptimizerSettings(m)
+	summary.Optimized = *scanOptimize
+
+	// every row starts from the first point of the previous
+	// row, the other points start from the previous point
+	rowStart := par.Values(nil)
+	for _, v1 := range grid[0].values {
+		if err := par.SetValues(rowStart); err != nil {
+			log.Fatal(err)
+		}
+		for j, v2 := range grid[1].values {
+			point := ScanPoint{Values: []float64{v1}}
+			par.SetByName(grid[0].name, v1)
+			if grid[1].name != "" {
+				point.Values = append(point.Values, v2)
+				par.SetByName(grid[1].name, v2)
+			}
+			if !par.InRange() {
+				log.Fatalf("Grid point %v is out of the parameter range", point.Values)
+			}
+
+			if *scanOptimize {
+				opt, err := o.create()
+				if err != nil {
+					log.Fatal(err)
+				}
+				opt.SetOptimizable(fixed)
+				opt.Run(o.iterations)
+				fpar := fixed.GetFloatParameters()
+				err = fpar.SetFromMap(opt.Summary().GetMaxLikelihoodParameters())
+				if err != nil {
+					log.Fatal(err)
+				}
+				point.LnL = opt.GetMaxL()
+				point.Parameters = par.GetMap()
+			} else {
+				point.LnL = m.Likelihood()
+			}
+
+			if j == 0 {
+				rowStart = par.Values(rowStart)
+			}
+
+			log.Infof("%v: lnL=%v", point.Values, point.LnL)
+			summary.Points = append(summary.Points, point)
+		}
+	}
+
+	if *scanTableF != "" {
+		if err := writeScanTable(*scanTableF, summary); err != nil {
+			log.Error("Error writing likelihood table:", err)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseGrid(tst *testing.T) {
+	g, err := parseGrid("kappa=0.5:1.5:0.1")
+	if err != nil {
+		tst.Fatal("Error:", err)
+	}
+	if g.name != "kappa" {
+		tst.Error("Wrong name:", g.name)
+	}
+	if len(g.values) != 11 {
+		tst.Fatal("Wrong number of values:", len(g.values))
+	}
+	if g.values[0] != 0.5 || math.Abs(g.values[10]-1.5) > 1e-10 {
+		tst.Error("Wrong values:", g.values)
+	}
+
+	for _, s := range []string{"kappa", "=1:2:1", "kappa=1:2", "kappa=2:1:0.1", "kappa=1:2:0", "kappa=a:2:1"} {
+		if _, err := parseGrid(s); err == nil {
+			tst.Error("No error for", s)
+		}
+	}
+}
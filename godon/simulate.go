@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"bitbucket.org/Davydov/godon/cmodel"
+)
+
+// parseParameters converts parameter values given in the command line
+// to a map, all the names should be model parameters.
+func parseParameters(m cmodel.TreeOptimizableSiteClass, par map[string]string) (map[string]float64, error) {
+	names := m.GetFloatParameters().GetMap()
+	res := make(map[string]float64, len(par))
+	for name, s := range par {
+		if _, ok := names[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("wrong value for parameter %s: %v", name, err)
+		}
+		res[name] = v
+	}
+	return res, nil
+}
+
+// simulation simulates a codon alignment.
+func simulation() (summary SimulationSummary) {
+	//transfer options from simulate command
+	treeFileName = simTreeFileName
+	model = simModel
+
+	var data *cmodel.Data
+	var err error
+	if *simAlignmentF != "" {
+		alignmentFileName = simAlignmentF
+		data, err = newData()
+	} else {
+		// only equal frequencies can be used without an
+		// alignment
+		if cFreqSet && *cFreq != "F0" && *cFreqFileName == "" {
+			log.Fatalf("%s codon frequency requires a template alignment (--template)", *cFreq)
+		}
+		data, err = cmodel.NewTreeData(*gcodeID, *treeFileName)
+		if err == nil {
+			err = setupData(data)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	length := *simLength
+	if length == 0 && *simAlignmentF != "" {
+		length = data.Length()
+	}
+	if length <= 0 {
+		log.Fatal("Alignment length should be specified (--length)")
+	}
+
+	ms := newModelSettings(data)
+	m, err := ms.createInitalized(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *simSummaryF != "" {
+		par, err := readSummaryParameters(*simSummaryF)
+		if err != nil {
+			log.Fatal("Error reading summary:", err)
+		}
+		setStart(m, par)
+	}
+
+	if len(*simParameters) > 0 {
+		par, err := parseParameters(m, *simParameters)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range m.GetFloatParameters() {
+			if v, ok := par[p.Name()]; ok {
+				p.Set(v)
+			}
+		}
+	}
+
+	par := m.GetFloatParameters()
+	if !par.InRange() {
+		log.Fatal("Parameters are not in the range")
+	}
+
+	summary.Parameters = par.GetMap()
+	logParameters(m)
+	summary.Tree = data.Tree.BrString()
+	log.Infof("Tree with node ids: %s", summary.Tree)
+
+	log.Noticef("Simulating %d codons", length)
+	seqs, classes := m.Simulate(length)
+	summary.SiteClasses = classes
+
+	f, err := os.Create(*simOutF)
+	if err != nil {
+		log.Fatal("Error creating alignment file:", err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(seqs.String() + "\n"); err != nil {
+		log.Fatal(err)
+	}
+
+	if *simClassesF != "" {
+		f, err := os.Create(*simClassesF)
+		if err != nil {
+			log.Fatal("Error creating site classes file:", err)
+		}
+		defer f.Close()
+		for _, class := range classes {
+			if _, err = fmt.Fprintln(f, class); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return
+}
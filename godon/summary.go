@@ -1,6 +1,9 @@
 package main
 
-import "bitbucket.org/Davydov/godon/optimize"
+import (
+	"bitbucket.org/Davydov/godon/cmodel"
+	"bitbucket.org/Davydov/godon/optimize"
+)
 
 // CallSummary stores summary of program call.
 type CallSummary struct {
@@ -32,6 +35,12 @@ type OptimizationSummary struct {
 	Model interface{} `json:"model,omitempty"`
 	// Optimizers is an array of summary of all optimizers used.
 	Optimizer optimize.Summary `json:"optimizer"`
+	// StochasticMapping is the expected number of substitutions
+	// per branch (only if requested).
+	StochasticMapping *cmodel.SubstitutionMapping `json:"stochasticMapping,omitempty"`
+	// Profiles are the profile likelihoods of the parameters
+	// (only if requested).
+	Profiles []*optimize.Profile `json:"profiles,omitempty"`
 	// Hypothesis is H0 or H1
 	Hypothesis string `json:"hypothesis,omitempty"`
 }
@@ -44,8 +53,46 @@ type HypTestSummary struct {
 	H0 HypSummary
 	// H1 is the result of H1 run.
 	H1 HypSummary
+	// D is the likelihood ratio test statistic.
+	D float64 `json:"D"`
+	// DF is the number of degrees of freedom.
+	DF int `json:"df"`
+	// NullDistribution is the asymptotic null distribution of D.
+	NullDistribution string `json:"nullDistribution"`
+	// PValue is the p-value computed using the null distribution
+	// (nil if there is no valid asymptotic null distribution).
+	PValue *float64 `json:"pValue,omitempty"`
 	// Optimizations stores the optimization
 	Optimizations []OptimizationSummary `json:"testOptimizations,omitempty"`
+	// Bootstrap is the parametric bootstrap result (if requested).
+	Bootstrap *BootstrapSummary `json:"bootstrap,omitempty"`
+	// Branch is the foreground branch id (multiple branches
+	// testing).
+	Branch int `json:"foregroundBranch,omitempty"`
+	// Adjusted are the p-values adjusted for the multiple testing
+	// (multiple branches testing).
+	Adjusted *AdjustedPValues `json:"adjustedPValues,omitempty"`
+}
+
+// AdjustedPValues stores p-values adjusted for the multiple testing.
+type AdjustedPValues struct {
+	// Bonferroni is the Bonferroni adjusted p-value.
+	Bonferroni float64 `json:"bonferroni"`
+	// Holm is the Holm adjusted p-value.
+	Holm float64 `json:"holm"`
+	// BH is the Benjamini-Hochberg adjusted p-value (FDR).
+	BH float64 `json:"BH"`
+}
+
+// BootstrapSummary stores the parametric bootstrap results.
+type BootstrapSummary struct {
+	// Replicates is the number of replicates.
+	Replicates int `json:"replicates"`
+	// NullLRT are the LRT statistics for the replicates simulated
+	// under H0.
+	NullLRT []float64 `json:"nullLRT"`
+	// PValue is the empirical p-value.
+	PValue float64 `json:"pValue"`
 }
 
 // HypSummary summary stores information on one hypothesis
@@ -57,3 +104,45 @@ type HypSummary struct {
 	// Model is the model summary, including BEB and NEB if available.
 	Final interface{} `json:"final,omitempty"`
 }
+
+// AncestralSummary stores ancestral sequence reconstruction results.
+type AncestralSummary struct {
+	// LnL is the log-likelihood of the model used for the reconstruction.
+	LnL float64 `json:"lnL"`
+	// Tree is the tree with node ids.
+	Tree string `json:"tree"`
+	// Nodes is the reconstruction for every internal node.
+	Nodes []cmodel.AncestralNode `json:"nodes"`
+}
+
+// SimulationSummary stores information on the simulated alignment.
+type SimulationSummary struct {
+	// Tree is the tree with node ids.
+	Tree string `json:"tree"`
+	// Parameters are the model parameter values used.
+	Parameters map[string]float64 `json:"parameters"`
+	// SiteClasses is the site class of every codon.
+	SiteClasses []int `json:"siteClasses"`
+}
+
+// ScanSummary stores the likelihood computed on a parameter grid.
+type ScanSummary struct {
+	// Parameters are the names of the scanned parameters.
+	Parameters []string `json:"parameters"`
+	// Optimized is true if the other parameters were
+	// re-optimized at every grid point.
+	Optimized bool `json:"optimized"`
+	// Points are the grid points.
+	Points []ScanPoint `json:"points"`
+}
+
+// ScanPoint is a point of the likelihood grid.
+type ScanPoint struct {
+	// Values are the values of the scanned parameters.
+	Values []float64 `json:"values"`
+	// LnL is the likelihood value.
+	LnL float64 `json:"lnL"`
+	// Parameters are the values of all the parameters (only if
+	// re-optimized).
+	Parameters map[string]float64 `json:"parameters,omitempty"`
+}
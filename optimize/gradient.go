@@ -0,0 +1,114 @@
+package optimize
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Threaded is an Optimizable which can limit the number of threads
+// used for a single likelihood computation.
+type Threaded interface {
+	Optimizable
+	// SetThreads limits the number of threads, zero means all
+	// the available threads.
+	SetThreads(n int)
+}
+
+// Cached is an Optimizable which caches intermediate results of the
+// likelihood computation.
+type Cached interface {
+	Optimizable
+	// SetCache enables or disables the cache.
+	SetCache(enabled bool)
+}
+
+// gradient computes derivatives of the log-likelihood at point x.
+// Parameters should be already set to x and L is the likelihood at
+// x. Derivatives from analytic are used if available, the other
+// derivatives are computed using forward finite differences with
+// step dH. Finite differences are computed concurrently on copies of
+// the optimizable, the available threads are split between the
+// copies. Caching is disabled for the copies, since every
+// finite difference changes a single parameter and resets it.
+func (o *BaseOptimizer) gradient(x []float64, L, dH float64, analytic map[string]float64, grad []float64) {
+	var comps []int
+	for i, par := range o.parameters {
+		if g, ok := analytic[par.Name()]; ok {
+			grad[i] = g
+			continue
+		}
+		comps = append(comps, i)
+	}
+	if len(comps) == 0 {
+		return
+	}
+
+	nThreads := runtime.GOMAXPROCS(0)
+	nModels := nThreads
+	if nModels > len(comps) {
+		nModels = len(comps)
+	}
+	models := []Optimizable{o.Optimizable}
+	if nModels > 1 {
+		for len(o.gradCopies) < nModels-1 {
+			c := o.Optimizable.Copy()
+			if c, ok := c.(Cached); ok {
+				c.SetCache(false)
+			}
+			o.gradCopies = append(o.gradCopies, c)
+		}
+		models = append(models, o.gradCopies[:nModels-1]...)
+		for _, m := range models {
+			if t, ok := m.(Threaded); ok {
+				t.SetThreads(nThreads / nModels)
+			}
+		}
+		// the optimizable uses all the threads by default
+		if t, ok := o.Optimizable.(Threaded); ok {
+			defer t.SetThreads(0)
+		}
+	}
+
+	tasks := make(chan int, len(comps))
+	for _, i := range comps {
+		tasks <- i
+	}
+	close(tasks)
+
+	var wg sync.WaitGroup
+	for j, m := range models {
+		wg.Add(1)
+		go func(m Optimizable, isCopy bool) {
+			defer wg.Done()
+			parameters := m.GetFloatParameters()
+			if isCopy {
+				if err := parameters.SetValues(x); err != nil {
+					panic(err)
+				}
+			}
+			for i := range tasks {
+				inv := false
+				v := x[i] + dH
+
+				// this shouldn't happen with current boundaries
+				// but to be safe
+				if v >= parameters[i].GetMax() {
+					v = x[i] - dH
+					inv = true
+				}
+
+				parameters[i].Set(v)
+				L2 := m.Likelihood()
+
+				grad[i] = (L2 - L) / dH
+				if inv {
+					grad[i] = -grad[i]
+				}
+
+				parameters[i].Set(x[i])
+			}
+		}(m, j > 0)
+	}
+	wg.Wait()
+	o.calls += len(comps)
+}
@@ -0,0 +1,172 @@
+package optimize
+
+import (
+	"math"
+
+	"github.com/gonum/matrix/mat64"
+)
+
+const (
+	// hessianStep is the relative step size for the finite
+	// difference Hessian computation.
+	hessianStep = 1e-3
+	// hessianMinScale is the minimal parameter scale used for
+	// the step size computation.
+	hessianMinScale = 1e-2
+	// waldZ is the standard normal quantile for the 95% Wald
+	// confidence intervals.
+	waldZ = 1.959964
+)
+
+// Uncertainty stores standard errors and confidence intervals
+// computed from the observed information matrix.
+type Uncertainty struct {
+	// Names are the names of the parameters for which standard
+	// errors were computed (in the correlation matrix order).
+	Names []string `json:"names"`
+	// StdErr are the standard errors.
+	StdErr map[string]float64 `json:"stdErr"`
+	// CI are the 95% Wald confidence intervals clipped to the
+	// parameter boundaries.
+	CI map[string][2]float64 `json:"ci95"`
+	// Clipped are the parameters for which the Wald intervals
+	// exceeded the boundaries and were clipped.
+	Clipped []string `json:"clipped,omitempty"`
+	// Correlation is the correlation matrix of the estimates.
+	Correlation [][]float64 `json:"correlation"`
+	// AtBound are the parameters at their boundaries, Wald
+	// intervals are not valid for them and they are excluded
+	// from the computations.
+	AtBound []string `json:"atBound,omitempty"`
+}
+
+// hessianSteps returns step sizes for the finite differences; zero
+// step means the parameter cannot be varied (discrete or at the
+// boundary).
+func hessianSteps(par FloatParameters) []float64 {
+	h := make([]float64, len(par))
+	for i, p := range par {
+		if _, ok := p.(*DiscreteParameter); ok {
+			continue
+		}
+		x := p.Get()
+		step := hessianStep * math.Max(math.Abs(x), hessianMinScale)
+		if x-p.GetMin() < step || p.GetMax()-x < step {
+			continue
+		}
+		h[i] = step
+	}
+	return h
+}
+
+// Hessian computes the Hessian matrix of the log-likelihood using
+// central finite differences with respect to the parameters with
+// non-zero steps. Parameter values are restored after the
+// computation.
+func Hessian(opt Optimizable, h []float64) *mat64.Dense {
+	par := opt.GetFloatParameters()
+	x := par.Values(nil)
+	defer func() {
+		if err := par.SetValues(x); err != nil {
+			panic(err)
+		}
+	}()
+
+	// l computes likelihood with parameters i and j shifted by
+	// di and dj steps
+	l := func(i, j int, di, dj float64) float64 {
+		par[i].Set(x[i] + di*h[i])
+		if j != i {
+			par[j].Set(x[j] + dj*h[j])
+		}
+		res := opt.Likelihood()
+		par[i].Set(x[i])
+		par[j].Set(x[j])
+		return res
+	}
+
+	n := len(par)
+	hess := mat64.NewDense(n, n, nil)
+	l0 := opt.Likelihood()
+	for i := 0; i < n; i++ {
+		if h[i] == 0 {
+			continue
+		}
+		v := (l(i, i, 1, 0) - 2*l0 + l(i, i, -1, 0)) / (h[i] * h[i])
+		hess.Set(i, i, v)
+		for j := 0; j < i; j++ {
+			if h[j] == 0 {
+				continue
+			}
+			v := (l(i, j, 1, 1) - l(i, j, 1, -1) - l(i, j, -1, 1) + l(i, j, -1, -1)) / (4 * h[i] * h[j])
+			hess.Set(i, j, v)
+			hess.Set(j, i, v)
+		}
+	}
+	return hess
+}
+
+// ComputeUncertainty computes standard errors, 95% Wald confidence
+// intervals and the correlation matrix of the parameter estimates
+// using the observed information matrix (the negative Hessian)
+// at the current parameter values. Confidence intervals are clipped
+// to the parameter boundaries.
+func ComputeUncertainty(opt Optimizable) (*Uncertainty, error) {
+	par := opt.GetFloatParameters()
+	h := hessianSteps(par)
+	hess := Hessian(opt, h)
+
+	res := &Uncertainty{
+		StdErr: make(map[string]float64),
+		CI:     make(map[string][2]float64),
+	}
+	var idx []int
+	for i, p := range par {
+		if h[i] == 0 {
+			if _, ok := p.(*DiscreteParameter); !ok {
+				res.AtBound = append(res.AtBound, p.Name())
+			}
+			continue
+		}
+		idx = append(idx, i)
+		res.Names = append(res.Names, p.Name())
+	}
+
+	info := mat64.NewDense(len(idx), len(idx), nil)
+	for k1, i := range idx {
+		for k2, j := range idx {
+			info.Set(k1, k2, -hess.At(i, j))
+		}
+	}
+
+	var cov mat64.Dense
+	if err := cov.Inverse(info); err != nil {
+		return nil, err
+	}
+
+	res.Correlation = make([][]float64, len(idx))
+	for k1, i := range idx {
+		res.Correlation[k1] = make([]float64, len(idx))
+		v := cov.At(k1, k1)
+		if v <= 0 {
+			log.Warningf("Observed information is not positive definite for %s", par[i].Name())
+			continue
+		}
+		se := math.Sqrt(v)
+		x := par[i].Get()
+		res.StdErr[par[i].Name()] = se
+		lo, hi := x-waldZ*se, x+waldZ*se
+		if lo < par[i].GetMin() || hi > par[i].GetMax() {
+			lo = math.Max(lo, par[i].GetMin())
+			hi = math.Min(hi, par[i].GetMax())
+			res.Clipped = append(res.Clipped, par[i].Name())
+		}
+		res.CI[par[i].Name()] = [2]float64{lo, hi}
+		for k2 := range idx {
+			if w := cov.At(k2, k2); w > 0 {
+				res.Correlation[k1][k2] = cov.At(k1, k2) / math.Sqrt(v*w)
+			}
+		}
+	}
+	return res, nil
+}
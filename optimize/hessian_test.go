@@ -0,0 +1,83 @@
+package optimize
+
+import (
+	"math"
+	"testing"
+)
+
+// normalOptimizable is a bivariate normal log-density (with the
+// variances 4 and 1 and the correlation 0.6) with an extra parameter
+// at the boundary.
+type normalOptimizable struct {
+	a, b, c    float64
+	parameters FloatParameters
+}
+
+func newNormalOptimizable() *normalOptimizable {
+	n := &normalOptimizable{a: 1, b: -1}
+	for _, p := range []*BasicFloatParameter{
+		NewBasicFloatParameter(&n.a, "a"),
+		NewBasicFloatParameter(&n.b, "b"),
+		NewBasicFloatParameter(&n.c, "c"),
+	} {
+		p.SetMin(-10)
+		p.SetMax(10)
+		n.parameters.Append(p)
+	}
+	n.parameters[2].(*BasicFloatParameter).SetMin(0)
+	return n
+}
+
+func (n *normalOptimizable) GetFloatParameters() FloatParameters {
+	return n.parameters
+}
+
+func (n *normalOptimizable) Copy() Optimizable {
+	return newNormalOptimizable()
+}
+
+func (n *normalOptimizable) Likelihood() float64 {
+	// inverse of [[4, 1.2], [1.2, 1]]
+	det := 4 - 1.2*1.2
+	x, y := n.a-1, n.b+1
+	return -0.5*(x*x*1/det-2*x*y*1.2/det+y*y*4/det) - n.c
+}
+
+func TestComputeUncertainty(tst *testing.T) {
+	n := newNormalOptimizable()
+	u, err := ComputeUncertainty(n)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if math.Abs(u.StdErr["a"]-2) > 1e-6 || math.Abs(u.StdErr["b"]-1) > 1e-6 {
+		tst.Error("Wrong standard errors:", u.StdErr)
+	}
+	if math.Abs(u.Correlation[0][1]-0.6) > 1e-6 {
+		tst.Error("Wrong correlation:", u.Correlation)
+	}
+	if math.Abs(u.CI["a"][0]-(1-waldZ*2)) > 1e-6 {
+		tst.Error("Wrong confidence interval:", u.CI["a"])
+	}
+	if len(u.AtBound) != 1 || u.AtBound[0] != "c" {
+		tst.Error("Parameter at the boundary is not detected:", u.AtBound)
+	}
+	if n.a != 1 || n.b != -1 {
+		tst.Error("Parameter values were not restored")
+	}
+	if len(u.Clipped) != 0 {
+		tst.Error("Unexpected clipped intervals:", u.Clipped)
+	}
+
+	// the interval for a exceeds the lower boundary
+	n.parameters[0].(*BasicFloatParameter).SetMin(-1)
+	u, err = ComputeUncertainty(n)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if u.CI["a"][0] != -1 || math.Abs(u.CI["a"][1]-(1+waldZ*2)) > 1e-6 {
+		tst.Error("Wrong clipped confidence interval:", u.CI["a"])
+	}
+	if len(u.Clipped) != 1 || u.Clipped[0] != "a" {
+		tst.Error("Clipped interval is not reported:", u.Clipped)
+	}
+}
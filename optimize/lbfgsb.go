@@ -62,7 +62,9 @@ func (l *LBFGSB) EvaluateFunction(x []float64) float64 {
 	return -L
 }
 
-// EvaluateGradient evaluates gradient for point x.
+// EvaluateGradient evaluates gradient for point x. If the
+// optimizable is Differentiable, analytic derivatives are used, and
+// finite differences are computed only for the other parameters.
 func (l *LBFGSB) EvaluateGradient(x []float64) (grad []float64) {
 	if l.grad == nil {
 		l.grad = make([]float64, len(x))
@@ -74,37 +76,27 @@ func (l *LBFGSB) EvaluateGradient(x []float64) (grad []float64) {
 		panic(err)
 	}
 
-	l1 := -l.Likelihood()
+	var L float64
+	var analytic map[string]float64
+	if d, ok := l.Optimizable.(Differentiable); ok {
+		L, analytic = d.Gradient()
+	} else {
+		L = l.Likelihood()
+	}
 	l.calls++
-	for i := range x {
-		inv := false
-		v := x[i] + l.dH
-
-		// this shouldn't happen with current boundaries
-		// but to be safe
-		if v >= l.parameters[i].GetMax() {
-			v = x[i] - l.dH
-			inv = true
-		}
-
-		l.parameters[i].Set(v)
-		l2 := -l.Likelihood()
-		l.calls++
-
-		grad[i] = (l2 - l1) / l.dH
-		if inv {
-			grad[i] = -grad[i]
-		}
-
-		l.parameters[i].Set(x[i])
-
-		select {
-		case s := <-l.sig:
-			log.Fatal("Received signal exiting:", s)
-		default:
-		}
 
+	l.gradient(x, L, l.dH, analytic, grad)
+	// we minimize negative likelihood
+	for i := range grad {
+		grad[i] = -grad[i]
+	}
+
+	select {
+	case s := <-l.sig:
+		log.Fatal("Received signal exiting:", s)
+	default:
 	}
+
 	log.Debugf("Grad(%v)=%v", l.parameters.Values(nil), grad)
 	return
 }
@@ -0,0 +1,100 @@
+package optimize
+
+import (
+	"math"
+	"runtime"
+	"testing"
+)
+
+// differentiableNormal is normalOptimizable with the analytic
+// derivative for parameter a.
+type differentiableNormal struct {
+	*normalOptimizable
+}
+
+func (n differentiableNormal) Gradient() (float64, map[string]float64) {
+	det := 4 - 1.2*1.2
+	x, y := n.a-1, n.b+1
+	return n.Likelihood(), map[string]float64{"a": -(x - 1.2*y) / det}
+}
+
+func TestLBFGSBGradient(tst *testing.T) {
+	x := []float64{2, 0, 1}
+	det := 4 - 1.2*1.2
+	// gradient of the negative log-likelihood
+	expected := []float64{(1 - 1.2) / det, (-1.2 + 4) / det, 1}
+
+	for _, opt := range []Optimizable{newNormalOptimizable(), differentiableNormal{newNormalOptimizable()}} {
+		l := NewLBFGSB()
+		l.SetOptimizable(opt)
+		grad := l.EvaluateGradient(x)
+		for i, g := range grad {
+			if math.Abs(g-expected[i]) > 1e-5 {
+				tst.Errorf("%T: expected %v, got %v", opt, expected, grad)
+				break
+			}
+		}
+		// one call at x and one per finite difference
+		calls := 4
+		if _, ok := opt.(Differentiable); ok {
+			calls = 3
+		}
+		if l.GetNCalls() != calls {
+			tst.Errorf("%T: expected %d likelihood calls, got %d", opt, calls, l.GetNCalls())
+		}
+	}
+}
+
+// threadedNormal is normalOptimizable which records the number of
+// threads and the cache settings.
+type threadedNormal struct {
+	*normalOptimizable
+	threads *[]int
+	caches  *[]bool
+}
+
+func (n threadedNormal) SetThreads(t int) {
+	*n.threads = append(*n.threads, t)
+}
+
+func (n threadedNormal) SetCache(enabled bool) {
+	*n.caches = append(*n.caches, enabled)
+}
+
+func (n threadedNormal) Copy() Optimizable {
+	return threadedNormal{newNormalOptimizable(), n.threads, n.caches}
+}
+
+func TestGradientCopies(tst *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	var threads []int
+	var caches []bool
+	l := NewLBFGSB()
+	l.SetOptimizable(threadedNormal{newNormalOptimizable(), &threads, &caches})
+	x := []float64{2, 0, 1}
+	grad := l.EvaluateGradient(x)
+	det := 4 - 1.2*1.2
+	expected := []float64{(1 - 1.2) / det, (-1.2 + 4) / det, 1}
+	for i, g := range grad {
+		if math.Abs(g-expected[i]) > 1e-5 {
+			tst.Errorf("Expected %v, got %v", expected, grad)
+			break
+		}
+	}
+	// three components on three models with one thread each,
+	// the optimizable is reset to all the threads
+	if len(l.gradCopies) != 2 {
+		tst.Error("Expected 2 copies, got", len(l.gradCopies))
+	}
+	if len(threads) != 4 || threads[0] != 1 || threads[3] != 0 {
+		tst.Error("Wrong number of threads:", threads)
+	}
+	// cache is disabled for the copies only
+	if len(caches) != 2 || caches[0] || caches[1] {
+		tst.Error("Wrong cache settings:", caches)
+	}
+	if v := l.parameters.Values(nil); v[0] != x[0] || v[1] != x[1] || v[2] != x[2] {
+		tst.Error("Parameters changed:", v)
+	}
+}
@@ -29,44 +29,35 @@ func nloptCallback(n uint, x *C.double, grad *C.double, fData unsafe.Pointer) C.
 
 	xsl := (*[1 << 30]C.double)(unsafe.Pointer(x))[:n:n]
 
+	xf := make([]float64, n)
 	for i := range xsl {
-		nlopt.parameters[i].Set((float64)(xsl[i]))
+		xf[i] = (float64)(xsl[i])
+		nlopt.parameters[i].Set(xf[i])
+	}
+
+	var l1 float64
+	var analytic map[string]float64
+	d, ok := nlopt.Optimizable.(Differentiable)
+	if grad != nil && ok {
+		l1, analytic = d.Gradient()
+	} else {
+		l1 = nlopt.Likelihood()
 	}
-	l1 := nlopt.Likelihood()
 	nlopt.calls++
 	if grad != nil {
 		gradsl := (*[1 << 30]C.double)(unsafe.Pointer(grad))[:n:n]
-	g:
-		for i := range xsl {
-			inv := false
-			v := (float64)(xsl[i]) + nlopt.dH
-
-			// this shouldn't happen with current boundaries
-			// but to be safe
-			if v >= nlopt.parameters[i].GetMax() {
-				v = (float64)(xsl[i]) - nlopt.dH
-				inv = true
-			}
-
-			nlopt.parameters[i].Set(v)
-			l2 := nlopt.Likelihood()
-			nlopt.calls++
-
-			gradsl[i] = (C.double)((l2 - l1) / nlopt.dH)
-			if inv {
-				gradsl[i] = -gradsl[i]
-			}
-
-			nlopt.parameters[i].Set((float64)(xsl[i]))
+		g := make([]float64, n)
+		nlopt.gradient(xf, l1, nlopt.dH, analytic, g)
+		for i, v := range g {
+			gradsl[i] = (C.double)(v)
+		}
 
-			select {
-			case s := <-nlopt.sig:
-				log.Warningf("Received signal (%v), exiting.", s)
-				C.nlopt_force_stop(nlopt.gopt)
-				nlopt.stop = true
-				break g
-			default:
-			}
+		select {
+		case s := <-nlopt.sig:
+			log.Warningf("Received signal (%v), exiting.", s)
+			C.nlopt_force_stop(nlopt.gopt)
+			nlopt.stop = true
+		default:
 		}
 	}
 
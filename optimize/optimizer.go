@@ -33,6 +33,16 @@ type Optimizable interface {
 	Likelihood() float64
 }
 
+// Differentiable is an Optimizable which can compute derivatives of
+// the likelihood with respect to some of the parameters analytically.
+type Differentiable interface {
+	Optimizable
+	// Gradient returns likelihood and its derivatives with respect
+	// to the parameters (by name) for which they can be computed
+	// analytically; other parameters are absent from grad.
+	Gradient() (L float64, grad map[string]float64)
+}
+
 // Optimizer an optimizer interface.
 type Optimizer interface {
 	// SetOptimizable sets model for the optimization.
@@ -66,6 +76,9 @@ type Optimizer interface {
 	PrintResults(quiet bool)
 	// Summary returns optimization summary for JSON output.
 	Summary() Summary
+	// ComputeUncertainty computes standard errors at the maximum
+	// likelihood point.
+	ComputeUncertainty()
 }
 
 // baseSummary stores summary information.
@@ -86,6 +99,9 @@ type baseSummary struct {
 	Status interface{} `json:"status,omitempty"`
 	// OptimizationTime is the optimization time in seconds.
 	OptimizationTime float64 `json:"optimizationTime,omitempty"`
+	// Uncertainty are the standard errors and confidence
+	// intervals (only if computed).
+	Uncertainty *Uncertainty `json:"uncertainty,omitempty"`
 }
 
 // Summary allows quering of maximum likelihood estimates.
@@ -127,12 +143,19 @@ type BaseOptimizer struct {
 	startTime time.Time
 
 	checkpointIO *checkpoint.CheckpointIO
+
+	uncertainty *Uncertainty
+
+	// gradCopies are copies of the optimizable used for
+	// concurrent gradient computations
+	gradCopies []Optimizable
 }
 
 // SetOptimizable sets a model for the optimization.
 func (o *BaseOptimizer) SetOptimizable(opt Optimizable) {
 	o.Optimizable = opt
 	o.parameters = opt.GetFloatParameters()
+	o.gradCopies = nil
 	log.Debug("Parameters:")
 	for _, par := range o.parameters {
 		// debug parameter info
@@ -305,5 +328,45 @@ func (o *BaseOptimizer) Summary() Summary {
 		NIterations:        o.GetNIter(),
 		NCalls:             o.GetNCalls(),
 		OptimizationTime:   o.otime,
+		Uncertainty:        o.uncertainty,
+	}
+}
+
+// ComputeUncertainty computes standard errors and confidence
+// intervals at the maximum likelihood point using the observed
+// information matrix.
+func (o *BaseOptimizer) ComputeUncertainty() {
+	if err := o.parameters.SetValues(o.maxLPar); err != nil {
+		log.Error("Error setting maximum likelihood parameters:", err)
+		return
+	}
+	log.Notice("Computing standard errors")
+	u, err := ComputeUncertainty(o.Optimizable)
+	if err != nil {
+		log.Error("Error computing standard errors:", err)
+		return
+	}
+	o.uncertainty = u
+	for _, name := range u.Names {
+		if brPar.MatchString(name) {
+			continue
+		}
+		se, ok := u.StdErr[name]
+		if !ok {
+			continue
+		}
+		log.Infof("%s: SE=%g, 95%% CI=[%g, %g]", name, se, u.CI[name][0], u.CI[name][1])
+	}
+	for _, name := range u.Clipped {
+		if brPar.MatchString(name) {
+			continue
+		}
+		log.Warningf("Confidence interval for %s is clipped to the parameter boundaries", name)
+	}
+	for _, name := range u.AtBound {
+		if brPar.MatchString(name) {
+			continue
+		}
+		log.Warningf("Parameter %s is at the boundary, no standard error", name)
 	}
 }
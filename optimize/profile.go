@@ -0,0 +1,233 @@
+package optimize
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// profileCutoff is the 95% quantile of the chi-square
+	// distribution with one degree of freedom.
+	profileCutoff = 3.841459
+	// profileStep is the relative size of the first profile
+	// step.
+	profileStep = 0.1
+	// profileGrowth is the factor by which the profile step
+	// increases after every point.
+	profileGrowth = 1.5
+	// profileMaxPoints is the maximum number of profile points
+	// on every side of the maximum.
+	profileMaxPoints = 20
+)
+
+// fixedOptimizable is an optimizable with some of the parameters
+// hidden from the optimizer.
+type fixedOptimizable struct {
+	Optimizable
+	names      []string
+	parameters FloatParameters
+}
+
+// Fix returns an optimizable with the named parameters fixed,
+// i.e. these parameters are not returned by GetFloatParameters
+// and keep their current values during the optimization.
+func Fix(opt Optimizable, names ...string) Optimizable {
+	fixed := make(map[string]bool, len(names))
+	for _, name := range names {
+		fixed[name] = true
+	}
+	f := &fixedOptimizable{
+		Optimizable: opt,
+		names:       names,
+	}
+	for _, p := range opt.GetFloatParameters() {
+		if !fixed[p.Name()] {
+			f.parameters.Append(p)
+		}
+	}
+	return f
+}
+
+// GetFloatParameters returns the parameters which are not fixed.
+func (f *fixedOptimizable) GetFloatParameters() FloatParameters {
+	return f.parameters
+}
+
+// Gradient returns analytic derivatives of the underlying
+// optimizable if it is Differentiable.
+func (f *fixedOptimizable) Gradient() (float64, map[string]float64) {
+	if d, ok := f.Optimizable.(Differentiable); ok {
+		return d.Gradient()
+	}
+	return f.Likelihood(), nil
+}
+
+// SetThreads limits the number of threads of the underlying
+// optimizable if it is Threaded.
+func (f *fixedOptimizable) SetThreads(n int) {
+	if t, ok := f.Optimizable.(Threaded); ok {
+		t.SetThreads(n)
+	}
+}
+
+// SetCache enables or disables the cache of the underlying
+// optimizable if it is Cached.
+func (f *fixedOptimizable) SetCache(enabled bool) {
+	if c, ok := f.Optimizable.(Cached); ok {
+		c.SetCache(enabled)
+	}
+}
+
+// Copy creates a copy of the optimizable with the same parameters
+// fixed.
+func (f *fixedOptimizable) Copy() Optimizable {
+	return Fix(f.Optimizable.Copy(), f.names...)
+}
+
+// ProfilePoint is a point of the profile likelihood curve.
+type ProfilePoint struct {
+	// Value is the parameter value.
+	Value float64 `json:"value"`
+	// LnL is the maximum likelihood with the parameter fixed.
+	LnL float64 `json:"lnL"`
+}
+
+// Profile is the profile likelihood of a parameter.
+type Profile struct {
+	// Parameter is the parameter name.
+	Parameter string `json:"parameter"`
+	// MaxLValue is the parameter value at the maximum of the
+	// profile.
+	MaxLValue float64 `json:"maxLValue"`
+	// MaxLnL is the maximum of the profile likelihood.
+	MaxLnL float64 `json:"maxLnL"`
+	// CI is the 95% profile likelihood confidence interval.
+	CI [2]float64 `json:"ci95"`
+	// Points is the profile likelihood curve.
+	Points []ProfilePoint `json:"points"`
+}
+
+// ProfileLikelihood computes the profile likelihood of the named
+// parameter around the current (maximum likelihood) parameter
+// values. The grid starts at the current value and goes in both
+// directions with increasing steps until the likelihood drops below
+// the chi-square cutoff or the parameter boundary is reached. For
+// every point maximize is called with the optimizable where the
+// parameter is fixed; it should optimize the other parameters, leave
+// them at the maximum and return the maximum likelihood
+// value. Parameter values are restored after the computation.
+func ProfileLikelihood(opt Optimizable, name string, maximize func(Optimizable) float64) (*Profile, error) {
+	all := opt.GetFloatParameters()
+	var par FloatParameter
+	for _, p := range all {
+		if p.Name() == name {
+			par = p
+			break
+		}
+	}
+	if par == nil {
+		return nil, fmt.Errorf("unknown parameter %s", name)
+	}
+	if _, ok := par.(*DiscreteParameter); ok {
+		return nil, fmt.Errorf("cannot profile discrete parameter %s", name)
+	}
+
+	x0 := all.Values(nil)
+	defer func() {
+		if err := all.SetValues(x0); err != nil {
+			panic(err)
+		}
+	}()
+
+	fixed := Fix(opt, name)
+	v0 := par.Get()
+	l0 := opt.Likelihood()
+	res := &Profile{
+		Parameter: name,
+		Points:    []ProfilePoint{{Value: v0, LnL: l0}},
+	}
+
+	for _, dir := range []float64{-1, 1} {
+		if err := all.SetValues(x0); err != nil {
+			return nil, err
+		}
+		step := profileStep * math.Max(math.Abs(v0), hessianMinScale)
+		v := v0
+		for i := 0; i < profileMaxPoints; i++ {
+			v += dir * step
+			step *= profileGrowth
+			last := false
+			if v <= par.GetMin() {
+				v = par.GetMin()
+				last = true
+			}
+			if v >= par.GetMax() {
+				v = par.GetMax()
+				last = true
+			}
+			if v == v0 {
+				// the maximum is at the boundary
+				break
+			}
+			par.Set(v)
+			l := maximize(fixed)
+			log.Infof("profile %s=%v: lnL=%v", name, v, l)
+			if l > l0+1e-3 {
+				log.Warningf("Profile likelihood (%s=%v) is higher than the maximum likelihood, optimization might not have converged", name, v)
+			}
+			res.Points = append(res.Points, ProfilePoint{Value: v, LnL: l})
+			if last || l < l0-profileCutoff/2 {
+				break
+			}
+			if i == profileMaxPoints-1 {
+				log.Warningf("Profile for %s does not reach the cutoff, confidence interval is too narrow", name)
+			}
+		}
+	}
+
+	sort.Slice(res.Points, func(i, j int) bool {
+		return res.Points[i].Value < res.Points[j].Value
+	})
+	res.computeCI()
+	return res, nil
+}
+
+// computeCI computes the maximum and the confidence interval from
+// the profile points. The signed root of the likelihood ratio
+// statistic is linearly interpolated between the points, this is
+// exact for the normal likelihood. If the curve doesn't drop below
+// the cutoff, the last point is used as the interval bound.
+func (p *Profile) computeCI() {
+	imax := 0
+	for i, pt := range p.Points {
+		if pt.LnL > p.Points[imax].LnL {
+			imax = i
+		}
+	}
+	p.MaxLnL = p.Points[imax].LnL
+	p.MaxLValue = p.Points[imax].Value
+
+	// root is the root of the likelihood ratio statistic
+	root := func(pt ProfilePoint) float64 {
+		return math.Sqrt(2 * (p.MaxLnL - pt.LnL))
+	}
+	z := math.Sqrt(profileCutoff)
+
+	// bound finds the interval bound going from the maximum in
+	// the direction dir
+	bound := func(dir int) float64 {
+		prev := p.Points[imax]
+		for i := imax + dir; i >= 0 && i < len(p.Points); i += dir {
+			pt := p.Points[i]
+			if r := root(pt); r >= z {
+				r0 := root(prev)
+				return prev.Value + (pt.Value-prev.Value)*(z-r0)/(r-r0)
+			}
+			prev = pt
+		}
+		return prev.Value
+	}
+
+	p.CI = [2]float64{bound(-1), bound(1)}
+}
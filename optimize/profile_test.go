@@ -0,0 +1,60 @@
+package optimize
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProfileLikelihood(tst *testing.T) {
+	n := newNormalOptimizable()
+	// conditional maximum of b given a
+	maximize := func(opt Optimizable) float64 {
+		n.b = -1 + 1.2/4*(n.a-1)
+		return opt.Likelihood()
+	}
+
+	p, err := ProfileLikelihood(n, "a", maximize)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if p.MaxLValue != 1 || p.MaxLnL != 0 {
+		tst.Error("Wrong profile maximum:", p.MaxLValue, p.MaxLnL)
+	}
+	se := 2.0
+	if math.Abs(p.CI[0]-(1-waldZ*se)) > 1e-5 || math.Abs(p.CI[1]-(1+waldZ*se)) > 1e-5 {
+		tst.Error("Wrong confidence interval:", p.CI)
+	}
+	for i := 1; i < len(p.Points); i++ {
+		if p.Points[i].Value <= p.Points[i-1].Value {
+			tst.Error("Profile points are not sorted")
+		}
+	}
+	if n.a != 1 || n.b != -1 {
+		tst.Error("Parameter values were not restored")
+	}
+
+	// profile at the boundary
+	p, err = ProfileLikelihood(n, "c", maximize)
+	if err != nil {
+		tst.Fatal("Error: ", err)
+	}
+	if p.CI[0] != 0 || math.Abs(p.CI[1]-profileCutoff/2) > 0.1 {
+		tst.Error("Wrong confidence interval at the boundary:", p.CI)
+	}
+
+	if _, err = ProfileLikelihood(n, "d", maximize); err == nil {
+		tst.Error("No error for unknown parameter")
+	}
+}
+
+func TestFix(tst *testing.T) {
+	n := newNormalOptimizable()
+	f := Fix(n, "b")
+	par := f.GetFloatParameters()
+	if len(par) != 2 || par[0].Name() != "a" || par[1].Name() != "c" {
+		tst.Error("Wrong parameters:", par.NamesString())
+	}
+	if len(f.Copy().GetFloatParameters()) != 2 {
+		tst.Error("Fixed parameters are not preserved by copy")
+	}
+}